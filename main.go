@@ -2,41 +2,198 @@ package main
 
 import (
 	"./rcdaemon"
-	"os"
-	"strconv"
+	"context"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 func main() {
-	redisHost, exists := os.LookupEnv("REDIS_HOST")
-	if !exists {
-		panic("REDIS_HOST env should be provided")
+	config, err := rcdaemon.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rcdaemon.Configure(config)
+	if err := rcdaemon.SetupLog(config); err != nil {
+		log.Fatal(err)
 	}
 
-	redisPortStr, exists := os.LookupEnv("REDIS_PORT")
-	if !exists {
-		redisPortStr = "6379"
+	if config.ChaosMode {
+		log.Printf("CHAOS_MODE is on: %v of requests delayed by %v, %v failed", config.ChaosLatencyRate, config.ChaosLatency, config.ChaosErrorRate)
+	}
+	log.Printf("Using redis connection to %s", config.RedisAddr)
+	rcdaemon.Connect(config)
+	if config.RedisWarmup > 0 {
+		n, err := rcdaemon.WarmUp(config.RedisWarmup)
+		if err != nil {
+			log.Printf("Redis warmup stopped after %d connections: %v", n, err)
+		} else {
+			log.Printf("Opened %d connections to redis", n)
+		}
 	}
 
-	redisPort, err := strconv.Atoi(redisPortStr)
-	log.Printf("Using redis connection to %s:%d", redisHost, redisPort)
+	if ok, err := rcdaemon.CheckScripting(); err != nil {
+		log.Printf("Checking Lua scripting failed, assuming it works: %v", err)
+	} else if ok {
+		log.Printf("Redis runs Lua scripts")
+	}
+
+	if config.PreloadFile != "" {
+		n, err := rcdaemon.Preload(config.PreloadFile)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Preloaded %d entries from %s", n, config.PreloadFile)
+	}
 
 	server, err := rcdaemon.NewServer("", nil)
 	if err != nil {
 		panic(err)
 	}
+	server.ReusePort = config.ReusePort
+	server.AcceptLoops = config.AcceptLoops
 
 	// register handler
 	server.RegisterFunc("get", rcdaemon.GetHandler)
 	server.RegisterFunc("gets", rcdaemon.GetHandler)
 	server.RegisterFunc("add", rcdaemon.AddHandler)
 	server.RegisterFunc("set", rcdaemon.SetHandler)
+	server.RegisterFunc("add_get", rcdaemon.AddGetHandler)
+	server.RegisterFunc("append", rcdaemon.AppendHandler)
+	server.RegisterFunc("prepend", rcdaemon.PrependHandler)
+	server.RegisterFunc("mg", rcdaemon.MetaGetHandler)
+	server.RegisterFunc("ttl", rcdaemon.TTLHandler)
 	server.RegisterFunc("delete", rcdaemon.DeleteHandler)
 	server.RegisterFunc("incr", rcdaemon.IncrHandler)
+	server.RegisterFunc("decr", rcdaemon.DecrHandler)
 	server.RegisterFunc("flush_all", rcdaemon.FlushAllHandler)
 	server.RegisterFunc("version", rcdaemon.VersionHandler)
+	server.RegisterFunc("noop", rcdaemon.NoopHandler)
+	server.RegisterFunc("ping", rcdaemon.NoopHandler)
+	server.RegisterFunc("stats", server.StatsHandler)
+	server.RegisterFunc("time", server.TimeHandler)
+	server.RegisterFunc("cache_memlimit", rcdaemon.CacheMemlimitHandler)
+	server.RegisterFunc("invalidate_tag", rcdaemon.InvalidateTagHandler)
+	server.RegisterFunc("lru_crawler", rcdaemon.SlabsHandler)
+	server.RegisterFunc("slabs", rcdaemon.SlabsHandler)
+	if config.AdminCommands {
+		server.RegisterFunc("reconfigure", rcdaemon.ReconfigureHandler)
+		server.RegisterFunc("delete_matching", rcdaemon.DeleteMatchingHandler)
+		server.RegisterFunc("debug", rcdaemon.DebugHandler)
+	}
 
-	if err := server.ListenAndServe(); err != nil {
+	// operators get the stats and admin commands on the admin socket,
+	// whatever ADMIN_COMMANDS says for the network
+	var admin *rcdaemon.Server
+	if config.AdminSocket != "" {
+		admin, err = rcdaemon.NewServer(config.AdminSocket, nil)
+		if err != nil {
+			panic(err)
+		}
+		admin.Admin = true
+		admin.RegisterFunc("stats", server.StatsHandler)
+		admin.RegisterFunc("time", server.TimeHandler)
+		admin.RegisterFunc("version", rcdaemon.VersionHandler)
+		admin.RegisterFunc("noop", rcdaemon.NoopHandler)
+		admin.RegisterFunc("ping", rcdaemon.NoopHandler)
+		admin.RegisterFunc("flush_all", rcdaemon.FlushAllHandler)
+		admin.RegisterFunc("cache_memlimit", rcdaemon.CacheMemlimitHandler)
+		admin.RegisterFunc("reconfigure", rcdaemon.ReconfigureHandler)
+		admin.RegisterFunc("delete_matching", rcdaemon.DeleteMatchingHandler)
+		admin.RegisterFunc("debug", rcdaemon.DebugHandler)
+		go func() {
+			if err := admin.ListenAndServeUnix(); err != rcdaemon.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	var debug *http.Server
+	if config.DebugAddr != "" {
+		log.Printf("Serving debug variables on http://%s/debug/vars", config.DebugAddr)
+		debug = rcdaemon.DebugServer(config.DebugAddr)
+		go func() {
+			if err := debug.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// SIGHUP reopens the log file and reloads the configuration without
+	// dropping connections
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := rcdaemon.ReopenLog(); err != nil {
+				log.Printf("Reopening log file failed: %v", err)
+			}
+			restart, err := rcdaemon.Reload()
+			if err != nil {
+				log.Printf("Reloading configuration failed: %v", err)
+			} else if len(restart) > 0 {
+				log.Printf("Configuration reloaded, restart required for %v", restart)
+			} else {
+				log.Printf("Configuration reloaded")
+			}
+		}
+	}()
+
+	// SIGTERM and SIGINT let the clients finish for up to SHUTDOWN_GRACE,
+	// then ListenAndServeAll returns once the Redis pool is closed. The
+	// admin socket and DEBUG_ADDR stop listening at once too, and their
+	// connections are drained within the same grace.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		sig := <-term
+		grace := config.ShutdownGrace
+		log.Printf("Got %v, shutting down within %v", sig, grace)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		var wg sync.WaitGroup
+		if admin != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := admin.Shutdown(ctx); err != nil {
+					log.Printf("Admin socket shutdown: %v, remaining connections closed", err)
+				}
+			}()
+		}
+		if debug != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := debug.Shutdown(ctx); err != nil {
+					debug.Close()
+				}
+			}()
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v, remaining connections closed", err)
+		}
+		wg.Wait()
+	}()
+
+	// every LISTEN address is served by the same handlers, and drained by
+	// the same Shutdown
+	listen := config.Listen
+	if len(listen) == 0 {
+		listen = []string{server.Addr}
+	}
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.ListenAndServeAll(listen, tlsConfig); err != nil && err != rcdaemon.ErrServerClosed {
 		panic(err)
 	}
+	<-drained
+	log.Printf("Shut down")
 }
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// memcached binary protocol
+//
+// Only enough of it is understood to answer every request with an error:
+// redcached speaks the text protocol. A connection is binary if its first
+// byte is BinaryRequestMagic, which no text command starts with, and stays
+// so for its lifetime: a client cannot switch protocols mid-connection.
+
+const (
+	BinaryRequestMagic  = 0x80
+	BinaryResponseMagic = 0x81
+
+	// BinaryHeaderLen is the length of the header of every request and
+	// response.
+	BinaryHeaderLen = 24
+
+	// BinaryUnknownCommand is the status answered to every request.
+	BinaryUnknownCommand = 0x0081
+)
+
+// BinaryHeader is the header of a binary request, the fields needed to
+// answer it.
+type BinaryHeader struct {
+	Opcode  byte
+	BodyLen uint32 // extras, key and value
+	Opaque  uint32 // echoed in the response
+}
+
+// ErrNotBinary is returned by ReadBinaryRequest for a request that does not
+// start with BinaryRequestMagic. The stream cannot be resumed.
+var ErrNotBinary = NewProtocolError("not a binary request")
+
+// ReadBinaryRequest reads the next binary request, skipping its body.
+func ReadBinaryRequest(r *bufio.Reader) (BinaryHeader, error) {
+	var b [BinaryHeaderLen]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return BinaryHeader{}, err
+	}
+	if b[0] != BinaryRequestMagic {
+		return BinaryHeader{}, ErrNotBinary
+	}
+	h := BinaryHeader{
+		Opcode:  b[1],
+		BodyLen: binary.BigEndian.Uint32(b[8:12]),
+		Opaque:  binary.BigEndian.Uint32(b[12:16]),
+	}
+	if _, err := r.Discard(int(h.BodyLen)); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// AppendBinaryError appends the response to the request h with status and
+// message as its value, as memcached answers errors.
+func AppendBinaryError(b []byte, h BinaryHeader, status uint16, message string) []byte {
+	var hdr [BinaryHeaderLen]byte
+	hdr[0] = BinaryResponseMagic
+	hdr[1] = h.Opcode
+	binary.BigEndian.PutUint16(hdr[6:8], status)
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(message)))
+	binary.BigEndian.PutUint32(hdr[12:16], h.Opaque)
+	b = append(b, hdr[:]...)
+	return append(b, message...)
+}
@@ -3,7 +3,9 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -17,26 +19,91 @@ type McRequest struct {
 	Flags     string
 	Exptime   int64
 	Value     []byte
-	Increment int64
+	Increment uint64
 	Cas       string
 	Noreply   bool
+	Args      []string // arguments of commands like stats, which have no key
+	Opaque    string   // token echoed in the response, the O flag of meta commands
 }
 
+// ErrorKind classifies a ProtocolError by the memcached response it calls
+// for, so that the detail in its Description need not be matched.
+type ErrorKind int
+
+const (
+	// BadCommandLine is a malformed command line, answered `CLIENT_ERROR`
+	// and the Description.
+	BadCommandLine ErrorKind = iota
+	// BadDataChunk is a data block of the wrong length or without its
+	// terminator, answered `CLIENT_ERROR bad data chunk`.
+	BadDataChunk
+	// UnknownCommand is a command that is not known at all, an empty line
+	// or a get without keys, answered `ERROR` as memcached does.
+	UnknownCommand
+	// LineTooLong is ErrLineTooLong, after which the stream cannot be
+	// resumed.
+	LineTooLong
+)
+
 type ProtocolError struct {
+	Kind        ErrorKind
 	Description string
+	Noreply     bool // the malformed request still asked for no reply
 }
 
 func (e ProtocolError) Error() string {
 	return fmt.Sprintf("Protocol error: %s", e.Description)
 }
 
+// NewProtocolError returns a BadCommandLine error.
 func NewProtocolError(description string) ProtocolError {
-	return ProtocolError{description}
+	return ProtocolError{Kind: BadCommandLine, Description: description}
+}
+
+// MaxLineLength bounds the length of a command line, excluding the data
+// block. Longer lines are rejected with ErrLineTooLong.
+var MaxLineLength = 64 * 1024
+
+// MaxOpaqueLength is the longest opaque token accepted, as in memcached.
+const MaxOpaqueLength = 32
+
+// MaxExptime is the largest exptime accepted, a Unix time in 2106, as
+// memcached keeps exptimes in 32 bits. It keeps the TTLs derived from
+// exptimes well within the range of time.Duration.
+const MaxExptime = 1<<32 - 1
+
+// ErrLineTooLong is returned when a command line exceeds MaxLineLength.
+// The rest of the line is left unread, so the stream cannot be resumed.
+var ErrLineTooLong = ProtocolError{Kind: LineTooLong, Description: "bad command line format"}
+
+// readLine reads a whole command line without its terminator, without
+// buffering more than MaxLineLength bytes of it.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, isPrefix, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if isPrefix {
+		// line is only valid until the next read
+		line = append([]byte(nil), line...)
+	}
+	for isPrefix && len(line) <= MaxLineLength {
+		var more []byte
+		more, isPrefix, err = r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, more...)
+	}
+	if len(line) > MaxLineLength {
+		return nil, ErrLineTooLong
+	}
+	return line, nil
 }
 
 func ReadRequest(r *bufio.Reader) (req *McRequest, err error) {
 	// todo use a panic error handling pattern
-	lineBytes, _, err := r.ReadLine() // todo pref
+	lineBytes, err := readLine(r)
 	if err != nil {
 		return nil, err
 	}
@@ -44,12 +111,21 @@ func ReadRequest(r *bufio.Reader) (req *McRequest, err error) {
 	line := string(lineBytes)
 	arr := strings.Fields(line)
 	if len(arr) < 1 {
-		return nil, NewProtocolError("empty line")
+		return nil, ProtocolError{Kind: UnknownCommand, Description: "empty line"}
 	}
 
+	// A client that sent noreply is not reading responses, not even errors,
+	// so a CLIENT_ERROR would be taken as the reply to a later request.
+	defer func() {
+		if perr, ok := err.(ProtocolError); ok && acceptsNoreply[arr[0]] && arr[len(arr)-1] == "noreply" {
+			perr.Noreply = true
+			err = perr
+		}
+	}()
+
 	// arr[0] = strings.ToLower(arr[0])
 	switch arr[0] {
-	case "set", "add", "replace", "append", "prepend":
+	case "set", "add", "replace", "append", "prepend", "add_get":
 		// <command name> <key> <flags> <exptime> <bytes> [noreply]\r\n
 		// <data block>\r\n
 		req := &McRequest{}
@@ -60,45 +136,32 @@ func ReadRequest(r *bufio.Reader) (req *McRequest, err error) {
 			if arr[5] == "noreply" {
 				req.Noreply = true
 			} else {
-				return nil, NewProtocolError(fmt.Sprintf("syntax error"))
+				return nil, skipData(r, arr[4], NewProtocolError(fmt.Sprintf("syntax error")))
 			}
 		} else if len(arr) > 6 {
-			return nil, NewProtocolError(fmt.Sprintf("too many params for command %q", arr[0]))
+			return nil, skipData(r, arr[4], NewProtocolError(fmt.Sprintf("too many params for command %q", arr[0])))
 		}
 
 		req.Command = arr[0]
 		req.Key = arr[1]
 		req.Flags = arr[2]
+		if _, err := strconv.ParseUint(arr[2], 10, 32); err != nil {
+			return nil, skipData(r, arr[4], NewProtocolError("bad command line format"))
+		}
 		req.Exptime, err = strconv.ParseInt(arr[3], 10, 64)
 		if err != nil {
-			return nil, NewProtocolError("cannot read exptime " + err.Error())
+			return nil, skipData(r, arr[4], NewProtocolError("cannot read exptime "+err.Error()))
+		}
+		if req.Exptime > MaxExptime {
+			return nil, skipData(r, arr[4], NewProtocolError("bad command line format"))
 		}
 		bytes, err := strconv.Atoi(arr[4])
 		if err != nil {
 			return nil, NewProtocolError("cannot read bytes " + err.Error())
 		}
-		req.Value = make([]byte, bytes)
-		n, err := r.Read(req.Value)
-		if err != nil {
-			return nil, err
-		}
-		if n != bytes {
-			return nil, NewProtocolError(fmt.Sprintf("Read only %d bytes of %d bytes of expected data", n, bytes))
-		}
-		c, err := r.ReadByte()
-		if err != nil {
-			return nil, err
-		}
-		if c != '\r' {
-			return nil, NewProtocolError("expected \\r")
-		}
-		c, err = r.ReadByte()
-		if err != nil {
+		if req.Value, err = readData(r, bytes); err != nil {
 			return nil, err
 		}
-		if c != '\n' {
-			return nil, NewProtocolError("expected \\n")
-		}
 		return req, nil
 	case "cas":
 		// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]\r\n
@@ -114,6 +177,9 @@ func ReadRequest(r *bufio.Reader) (req *McRequest, err error) {
 		if err != nil {
 			return nil, NewProtocolError("cannot read exptime " + err.Error())
 		}
+		if req.Exptime > MaxExptime {
+			return nil, skipData(r, arr[4], NewProtocolError("bad command line format"))
+		}
 		bytes, err := strconv.Atoi(arr[4])
 		if err != nil {
 			return nil, err
@@ -122,43 +188,26 @@ func ReadRequest(r *bufio.Reader) (req *McRequest, err error) {
 		if len(arr) > 6 && arr[6] == "noreply" {
 			req.Noreply = true
 		}
-		req.Value = make([]byte, bytes)
-		n, err := r.Read(req.Value)
-		if err != nil {
+		if req.Value, err = readData(r, bytes); err != nil {
 			return nil, err
 		}
-		if n != bytes {
-			return nil, NewProtocolError(fmt.Sprintf("Read only %d bytes of %d bytes of expected data", n, bytes))
-		}
-		c, err := r.ReadByte()
-		if err != nil {
-			return nil, err
-		}
-		if c != '\r' {
-			return nil, NewProtocolError("expected \\r")
-		}
-		c, err = r.ReadByte()
-		if err != nil {
-			return nil, err
-		}
-		if c != '\n' {
-			return nil, NewProtocolError("expected \\n")
-		}
 		return req, nil
 	case "delete":
 		// delete <key> [noreply]\r\n
 		req := &McRequest{}
 
+		// Old memcached accepted a hold time here; modern memcached only
+		// tolerates a literal 0 so that clients relying on it notice.
 		if len(arr) < 2 {
 			return nil, NewProtocolError(fmt.Sprintf("too few params for command %q", arr[0]))
-		} else if len(arr) == 3 {
-			if arr[3] == "noreply" {
-				req.Noreply = true
-			} else {
-				return nil, NewProtocolError(fmt.Sprintf("syntax error"))
+		} else if len(arr) > 2 {
+			holdIsZero := arr[2] == "0"
+			req.Noreply = arr[len(arr)-1] == "noreply"
+			valid := (len(arr) == 3 && (holdIsZero || req.Noreply)) ||
+				(len(arr) == 4 && holdIsZero && req.Noreply)
+			if !valid {
+				return nil, NewProtocolError("bad command line format.  Usage: delete <key> [noreply]")
 			}
-		} else if len(arr) > 3 {
-			return nil, NewProtocolError(fmt.Sprintf("too many params for command %q", arr[0]))
 		}
 
 		req.Command = arr[0]
@@ -170,52 +219,194 @@ func ReadRequest(r *bufio.Reader) (req *McRequest, err error) {
 	case "gets":
 		// gets <key>*\r\n
 		if len(arr) < 2 {
-			return nil, NewProtocolError(fmt.Sprintf("too few params for command %q", arr[0]))
+			return nil, ProtocolError{Kind: UnknownCommand, Description: fmt.Sprintf("no keys for command %q", arr[0])}
 		}
 		req := &McRequest{}
 		req.Command = arr[0]
 		req.Keys = arr[1:]
 		return req, nil
+	case "ttl":
+		// ttl <key>+\r\n
+		if len(arr) < 2 {
+			return nil, NewProtocolError(fmt.Sprintf("too few params for command %q", arr[0]))
+		}
+		return &McRequest{Command: arr[0], Keys: arr[1:]}, nil
+	case "mg":
+		// mg <key> <flag>*\r\n
+		if len(arr) < 2 {
+			return nil, NewProtocolError(fmt.Sprintf("too few params for command %q", arr[0]))
+		}
+		req := &McRequest{Command: arr[0], Key: arr[1]}
+		for _, flag := range arr[2:] {
+			if strings.HasPrefix(flag, "O") {
+				if len(flag)-1 > MaxOpaqueLength {
+					return nil, NewProtocolError("opaque token too long")
+				}
+				req.Opaque = flag[1:]
+				continue
+			}
+			req.Args = append(req.Args, flag)
+		}
+		return req, nil
 	case "incr", "decr":
 		// incr <key> <value> [noreply]\r\n
 		// decr <key> <value> [noreply]\r\n
 		req := &McRequest{}
 
-		if len(arr) < 3 {
-			return nil, NewProtocolError(fmt.Sprintf("too few params for command %q", arr[0]))
+		if len(arr) < 3 || len(arr) > 4 {
+			return nil, NewProtocolError("bad command line format")
 		} else if len(arr) == 4 {
 			if arr[3] == "noreply" {
 				req.Noreply = true
 			} else {
-				return nil, NewProtocolError(fmt.Sprintf("syntax error"))
+				return nil, NewProtocolError("bad command line format")
 			}
-		} else if len(arr) > 4 {
-			return nil, NewProtocolError(fmt.Sprintf("too many params for command %q", arr[0]))
 		}
 
 		req.Command = arr[0]
 		req.Key = arr[1]
-		req.Increment, err = strconv.ParseInt(arr[2], 10, 64)
+		req.Increment, err = strconv.ParseUint(arr[2], 10, 64)
 		if err != nil {
-			return nil, NewProtocolError("cannot read value " + err.Error())
+			return nil, NewProtocolError("invalid numeric delta argument")
 		}
 		return req, nil
 	case "touch":
 		// touch <key> <exptime> [noreply]\r\n
 	case "flush_all":
-		// flush_all [<exptime>] [<noreply>]\r\n
-		// TODO: Implement support for the optional exptime and noreply args.
-		return &McRequest{Command: arr[0]}, nil
+		// flush_all [<exptime>] [noreply]\r\n
+		// TODO: Implement the exptime, a delay before the flush.
+		req := &McRequest{Command: arr[0]}
+		args := arr[1:]
+		if n := len(args); n > 0 && args[n-1] == "noreply" {
+			req.Noreply = true
+			args = args[:n-1]
+		}
+		if len(args) > 1 {
+			return nil, NewProtocolError("bad command line format")
+		} else if len(args) == 1 {
+			if req.Exptime, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+				return nil, NewProtocolError("bad command line format")
+			}
+		}
+		return req, nil
 	case "version":
 		// version\r\n
 		return &McRequest{Command: arr[0]}, nil
+	case "noop", "ping":
+		// noop\r\n
+		return &McRequest{Command: arr[0]}, nil
+	case "time":
+		// time\r\n
+		return &McRequest{Command: arr[0]}, nil
 	case "quit":
 		// quit\r\n
 		return &McRequest{Command: arr[0]}, nil
 	case "stats":
 		// stats\r\n
-		// TODO stats <args>\r\n
-		return &McRequest{Command: arr[0]}, nil
+		// stats <args>\r\n
+		return &McRequest{Command: arr[0], Args: arr[1:]}, nil
+	case "cache_memlimit":
+		// cache_memlimit <megabytes> [noreply]\r\n
+		if len(arr) < 2 || len(arr) > 3 || (len(arr) == 3 && arr[2] != "noreply") {
+			return nil, NewProtocolError("bad command line format")
+		}
+		return &McRequest{Command: arr[0], Args: arr[1:2], Noreply: len(arr) == 3}, nil
+	case "invalidate_tag":
+		// invalidate_tag <tag> [noreply]\r\n
+		if len(arr) < 2 || len(arr) > 3 || (len(arr) == 3 && arr[2] != "noreply") {
+			return nil, NewProtocolError("bad command line format")
+		}
+		return &McRequest{Command: arr[0], Args: arr[1:2], Noreply: len(arr) == 3}, nil
+	case "delete_matching":
+		// delete_matching <pattern>\r\n
+		if len(arr) != 2 {
+			return nil, NewProtocolError("bad command line format")
+		}
+		return &McRequest{Command: arr[0], Args: arr[1:]}, nil
+	case "debug":
+		// debug key <key>\r\n
+		if len(arr) != 3 || arr[1] != "key" {
+			return nil, NewProtocolError("bad command line format")
+		}
+		return &McRequest{Command: arr[0], Args: arr[1:]}, nil
+	case "lru_crawler", "slabs":
+		// lru_crawler <subcommand> <args>*\r\n
+		// slabs <subcommand> <args>*\r\n
+		return &McRequest{Command: arr[0], Args: arr[1:]}, nil
+	case "reconfigure":
+		// reconfigure <name>=<value>*\r\n
+		return &McRequest{Command: arr[0], Args: arr[1:]}, nil
+	}
+	return nil, ProtocolError{Kind: UnknownCommand, Description: fmt.Sprintf("unknown command %q", arr[0])}
+}
+
+// Commands taking a trailing noreply argument.
+var acceptsNoreply = map[string]bool{
+	"set": true, "add": true, "replace": true, "append": true, "prepend": true,
+	"cas": true, "delete": true, "incr": true, "decr": true, "touch": true,
+	"flush_all": true, "cache_memlimit": true, "invalidate_tag": true,
+	"add_get": true,
+}
+
+// readData reads a data block of exactly n bytes and its terminator. The
+// block may itself contain "\r\n", so it is never scanned for a line end.
+func readData(r *bufio.Reader, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ProtocolError{Kind: BadDataChunk, Description: "bad data chunk"}
+	}
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if data[n] != '\r' {
+		return nil, ProtocolError{Kind: BadDataChunk, Description: "expected \\r"}
+	}
+	if data[n+1] != '\n' {
+		return nil, ProtocolError{Kind: BadDataChunk, Description: "expected \\n"}
+	}
+	return data[:n], nil
+}
+
+// skipData discards the data block of a storage command whose command line
+// was rejected, if its length can be told, so that the data is not read
+// as the next request. It returns perr.
+func skipData(r *bufio.Reader, length string, perr ProtocolError) ProtocolError {
+	if n, err := strconv.Atoi(length); err == nil && n >= 0 {
+		r.Discard(n + 2)
+	}
+	return perr
+}
+
+// HasBufferedRequest reports whether r already holds a whole request, so
+// that ReadRequest can return it without reading from the connection: a
+// command line and, for storage commands, its data block.
+func HasBufferedRequest(r *bufio.Reader) bool {
+	buf, _ := r.Peek(r.Buffered())
+	i := bytes.IndexByte(buf, '\n')
+	if i < 0 {
+		return false
+	}
+	arr := strings.Fields(string(buf[:i]))
+	size := ""
+	switch {
+	case len(arr) >= 5 && isStorageCommand(arr[0]):
+		size = arr[4]
+	case len(arr) >= 6 && arr[0] == "cas":
+		size = arr[4]
+	default:
+		return true
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return true // rejected without reading a data block
+	}
+	return len(buf)-(i+1) >= n+2
+}
+
+func isStorageCommand(cmd string) bool {
+	switch cmd {
+	case "set", "add", "replace", "append", "prepend", "add_get":
+		return true
 	}
-	return nil, NewProtocolError(fmt.Sprintf("unknown command %q", arr[0]))
+	return false
 }
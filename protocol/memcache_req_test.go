@@ -2,9 +2,13 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func testReq(in string, t *testing.T) (ret *McRequest, err error) {
@@ -21,6 +25,15 @@ func testReq(in string, t *testing.T) (ret *McRequest, err error) {
 	return ReadRequest(br)
 }
 
+func testProtocolError(in string, t *testing.T) ProtocolError {
+	_, err := testReq(in, t)
+	perr, ok := err.(ProtocolError)
+	if !ok {
+		t.Fatalf("ReadRequest(%q) err %v, want ProtocolError", in, err)
+	}
+	return perr
+}
+
 func TestSet(t *testing.T) {
 	ret, err := testReq("set KEY 0 0 10\r\n1234567890\r\n", t)
 	if err != nil {
@@ -37,10 +50,10 @@ func TestSet(t *testing.T) {
 		t.Errorf("Flags %s", ret.Flags)
 	}
 	if ret.Exptime != 0 {
-		t.Errorf("Exptime %s", ret.Exptime)
+		t.Errorf("Exptime %d", ret.Exptime)
 	}
-	if string(ret.Data) != "1234567890" {
-		t.Errorf("Data %s", ret.Data)
+	if string(ret.Value) != "1234567890" {
+		t.Errorf("Data %s", ret.Value)
 	}
 
 	// Out &{Command:set Key:KEY Keys:[] Flags:0 Exptime:0 Data:[49 50 51 52 53 54 55 56 57 48] Noreply:false}Written 28
@@ -76,13 +89,13 @@ func TestCas(t *testing.T) {
 		t.Errorf("Flags %s", ret.Flags)
 	}
 	if ret.Exptime != 0 {
-		t.Errorf("Exptime %s", ret.Exptime)
+		t.Errorf("Exptime %d", ret.Exptime)
 	}
 	if ret.Cas != "UNIQ" {
-		t.Errorf("Cas %s", ret.Exptime)
+		t.Errorf("Cas %s", ret.Cas)
 	}
-	if string(ret.Data) != "1234567890" {
-		t.Errorf("Data %s", ret.Data)
+	if string(ret.Value) != "1234567890" {
+		t.Errorf("Data %s", ret.Value)
 	}
 }
 
@@ -90,7 +103,424 @@ func TestProtocolError(t *testing.T) {
 	_, err := testReq("xxx KEY 0 0 10\r\n1234567890\r\n", t)
 	if perr, ok := err.(ProtocolError); ok {
 		t.Logf("Good error: %v", perr)
+		if perr.Kind != UnknownCommand {
+			t.Errorf("unknown command of kind %d", perr.Kind)
+		}
 		return
 	}
 	t.Fatalf("ReadRequest did not return error")
 }
+
+func TestDelete(t *testing.T) {
+	ret, err := testReq("delete KEY\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Command != "delete" || ret.Key != "KEY" || ret.Noreply {
+		t.Errorf("Req %+v", ret)
+	}
+}
+
+func TestDeleteZeroTime(t *testing.T) {
+	ret, err := testReq("delete KEY 0\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Key != "KEY" || ret.Noreply {
+		t.Errorf("Req %+v", ret)
+	}
+
+	ret, err = testReq("delete KEY 0 noreply\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Key != "KEY" || !ret.Noreply {
+		t.Errorf("Req %+v", ret)
+	}
+}
+
+func TestDeleteNonZeroTime(t *testing.T) {
+	for _, in := range []string{"delete KEY 5\r\n", "delete KEY 5 noreply\r\n", "delete KEY 0 junk\r\n"} {
+		perr := testProtocolError(in, t)
+		if perr.Description != "bad command line format.  Usage: delete <key> [noreply]" {
+			t.Errorf("%q: %v", in, perr)
+		}
+	}
+}
+
+func TestLongLineWithoutTerminator(t *testing.T) {
+	_, err := testReq("get "+strings.Repeat("k", 10*1024*1024), t)
+	if err != ErrLineTooLong {
+		t.Fatalf("ReadRequest err %v, want ErrLineTooLong", err)
+	}
+}
+
+func TestLongGetWithinLimit(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strings.Repeat("k", 50)
+	}
+	ret, err := testReq("get "+strings.Join(keys, " ")+"\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if len(ret.Keys) != len(keys) {
+		t.Errorf("got %d keys, want %d", len(ret.Keys), len(keys))
+	}
+}
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte("get a b c\r\n"))
+	f.Add([]byte("set KEY 0 0 10\r\n1234567890\r\n"))
+	f.Add([]byte("delete KEY 0 noreply\r\n"))
+	f.Fuzz(func(t *testing.T, in []byte) {
+		r := bufio.NewReader(bytes.NewReader(in))
+		for {
+			if _, err := ReadRequest(r); err == io.EOF || err == ErrLineTooLong {
+				return
+			} else if _, ok := err.(ProtocolError); !ok && err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestVersionIgnoresExtraTokens(t *testing.T) {
+	ret, err := testReq("version foo bar\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Command != "version" {
+		t.Errorf("Command %s", ret.Command)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	ret, err := testReq("incr KEY 5 noreply\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Command != "incr" || ret.Key != "KEY" || ret.Increment != 5 || !ret.Noreply {
+		t.Errorf("Req %+v", ret)
+	}
+}
+
+func TestIncrUnsignedDelta(t *testing.T) {
+	ret, err := testReq("incr KEY 18446744073709551615\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Increment != 1<<64-1 {
+		t.Errorf("Increment %d", ret.Increment)
+	}
+}
+
+func TestIncrBadCommandLine(t *testing.T) {
+	tests := map[string]string{
+		"incr\r\n":                          "bad command line format",
+		"incr KEY\r\n":                      "bad command line format",
+		"decr KEY 1 noreply x\r\n":          "bad command line format",
+		"incr KEY 1 junk\r\n":               "bad command line format",
+		"incr KEY x\r\n":                    "invalid numeric delta argument",
+		"decr KEY -1\r\n":                   "invalid numeric delta argument",
+		"incr KEY 18446744073709551616\r\n": "invalid numeric delta argument",
+	}
+	for in, want := range tests {
+		if perr := testProtocolError(in, t); perr.Description != want {
+			t.Errorf("%q: %q, want %q", in, perr.Description, want)
+		}
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	tests := map[string]ErrorKind{
+		"\r\n":                     UnknownCommand,
+		"xxx\r\n":                  UnknownCommand,
+		"get\r\n":                  UnknownCommand,
+		"gets \r\n":                UnknownCommand,
+		"set KEY 0 0\r\n":          BadCommandLine,
+		"set KEY 0 0 x\r\n":        BadCommandLine,
+		"set KEY 0 0 -1\r\n":       BadDataChunk,
+		"set KEY 0 0 2\r\nabc\r\n": BadDataChunk,
+		"incr KEY x\r\n":           BadCommandLine,
+		"get " + strings.Repeat("k", MaxLineLength) + "\r\n": LineTooLong,
+	}
+	for in, want := range tests {
+		if perr := testProtocolError(in, t); perr.Kind != want {
+			t.Errorf("%.20q: kind %d, want %d", in, perr.Kind, want)
+		}
+	}
+}
+
+func TestLineTooLongIsDistinct(t *testing.T) {
+	if NewProtocolError(ErrLineTooLong.Description) == ErrLineTooLong {
+		t.Errorf("ErrLineTooLong equals a plain protocol error")
+	}
+}
+
+func TestNoreplyProtocolError(t *testing.T) {
+	tests := map[string]bool{
+		"set KEY 0 x 5 noreply\r\nhello\r\n":  true,
+		"set KEY 0 0 5 noreply\r\nhello!\r\n": true,
+		"incr KEY x noreply\r\n":              true,
+		"delete KEY 5 noreply\r\n":            true,
+		"set KEY 0 x 5\r\nhello\r\n":          false,
+		"bogus noreply\r\n":                   false,
+	}
+	for in, want := range tests {
+		if _, err := testReq(in, t); err == nil {
+			t.Errorf("%q: no error", in)
+		} else if perr, ok := err.(ProtocolError); !ok || perr.Noreply != want {
+			t.Errorf("%q: %#v, want Noreply %v", in, err, want)
+		}
+	}
+}
+
+func TestBadSetSkipsData(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("set KEY 0 x 5 noreply\r\nhello\r\nget KEY\r\n"))
+	if _, err := ReadRequest(r); err == nil {
+		t.Fatalf("bad exptime accepted")
+	}
+	req, err := ReadRequest(r)
+	if err != nil || req.Command != "get" {
+		t.Errorf("next request %+v, %v", req, err)
+	}
+}
+
+func benchmarkReadRequest(b *testing.B, in string) {
+	b.ReportAllocs()
+	src := strings.NewReader(in)
+	r := bufio.NewReader(src)
+	for i := 0; i < b.N; i++ {
+		src.Reset(in)
+		r.Reset(src)
+		if _, err := ReadRequest(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadRequestGet(b *testing.B) {
+	benchmarkReadRequest(b, "get key1 key2 key3\r\n")
+}
+
+func BenchmarkReadRequestSet(b *testing.B) {
+	benchmarkReadRequest(b, "set key 0 0 100\r\n"+strings.Repeat("x", 100)+"\r\n")
+}
+
+func TestInvalidateTag(t *testing.T) {
+	ret, err := testReq("invalidate_tag user42 noreply\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Command != "invalidate_tag" || len(ret.Args) != 1 || ret.Args[0] != "user42" || !ret.Noreply {
+		t.Errorf("Req %+v", ret)
+	}
+	if perr := testProtocolError("invalidate_tag\r\n", t); perr.Description != "bad command line format" {
+		t.Errorf("no tag: %q", perr.Description)
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	ret, err := testReq("delete_matching session:*\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Command != "delete_matching" || len(ret.Args) != 1 || ret.Args[0] != "session:*" {
+		t.Errorf("Req %+v", ret)
+	}
+	for _, in := range []string{"delete_matching\r\n", "delete_matching a* b*\r\n"} {
+		if perr := testProtocolError(in, t); perr.Kind != BadCommandLine {
+			t.Errorf("%q: %+v", in, perr)
+		}
+	}
+}
+
+func TestDebugKey(t *testing.T) {
+	ret, err := testReq("debug key KEY\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if ret.Command != "debug" || len(ret.Args) != 2 || ret.Args[1] != "KEY" {
+		t.Errorf("Req %+v", ret)
+	}
+	for _, in := range []string{"debug\r\n", "debug key\r\n", "debug slabs KEY\r\n", "debug key a b\r\n"} {
+		if perr := testProtocolError(in, t); perr.Kind != BadCommandLine {
+			t.Errorf("%q: %+v", in, perr)
+		}
+	}
+}
+
+func TestSetValueWithCRLF(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("set KEY 0 0 10\r\nab\r\ncd\r\nef\r\nget KEY\r\n"))
+	req, err := ReadRequest(r)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if string(req.Value) != "ab\r\ncd\r\nef" {
+		t.Errorf("Value %q", req.Value)
+	}
+	if req, err = ReadRequest(r); err != nil || req.Command != "get" {
+		t.Errorf("next request %+v, %v", req, err)
+	}
+}
+
+func TestSetValueInPieces(t *testing.T) {
+	// larger than the bufio.Reader buffer and written in several pieces, so
+	// no single Read returns it whole
+	value := strings.Repeat("x\r\n", 10000)
+	r, w := io.Pipe()
+	go func() {
+		w.Write([]byte(fmt.Sprintf("set KEY 0 0 %d\r\n", len(value))))
+		for i := 0; i < len(value); i += 1000 {
+			w.Write([]byte(value[i : i+1000]))
+		}
+		w.Write([]byte("\r\n"))
+		w.Close()
+	}()
+	req, err := ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+	if string(req.Value) != value {
+		t.Errorf("Value of %d bytes, want %d", len(req.Value), len(value))
+	}
+}
+
+func TestSetBadDataChunk(t *testing.T) {
+	for _, in := range []string{"set KEY 0 0 -1\r\n\r\n", "set KEY 0 0 3\r\nabcd\r\n"} {
+		if _, err := testReq(in, t); err == nil {
+			t.Errorf("%q accepted", in)
+		}
+	}
+}
+
+func TestSetBadFlags(t *testing.T) {
+	for _, flags := range []string{"x", "-1", "4294967296"} {
+		r := bufio.NewReader(strings.NewReader("set KEY " + flags + " 0 5\r\nhello\r\nget KEY\r\n"))
+		if _, err := ReadRequest(r); err == nil {
+			t.Errorf("flags %s accepted", flags)
+		}
+		if req, err := ReadRequest(r); err != nil || req.Command != "get" {
+			t.Errorf("flags %s: next request %+v, %v", flags, req, err)
+		}
+	}
+}
+
+func TestSetHugeExptime(t *testing.T) {
+	for _, cmd := range []string{"set KEY 0 9223372036854775807 5", "cas KEY 0 4294967296 5 1"} {
+		r := bufio.NewReader(strings.NewReader(cmd + "\r\nhello\r\nget KEY\r\n"))
+		if _, err := ReadRequest(r); err == nil {
+			t.Errorf("%q accepted", cmd)
+		}
+		if req, err := ReadRequest(r); err != nil || req.Command != "get" {
+			t.Errorf("%q: next request %+v, %v", cmd, req, err)
+		}
+	}
+	req, err := testReq("set KEY 0 4294967295 5\r\nhello\r\n", t)
+	if err != nil || req.Exptime != MaxExptime {
+		t.Errorf("MaxExptime: %+v, %v", req, err)
+	}
+}
+
+// Requests arriving one byte per Read parse as when arriving whole: no
+// assumption is made that a Read returns a whole line or data block.
+func TestOneByteAtATime(t *testing.T) {
+	longGet := "get" + strings.Repeat(" KEY", 2000) // beyond the bufio.Reader buffer
+	stream := strings.Join([]string{
+		"set KEY 5 60 7 noreply\r\nab\r\ncde\r\n",
+		"cas KEY 0 0 2 99\r\nxy\r\n",
+		"add_get KEY 0 0 0\r\n\r\n",
+		"get A B C\r\n",
+		longGet + "\r\n",
+		"incr KEY 18446744073709551615\r\n",
+		"delete KEY noreply\r\n",
+		"mg KEY s v\r\n",
+		"stats settings\r\n",
+	}, "")
+
+	whole := bufio.NewReader(strings.NewReader(stream))
+	trickled := bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(stream)), 16)
+	for i := 0; ; i++ {
+		want, wantErr := ReadRequest(whole)
+		got, err := ReadRequest(trickled)
+		if wantErr == io.EOF {
+			if err != io.EOF {
+				t.Errorf("request %d after the stream: %+v, %v", i, got, err)
+			}
+			return
+		}
+		if wantErr != nil {
+			t.Fatalf("request %d: %v", i, wantErr)
+		}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("request %d read a byte at a time: %+v, %v, want %+v", i, got, err, want)
+		}
+	}
+}
+
+func TestHasBufferedRequest(t *testing.T) {
+	for in, want := range map[string]bool{
+		"":                            false,
+		"get KEY":                     false,
+		"get KEY\r\n":                 true,
+		"get KEY\r\nget":              true,
+		"set KEY 0 0 5\r\n":           false,
+		"set KEY 0 0 5\r\nhel":        false,
+		"set KEY 0 0 5\r\nhello\r":    false,
+		"set KEY 0 0 5\r\nhello\r\n":  true,
+		"add_get KEY 0 0 0\r\n\r\n":   true,
+		"cas KEY 0 0 2 99\r\nx":       false,
+		"cas KEY 0 0 2 99\r\nxy\r\n":  true,
+		"set KEY 0 0 bad\r\n":         true, // rejected at once
+		"set KEY 0 0\r\n":             true,
+		"incr KEY 1\r\nset KEY 0 0 5": true,
+	} {
+		br := bufio.NewReader(strings.NewReader(in))
+		br.Peek(1)
+		if got := HasBufferedRequest(br); got != want {
+			t.Errorf("HasBufferedRequest(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestMetaOpaque(t *testing.T) {
+	req, err := testReq("mg KEY s Oreq-17 v\r\n", t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Opaque != "req-17" || strings.Join(req.Args, " ") != "s v" {
+		t.Errorf("opaque %q, flags %q", req.Opaque, req.Args)
+	}
+	if perr := testProtocolError("mg KEY O"+strings.Repeat("x", MaxOpaqueLength+1)+"\r\n", t); perr.Description != "opaque token too long" {
+		t.Errorf("long opaque token: %v", perr)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	req, err := testReq("ttl A B\r\n", t)
+	if err != nil || req.Command != "ttl" || strings.Join(req.Keys, " ") != "A B" {
+		t.Errorf("ttl A B: %+v, %v", req, err)
+	}
+	testProtocolError("ttl\r\n", t)
+}
+
+func TestFlushAll(t *testing.T) {
+	for in, want := range map[string]McRequest{
+		"flush_all\r\n":            {Command: "flush_all"},
+		"flush_all noreply\r\n":    {Command: "flush_all", Noreply: true},
+		"flush_all 0\r\n":          {Command: "flush_all"},
+		"flush_all 10 noreply\r\n": {Command: "flush_all", Exptime: 10, Noreply: true},
+	} {
+		req, err := testReq(in, t)
+		if err != nil || !reflect.DeepEqual(*req, want) {
+			t.Errorf("%q: %+v, %v, want %+v", in, req, err, want)
+		}
+	}
+	for _, in := range []string{"flush_all soon\r\n", "flush_all 0 0\r\n"} {
+		testProtocolError(in, t)
+	}
+	if perr := testProtocolError("flush_all soon noreply\r\n", t); !perr.Noreply {
+		t.Errorf("malformed flush_all noreply answered")
+	}
+}
@@ -1,13 +1,14 @@
 package protocol
 
 import (
-	"bytes"
 	"strconv"
+	"strings"
 )
 
 type McResponse struct {
 	Response string
 	Values   []McValue
+	Opaque   string // echoed as an O flag after the status line, see AppendProtocol
 }
 
 type McValue struct {
@@ -19,24 +20,46 @@ type McValue struct {
 
 // converts McResponse to string to send over wire
 func (r McResponse) Protocol() string {
-	var b bytes.Buffer
+	return string(r.AppendProtocol(nil))
+}
 
+// AppendProtocol appends the wire format of r to b, so that a connection
+// can reuse one buffer for all its responses.
+func (r McResponse) AppendProtocol(b []byte) []byte {
 	for i := range r.Values {
 		//b.WriteString(fmt.Sprintf("VALUE %s %s %d\r\n", r.Values[i].Key, r.Values[i].Flags, len(r.Values[i].Data)))
-		b.WriteString("VALUE ")
-		b.WriteString(r.Values[i].Key)
-		b.WriteString(" ")
-		b.WriteString(r.Values[i].Flags)
-		b.WriteString(" ")
-		b.WriteString(strconv.Itoa(len(r.Values[i].Data)))
-		b.WriteString("\r\n")
-
-		b.Write(r.Values[i].Data)
-		b.WriteString("\r\n")
+		b = append(b, "VALUE "...)
+		b = append(b, r.Values[i].Key...)
+		b = append(b, ' ')
+		b = append(b, r.Values[i].Flags...)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(len(r.Values[i].Data)), 10)
+		b = append(b, "\r\n"...)
+
+		b = append(b, r.Values[i].Data...)
+		b = append(b, "\r\n"...)
 	}
 
-	b.WriteString(r.Response)
-	b.WriteString("\r\n")
+	if r.Opaque == "" || isError(r.Response) {
+		b = append(b, r.Response...)
+	} else {
+		// the status line of a meta response ends with its flags
+		line, rest := r.Response, ""
+		if i := strings.Index(line, "\r\n"); i >= 0 {
+			line, rest = line[:i], line[i:]
+		}
+		b = append(b, line...)
+		b = append(b, " O"...)
+		b = append(b, r.Opaque...)
+		b = append(b, rest...)
+	}
+	b = append(b, "\r\n"...)
+
+	return b
+}
 
-	return b.String()
+// isError reports whether response is an error, which echoes no flags.
+func isError(response string) bool {
+	return response == "ERROR" || strings.HasPrefix(response, "ERROR ") ||
+		strings.HasPrefix(response, "CLIENT_ERROR") || strings.HasPrefix(response, "SERVER_ERROR")
 }
@@ -32,6 +32,7 @@ func TestResp2(t *testing.T) {
 		[]McValue{
 			McValue{"k1", "f1", []byte("123")},
 		},
+		"",
 	}
 	r := res.Protocol()
 
@@ -47,6 +48,7 @@ func TestResp3(t *testing.T) {
 			McValue{"k1", "f1", []byte("123")},
 			McValue{"k2", "f2", []byte("456")},
 		},
+		"",
 	}
 	r := res.Protocol()
 
@@ -54,3 +56,37 @@ func TestResp3(t *testing.T) {
 		t.Errorf("%v", r)
 	}
 }
+
+func BenchmarkRespValues(b *testing.B) {
+	b.ReportAllocs()
+	res := McResponse{Response: "END"}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		res.Values = append(res.Values, McValue{Key: key, Flags: "0", Data: make([]byte, 100)})
+	}
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = res.AppendProtocol(buf[:0])
+	}
+}
+
+func TestAppendProtocolReusesBuffer(t *testing.T) {
+	res := McResponse{Response: "END", Values: []McValue{{Key: "k", Flags: "0", Data: []byte("v")}}}
+	buf := McResponse{Response: "STORED"}.AppendProtocol(nil)
+	if got := string(res.AppendProtocol(buf[:0])); got != res.Protocol() || got != "VALUE k 0 1\r\nv\r\nEND\r\n" {
+		t.Errorf("AppendProtocol %q", got)
+	}
+}
+
+func TestRespOpaque(t *testing.T) {
+	for r, want := range map[*McResponse]string{
+		{Response: "EN", Opaque: "1"}:                          "EN O1\r\n",
+		{Response: "HD s5 f0", Opaque: "abc"}:                  "HD s5 f0 Oabc\r\n",
+		{Response: "VA 2 s2\r\nhi", Opaque: "abc"}:             "VA 2 s2 Oabc\r\nhi\r\n",
+		{Response: "CLIENT_ERROR invalid flag", Opaque: "abc"}: "CLIENT_ERROR invalid flag\r\n",
+		{Response: "HD"}:                                       "HD\r\n",
+	} {
+		if got := r.Protocol(); got != want {
+			t.Errorf("%+v: %q, want %q", *r, got, want)
+		}
+	}
+}
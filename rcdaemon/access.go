@@ -0,0 +1,65 @@
+package rcdaemon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseCIDRs parses the comma-separated CIDR blocks of the setting name. A
+// bare address stands for itself alone, as a /32 or /128.
+func parseCIDRs(name, s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, block := range strings.Split(s, ",") {
+		block = strings.TrimSpace(block)
+		if !strings.Contains(block, "/") {
+			if ip := net.ParseIP(block); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, 8*net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(block)
+		if err != nil {
+			return nil, fmt.Errorf("%s should be CIDR blocks such as 10.0.0.0/8 or fd00::/8, separated by commas", name)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// formatCIDRs renders nets as they are set, for stats settings.
+func formatCIDRs(nets []*net.IPNet) string {
+	blocks := make([]string, len(nets))
+	for i, n := range nets {
+		blocks[i] = n.String()
+	}
+	return strings.Join(blocks, ",")
+}
+
+// refused returns why a connection from addr is refused by DENY_CIDRS or
+// ALLOW_CIDRS, or "" if it is not. Connections without an IP address,
+// such as those of the admin socket, are never refused.
+func refused(cfg *Config, addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	for _, n := range cfg.DenyCIDRs {
+		if n.Contains(tcp.IP) {
+			return "in DENY_CIDRS " + n.String()
+		}
+	}
+	if len(cfg.AllowCIDRs) == 0 {
+		return ""
+	}
+	for _, n := range cfg.AllowCIDRs {
+		if n.Contains(tcp.IP) {
+			return ""
+		}
+	}
+	return "not in ALLOW_CIDRS"
+}
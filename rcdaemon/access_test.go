@@ -0,0 +1,63 @@
+package rcdaemon
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs("ALLOW_CIDRS", "10.0.0.0/8, 192.168.1.7 ,fd00::/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := formatCIDRs(nets), "10.0.0.0/8,192.168.1.7/32,fd00::/8,::1/128"; got != want {
+		t.Errorf("parsed %s, want %s", got, want)
+	}
+	for _, s := range []string{"10.0.0.0/33", "host", "10.0.0.0/8,", "::1/129"} {
+		if _, err := parseCIDRs("ALLOW_CIDRS", s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestRefused(t *testing.T) {
+	allow, _ := parseCIDRs("ALLOW_CIDRS", "10.0.0.0/8,fd00::/8")
+	deny, _ := parseCIDRs("DENY_CIDRS", "10.1.0.0/16")
+	cfg := &Config{AllowCIDRs: allow, DenyCIDRs: deny}
+	tests := map[string]bool{
+		"10.2.3.4":        false,
+		"10.1.2.3":        true, // denied within an allowed block
+		"192.168.0.1":     true,
+		"::ffff:10.2.3.4": false,
+		"fd12::1":         false,
+		"2001:db8::1":     true,
+	}
+	for ip, want := range tests {
+		if reason := refused(cfg, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}); (reason != "") != want {
+			t.Errorf("%s refused %q, want %v", ip, reason, want)
+		}
+	}
+	if reason := refused(cfg, &net.UnixAddr{Name: "/run/admin.sock", Net: "unix"}); reason != "" {
+		t.Errorf("admin socket connection refused: %s", reason)
+	}
+	if reason := refused(&Config{DenyCIDRs: deny}, &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}); reason != "" {
+		t.Errorf("refused without ALLOW_CIDRS: %s", reason)
+	}
+}
+
+func TestRefusedConnectionClosed(t *testing.T) {
+	deny, _ := parseCIDRs("DENY_CIDRS", "127.0.0.0/8")
+	withConfig(t, func(cfg *Config) { cfg.DenyCIDRs = deny })
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("read from a denied connection: %v, want EOF", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.RejectedConnections != 1 || srv.TotalConnections != 0 {
+		t.Errorf("%d rejected, %d total connections, want 1 and 0", srv.RejectedConnections, srv.TotalConnections)
+	}
+}
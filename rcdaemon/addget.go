@@ -0,0 +1,85 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strconv"
+	"time"
+)
+
+// addGetScript stores ARGV[1] at KEYS[1] unless the key exists, with a TTL
+// of ARGV[2] milliseconds (none if 0, not stored if negative). It returns
+// 1 if it stored the value, the current value otherwise.
+var addGetScript = newScript(`
+local px = tonumber(ARGV[2])
+local stored
+if px > 0 then
+  stored = redis.call('SET', KEYS[1], ARGV[1], 'PX', px, 'NX')
+elseif px == 0 then
+  stored = redis.call('SET', KEYS[1], ARGV[1], 'NX')
+else
+  stored = redis.call('EXISTS', KEYS[1]) == 0
+end
+if stored then
+  return 1
+end
+return redis.call('GET', KEYS[1])
+`)
+
+// `add_get` handler, a non-standard extension
+//
+//	add_get <key> <flags> <exptime> <bytes> [noreply]\r\n
+//	<data block>\r\n
+//
+// Stores the item like add and answers STORED, or if the key exists
+// answers its current value like get does, in a VALUE line followed by
+// END, all in one script, or transaction, so nothing can come in between.
+func AddGetHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	key := req.Key
+	value := storedValue(req)
+	defer beginWrite(key)()
+	hotKeys.record(key)
+	exp, err := expirationParser(req.Exptime)
+	if err != nil {
+		return err
+	}
+	settleWrite(key)
+
+	px := int64(-1)
+	if !exp.past {
+		px = int64(hardTTL(exp) / time.Millisecond)
+		if !exp.unlimited && px <= 0 {
+			px = 1 // expires as good as immediately, but must not be unlimited
+		}
+	}
+	var result interface{}
+	if watchOps() {
+		result, err = addGetWatch(key, value, px)
+	} else {
+		result, err = addGetScript.Run([]string{key}, []string{string(value), strconv.FormatInt(px, 10)}).Result()
+	}
+	if err != nil {
+		return err
+	}
+
+	s, exists := result.(string)
+	if !exists {
+		if !exp.past {
+			if err := setStaleDeadline(key, exp); err != nil {
+				return err
+			}
+			if err := tagItem(key); err != nil {
+				return err
+			}
+			if err := recordStore(key, exp); err != nil {
+				return err
+			}
+		}
+		res.Response = "STORED"
+		return nil
+	}
+	if flags, data, ok := decodeValue(s); ok {
+		res.Values = []protocol.McValue{{Key: key, Flags: strconv.FormatUint(uint64(flags), 10), Data: []byte(data)}}
+	}
+	res.Response = "END"
+	return nil
+}
@@ -0,0 +1,34 @@
+package rcdaemon
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddGet(t *testing.T) {
+	srv, f := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	c.send(t, "add_get k 3 60 5\r\nfirst\r\n")
+	if line := c.readLine(t); line != "STORED" {
+		t.Fatalf("add_get of a new key %q", line)
+	}
+	if f.ttls["k"] != time.Minute {
+		t.Errorf("TTL %v, want 1m", f.ttls["k"])
+	}
+
+	c.send(t, "add_get k 0 0 6\r\nsecond\r\n")
+	want := []string{"VALUE k 3 5", "first", "END"}
+	if lines := c.readUntil(t, "END"); strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("add_get of an existing key %q, want %q", lines, want)
+	}
+
+	c.send(t, "add_get gone 0 1000000000 1\r\nx\r\n")
+	if line := c.readLine(t); line != "STORED" {
+		t.Errorf("add_get with a past exptime %q", line)
+	}
+	if _, ok := f.data["gone"]; ok {
+		t.Errorf("item with a past exptime stored")
+	}
+}
@@ -0,0 +1,129 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strconv"
+	"strings"
+)
+
+// concatScript adds ARGV[2] to the end (ARGV[1] 'append') or the start
+// ('prepend') of the data of KEYS[1], after the header of its value, see
+// encodeValue, keeping its TTL. It returns 1, 0 if the key does not exist
+// or its value has a header of an unknown version, or 2 if the data would
+// be longer than ARGV[3], leaving it as it is. Like concatValue.
+var concatScript = newScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+  return 0
+end
+local header = ''
+if string.sub(v, 1, 3) == '\0RC' then
+  if string.sub(v, 4, 4) ~= '\1' or #v < 8 then
+    return 0
+  end
+  header, v = string.sub(v, 1, 8), string.sub(v, 9)
+end
+if ARGV[1] == 'append' then
+  v = v .. ARGV[2]
+else
+  v = ARGV[2] .. v
+end
+if #v > tonumber(ARGV[3]) then
+  return 2
+end
+if header == '' and string.sub(v, 1, 3) == '\0RC' then
+  header = '\0RC\1\0\0\0\0'
+end
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl > 0 then
+  redis.call('PSETEX', KEYS[1], pttl, header .. v)
+else
+  redis.call('SET', KEYS[1], header .. v)
+end
+return 1
+`)
+
+// concatValue returns the Redis value v with data appended or prepended
+// (op), as concatScript computes it, or false if v has a header of an
+// unknown version.
+func concatValue(v, op, data string) (string, bool) {
+	header := ""
+	if strings.HasPrefix(v, valueMagic) {
+		if !strings.HasPrefix(v, valueMagic+"\x01") || len(v) < valueHeaderLen1 {
+			return "", false
+		}
+		header, v = v[:valueHeaderLen1], v[valueHeaderLen1:]
+	}
+	if op == "append" {
+		v += data
+	} else {
+		v = data + v
+	}
+	if header == "" && strings.HasPrefix(v, valueMagic) {
+		header = valueMagic + "\x01\x00\x00\x00\x00" // flags 0
+	}
+	return header + v, true
+}
+
+// `append` handler
+//
+// Adds the data to the end of an existing item, keeping its flags and TTL
+// (those of the request are ignored, as in memcached), or answers
+// NOT_STORED. Both memcached and Redis hold values as bytes, so appending
+// "5" to the counter "10" makes it "105", which incr then counts on from.
+func AppendHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	return concat("append", req, res)
+}
+
+// `prepend` handler, see AppendHandler.
+func PrependHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	return concat("prepend", req, res)
+}
+
+// concatStored, concatMissing and concatTooLarge are the results of
+// concatScript and concatWatch.
+const (
+	concatMissing  = int64(0)
+	concatStored   = int64(1)
+	concatTooLarge = int64(2)
+)
+
+// concat runs append or prepend for req, in concatScript, or concatWatch.
+// The item grown is at most ITEM_SIZE_MAX, see limitItemSize.
+func concat(op string, req *protocol.McRequest, res *protocol.McResponse) error {
+	key := req.Key
+	defer beginWrite(key)()
+	hotKeys.record(key)
+	settleWrite(key)
+	if cfg := config(); cfg.FlushPrefix != "" && len(flushingKeys(cfg.FlushPrefix, []string{key})) > 0 {
+		// flushed though not deleted yet: delete it now, or it would be
+		// kept as stored since flush_all
+		if err := backend.Del(key).Err(); err != nil {
+			return err
+		}
+		res.Response = "NOT_STORED"
+		return nil
+	}
+
+	// not retried: a retry after the script was applied would apply it twice
+	max := config().ItemSizeMax
+	var result interface{}
+	var err error
+	if watchOps() {
+		result, err = concatWatch(noRetry(), key, op, string(req.Value), max)
+	} else {
+		result, err = concatScript.RunOn(noRetry(), []string{key}, []string{op, string(req.Value), strconv.Itoa(max)}).Result()
+	}
+	if err != nil {
+		return unlessApplied(err)
+	}
+	switch result {
+	case concatStored:
+		res.Response = "STORED"
+	case concatTooLarge:
+		res.Response = "SERVER_ERROR out of memory storing object"
+	default:
+		res.Response = "NOT_STORED"
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"testing"
+	"time"
+)
+
+func TestAppendPrepend(t *testing.T) {
+	for _, mode := range []string{CompoundOpsLua, CompoundOpsWatch} {
+		f := useFakeBackend(t)
+		withConfig(t, func(cfg *Config) { cfg.CompoundOps = mode })
+		run := func(fn HandlerFn, req *protocol.McRequest) string {
+			res := &protocol.McResponse{}
+			if err := fn(req, res); err != nil {
+				t.Fatalf("COMPOUND_OPS=%s %s: %v", mode, req.Command, err)
+			}
+			return res.Response
+		}
+		get := func(key string) (flags, data string) {
+			res := &protocol.McResponse{}
+			if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{key}}, res); err != nil || len(res.Values) != 1 {
+				t.Fatalf("COMPOUND_OPS=%s get %s: %v, %v", mode, key, res.Values, err)
+			}
+			return res.Values[0].Flags, string(res.Values[0].Data)
+		}
+
+		run(SetHandler, &protocol.McRequest{Command: "set", Key: "n", Flags: "7", Exptime: 60, Value: []byte("10")})
+		if got := run(AppendHandler, &protocol.McRequest{Command: "append", Key: "n", Flags: "0", Value: []byte("5")}); got != "STORED" {
+			t.Errorf("COMPOUND_OPS=%s append: %q", mode, got)
+		}
+		if flags, data := get("n"); flags != "7" || data != "105" {
+			t.Errorf("COMPOUND_OPS=%s after append: flags %s, %q, want 7 and 105", mode, flags, data)
+		}
+		// memcached counts on from the bytes as they are
+		if got := run(IncrHandler, &protocol.McRequest{Command: "incr", Key: "n", Increment: 1}); got != "106" {
+			t.Errorf("COMPOUND_OPS=%s incr after append: %q, want 106", mode, got)
+		}
+		run(PrependHandler, &protocol.McRequest{Command: "prepend", Key: "n", Flags: "0", Value: []byte("00")})
+		if got := run(IncrHandler, &protocol.McRequest{Command: "incr", Key: "n", Increment: 1}); got != "107" {
+			t.Errorf("COMPOUND_OPS=%s incr after prepend: %q, want 107", mode, got)
+		}
+		if ttl := f.ttls["n"]; ttl <= 0 || ttl > time.Minute {
+			t.Errorf("COMPOUND_OPS=%s TTL %v after append, want the minute of the set", mode, ttl)
+		}
+
+		if got := run(AppendHandler, &protocol.McRequest{Command: "append", Key: "missing", Flags: "0", Value: []byte("x")}); got != "NOT_STORED" {
+			t.Errorf("COMPOUND_OPS=%s append to a missing key: %q", mode, got)
+		}
+		if _, ok := f.data["missing"]; ok {
+			t.Errorf("COMPOUND_OPS=%s append to a missing key created it", mode)
+		}
+
+		// the result takes a header once it looks like one
+		run(SetHandler, &protocol.McRequest{Command: "set", Key: "raw", Flags: "0", Value: []byte("RC")})
+		run(PrependHandler, &protocol.McRequest{Command: "prepend", Key: "raw", Flags: "0", Value: []byte("\x00")})
+		if flags, data := get("raw"); flags != "0" || data != "\x00RC" {
+			t.Errorf("COMPOUND_OPS=%s prepend making a header: flags %s, %q", mode, flags, data)
+		}
+	}
+}
+
+func TestConcatValueUnknownVersion(t *testing.T) {
+	if v, ok := concatValue(valueMagic+"\x09rest", "append", "x"); ok {
+		t.Errorf("appended to a value of an unknown version: %q", v)
+	}
+}
@@ -0,0 +1,139 @@
+package rcdaemon
+
+import (
+	"errors"
+	"gopkg.in/redis.v3"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Backend is the subset of the redis client used by the handlers.
+// *redis.Client satisfies it; tests substitute an in-memory fake.
+type Backend interface {
+	Get(key string) *redis.StringCmd
+	MGet(keys ...string) *redis.SliceCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+	Del(keys ...string) *redis.IntCmd
+	Exists(key string) *redis.BoolCmd
+	FlushAll() *redis.StatusCmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	SAdd(key string, members ...string) *redis.IntCmd
+	ConfigSet(parameter, value string) *redis.StatusCmd
+	Info() *redis.StringCmd
+	DbSize() *redis.IntCmd
+	Publish(channel, message string) *redis.IntCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args []string) *redis.Cmd
+	PoolStats() *redis.PoolStats
+	Close() error
+}
+
+// unretried is Redis without retries, for the commands that are not
+// idempotent, when backend retries. It is nil otherwise.
+var unretried Backend
+
+// Connect points the handlers at the Redis server configured in cfg.
+// With REDIS_MAX_RETRIES, commands failing on the network are retried,
+// except those run on unretried, which gets a pool of its own.
+func Connect(cfg *Config) {
+	opt := &redis.Options{
+		Addr:        cfg.RedisAddr,
+		PoolSize:    cfg.RedisPoolSize,
+		IdleTimeout: cfg.RedisIdleTimeout,
+		MaxRetries:  cfg.RedisMaxRetries,
+	}
+	backend = redis.NewClient(opt)
+	unretried = nil
+	if cfg.RedisMaxRetries > 0 {
+		once := *opt
+		once.MaxRetries = 0
+		unretried = redis.NewClient(&once)
+	}
+}
+
+// WarmUp opens n connections to Redis, checking each with a PING, and
+// leaves them idle in the pool so that the first requests after startup
+// do not each wait for a connection to be established. It returns how
+// many it opened. A Multi holds a connection of its own until closed, so
+// the n of them open as many.
+func WarmUp(n int) (int, error) {
+	client, ok := backend.(*redis.Client)
+	if !ok {
+		return 0, nil
+	}
+	multis := make([]*redis.Multi, 0, n)
+	defer func() {
+		for _, m := range multis {
+			m.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		m := client.Multi()
+		if err := m.Ping().Err(); err != nil {
+			m.Close()
+			return len(multis), err
+		}
+		multis = append(multis, m)
+	}
+	return len(multis), nil
+}
+
+// noRetry returns the backend for commands that must not be retried, which
+// may have been applied when they failed.
+func noRetry() Backend {
+	if unretried != nil {
+		return unretried
+	}
+	return backend
+}
+
+// closeBackend closes b and u, backend and unretried, if not nil.
+func closeBackend(b, u Backend) error {
+	if u != nil {
+		u.Close()
+	}
+	return b.Close()
+}
+
+// outcomeUnknownError reports a write that failed after it may have been
+// applied by Redis, which makes retrying it unsafe.
+type outcomeUnknownError struct {
+	err error
+}
+
+func (e outcomeUnknownError) Error() string {
+	return "outcome unknown: " + e.err.Error()
+}
+
+// unlessApplied wraps err in an outcomeUnknownError when it is a
+// connection failure that may have happened after the command was sent.
+// Replies from Redis and failures to connect are returned unchanged.
+func unlessApplied(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return outcomeUnknownError{err}
+	}
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return err
+	}
+	if _, ok := err.(net.Error); ok {
+		return outcomeUnknownError{err}
+	}
+	return err
+}
+
+// errReadOnly replaces READONLY errors, which Redis returns for writes sent
+// to a replica, e.g. when REDIS_ADDR points at one or after a failover.
+var errReadOnly = errors.New("backend is read-only")
+
+// backendError returns err as reported to clients, which is itself unless
+// better described.
+func backendError(err error) error {
+	if strings.HasPrefix(err.Error(), "READONLY") {
+		return errReadOnly
+	}
+	return err
+}
@@ -0,0 +1,494 @@
+package rcdaemon
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/redis.v3"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend is an in-memory Backend used by the handler tests.
+type fakeBackend struct {
+	mu   sync.Mutex
+	data map[string]string
+	ttls map[string]time.Duration
+
+	others map[string]string // keys holding other Redis types, to the type
+	sets   map[string]map[string]bool
+
+	scripts map[string]string // script cache, by sha1
+	evals   int               // number of Eval calls, i.e. script bodies sent
+
+	config map[string]string // CONFIG SET parameters
+	info   string            // INFO reply
+
+	published []string // PUBLISHed messages, after their channel and a space
+
+	fail     map[string]error // errors returned instead of running, by command name
+	failKeys map[string]error // errors returned by MGET and EVAL of these keys
+
+	scans      map[int64]string // SCAN cursors, to the last key returned
+	lastCursor int64
+
+	beforeExec func() // run before each EXEC, see fakeTx
+	execs      int    // EXECs of transactions, aborted or not
+}
+
+// useFakeBackend installs an empty fakeBackend for the duration of the test.
+func useFakeBackend(t testing.TB) *fakeBackend {
+	f := &fakeBackend{
+		data:     make(map[string]string),
+		ttls:     make(map[string]time.Duration),
+		others:   make(map[string]string),
+		sets:     make(map[string]map[string]bool),
+		scripts:  make(map[string]string),
+		config:   make(map[string]string),
+		fail:     make(map[string]error),
+		failKeys: make(map[string]error),
+		scans:    make(map[int64]string),
+	}
+	prev := backend
+	backend = f
+	t.Cleanup(func() { backend = prev })
+	return f
+}
+
+func (f *fakeBackend) Get(key string) *redis.StringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.data[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(v, nil)
+}
+
+func (f *fakeBackend) MGet(keys ...string) *redis.SliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail["mget"]; err != nil {
+		return redis.NewSliceResult(nil, err)
+	}
+	for _, key := range keys {
+		if err := f.failKeys[key]; err != nil {
+			return redis.NewSliceResult(nil, err)
+		}
+	}
+	vals := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if v, ok := f.data[key]; ok {
+			vals[i] = v
+		}
+	}
+	return redis.NewSliceResult(vals, nil)
+}
+
+func (f *fakeBackend) set(key string, value interface{}, expiration time.Duration) {
+	switch v := value.(type) {
+	case string:
+		f.data[key] = v
+	case []byte:
+		f.data[key] = string(v)
+	}
+	f.ttls[key] = expiration
+}
+
+func (f *fakeBackend) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail["set"]; err != nil {
+		return redis.NewStatusResult("", err)
+	}
+	f.set(key, value, expiration)
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeBackend) SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data[key]; ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	f.set(key, value, expiration)
+	return redis.NewBoolResult(true, nil)
+}
+
+func (f *fakeBackend) Expire(key string, expiration time.Duration) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sets[key]; ok && expiration > 0 {
+		f.ttls[key] = expiration
+		return redis.NewBoolResult(true, nil)
+	}
+	if _, ok := f.data[key]; !ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	if expiration <= 0 {
+		delete(f.data, key)
+		delete(f.ttls, key)
+	} else {
+		f.ttls[key] = expiration
+	}
+	return redis.NewBoolResult(true, nil)
+}
+
+func (f *fakeBackend) Del(keys ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	for _, key := range keys {
+		if _, ok := f.data[key]; ok {
+			delete(f.data, key)
+			delete(f.ttls, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (f *fakeBackend) Exists(key string) *redis.BoolCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail["exists"]; err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+	_, ok := f.data[key]
+	_, other := f.others[key]
+	return redis.NewBoolResult(ok || other, nil)
+}
+
+func (f *fakeBackend) FlushAll() *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = make(map[string]string)
+	f.ttls = make(map[string]time.Duration)
+	return redis.NewStatusResult("OK", nil)
+}
+
+// Scan only supports the patterns made by globEscape(prefix) + "*". Like
+// SCAN, it returns the keys that exist throughout the iteration even if
+// others are deleted meanwhile.
+func (f *fakeBackend) Scan(cursor int64, match string, count int64) *redis.ScanCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail["scan"]; err != nil {
+		return redis.NewScanCmdResult(nil, 0, err)
+	}
+	after := f.scans[cursor]
+	delete(f.scans, cursor)
+
+	var keys []string
+	for key := range f.data {
+		if globMatch(match, key) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if int64(len(keys)) <= count {
+		return redis.NewScanCmdResult(keys, 0, nil)
+	}
+	keys = keys[:count]
+	f.lastCursor++
+	f.scans[f.lastCursor] = keys[len(keys)-1]
+	return redis.NewScanCmdResult(keys, f.lastCursor, nil)
+}
+
+// globMatch reports whether s matches the SCAN MATCH pattern, which has
+// no character classes in the tests.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func (f *fakeBackend) SAdd(key string, members ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sets[key] == nil {
+		f.sets[key] = make(map[string]bool)
+	}
+	var n int64
+	for _, m := range members {
+		if !f.sets[key][m] {
+			f.sets[key][m] = true
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (f *fakeBackend) ConfigSet(parameter, value string) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.config[parameter] = value
+	return redis.NewStatusResult("OK", nil)
+}
+
+// Eval caches the script and runs it, see eval.
+func (f *fakeBackend) Eval(script string, keys []string, args []string) *redis.Cmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.evals++
+	h := sha1.Sum([]byte(script))
+	f.scripts[hex.EncodeToString(h[:])] = script
+	return f.eval(script, keys, args)
+}
+
+func (f *fakeBackend) EvalSha(sha string, keys []string, args []string) *redis.Cmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	script, ok := f.scripts[sha]
+	if !ok {
+		return redis.NewCmdResult(nil, fmt.Errorf("NOSCRIPT No matching script. Please use EVAL."))
+	}
+	return f.eval(script, keys, args)
+}
+
+// flushScripts empties the script cache, like SCRIPT FLUSH.
+func (f *fakeBackend) flushScripts() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scripts = make(map[string]string)
+}
+
+// eval runs a Go rendition of the scripts the handlers use.
+func (f *fakeBackend) eval(script string, keys []string, args []string) *redis.Cmd {
+	if err := f.fail["eval"]; err != nil {
+		return redis.NewCmdResult(nil, err)
+	}
+	for _, key := range keys {
+		if err := f.failKeys[key]; err != nil {
+			return redis.NewCmdResult(nil, err)
+		}
+	}
+	switch script {
+	case staleGetScript.src:
+		return redis.NewCmdResult(f.staleGet(keys, args), nil)
+	case incrScript.src:
+		return f.incr(keys[0], args[0], args[1])
+	case concatScript.src:
+		v, ok := f.data[keys[0]]
+		if !ok {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		if v, ok = concatValue(v, args[0], args[1]); !ok {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		max, _ := strconv.Atoi(args[2])
+		if _, item, _ := decodeValue(v); len(item) > max {
+			return redis.NewCmdResult(int64(2), nil)
+		}
+		f.data[keys[0]] = v
+		return redis.NewCmdResult(int64(1), nil)
+	case addGetScript.src:
+		if v, ok := f.data[keys[0]]; ok {
+			return redis.NewCmdResult(v, nil)
+		}
+		if px, _ := strconv.ParseInt(args[1], 10, 64); px >= 0 {
+			f.set(keys[0], args[0], time.Duration(px)*time.Millisecond)
+		}
+		return redis.NewCmdResult(int64(1), nil)
+	case debugKeyScript.src:
+		out := []interface{}{"none", int64(-2), nil, nil}
+		if v, ok := f.data[keys[0]]; ok {
+			out[0], out[1], out[2] = "string", int64(-1), v
+			if ttl := f.ttls[keys[0]]; ttl > 0 {
+				out[1] = int64(ttl / time.Millisecond)
+			}
+		} else if kind, ok := f.others[keys[0]]; ok {
+			out[0], out[1] = kind, int64(-1)
+		}
+		if v, ok := f.data[args[0]]; ok {
+			out[3] = v
+		}
+		return redis.NewCmdResult(out, nil)
+	case ttlScript.src:
+		pttls := make([]interface{}, len(keys))
+		for i, key := range keys {
+			switch _, ok := f.data[key]; {
+			case !ok:
+				pttls[i] = int64(-2)
+			case f.ttls[key] == 0:
+				pttls[i] = int64(-1)
+			default:
+				pttls[i] = int64(f.ttls[key] / time.Millisecond)
+			}
+		}
+		return redis.NewCmdResult(pttls, nil)
+	case probeScript.src:
+		return redis.NewCmdResult(int64(1), nil)
+	case missReasonScript.src:
+		out := make([]interface{}, len(keys))
+		for i, key := range keys {
+			typ := "none"
+			if _, ok := f.data[key]; ok {
+				typ = "string"
+			} else if other, ok := f.others[key]; ok {
+				typ = other
+			}
+			var tombstone interface{}
+			if v, ok := f.data[args[0]+"miss:"+key]; ok {
+				tombstone = v
+			}
+			out[i] = []interface{}{typ, tombstone}
+		}
+		return redis.NewCmdResult(out, nil)
+	case metaSizeScript.src:
+		v, ok := f.data[keys[0]]
+		if !ok {
+			return redis.NewCmdResult(nil, redis.Nil)
+		}
+		n, _ := strconv.Atoi(args[0])
+		if n > len(v) {
+			n = len(v)
+		}
+		return redis.NewCmdResult([]interface{}{int64(len(v)), v[:n]}, nil)
+	case writeBehindScript.src:
+		for i, key := range keys {
+			px, _ := strconv.ParseInt(args[2*i+1], 10, 64)
+			if px < 0 {
+				delete(f.data, key)
+				delete(f.ttls, key)
+				continue
+			}
+			f.set(key, args[2*i], time.Duration(px)*time.Millisecond)
+		}
+		return redis.NewCmdResult(int64(len(keys)), nil)
+	case invalidateTagScript.src:
+		var n int64
+		members := []interface{}{}
+		for key := range f.sets[keys[0]] {
+			if _, ok := f.data[key]; ok {
+				n++
+			}
+			delete(f.data, key)
+			delete(f.data, staleMetaKey(key))
+			if args[1] == "1" {
+				members = append(members, key)
+			}
+		}
+		delete(f.sets, keys[0])
+		return redis.NewCmdResult([]interface{}{n, members}, nil)
+	}
+	return redis.NewCmdResult(nil, fmt.Errorf("fakeBackend: unknown script"))
+}
+
+func (f *fakeBackend) staleGet(keys []string, args []string) interface{} {
+	now, _ := strconv.ParseInt(args[0], 10, 64)
+	out := make([]interface{}, len(keys))
+	for i, key := range keys {
+		v, ok := f.data[key]
+		if !ok {
+			_, wrong := f.others[key]
+			out[i] = []interface{}{nil, int64(0), boolInt(wrong)}
+			continue
+		}
+		elected := int64(0)
+		meta := staleMetaKey(key)
+		if soft, err := strconv.ParseInt(f.data[meta], 10, 64); err == nil && soft <= now {
+			f.data[meta] = "refreshing"
+			elected = 1
+		}
+		out[i] = []interface{}{v, elected, int64(0)}
+	}
+	return out
+}
+
+func (f *fakeBackend) incr(key, op, delta string) *redis.Cmd {
+	v, ok := f.data[key]
+	if !ok {
+		return redis.NewCmdResult(nil, redis.Nil)
+	}
+	header := ""
+	if strings.HasPrefix(v, valueMagic+"\x01") && len(v) >= valueHeaderLen1 {
+		header, v = v[:valueHeaderLen1], v[valueHeaderLen1:]
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return redis.NewCmdResult(nil, fmt.Errorf("NONNUMERIC"))
+	}
+	d, _ := strconv.ParseUint(delta, 10, 64)
+	switch {
+	case op == "incr":
+		n += d
+	case n < d:
+		n = 0
+	default:
+		n -= d
+	}
+	s := strconv.FormatUint(n, 10)
+	f.data[key] = header + s
+	return redis.NewCmdResult(s, nil)
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (f *fakeBackend) Info() *redis.StringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail["info"]; err != nil {
+		return redis.NewStringResult("", err)
+	}
+	return redis.NewStringResult(f.info, nil)
+}
+
+func (f *fakeBackend) DbSize() *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail["dbsize"]; err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	return redis.NewIntResult(int64(len(f.data)+len(f.others)), nil)
+}
+
+func (f *fakeBackend) Publish(channel, message string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail["publish"]; err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	f.published = append(f.published, channel+" "+message)
+	return redis.NewIntResult(1, nil)
+}
+
+func (f *fakeBackend) PoolStats() *redis.PoolStats {
+	return &redis.PoolStats{Requests: 3, Hits: 2, TotalConns: 1, FreeConns: 1}
+}
+
+func (f *fakeBackend) Close() error {
+	return nil
+}
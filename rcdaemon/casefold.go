@@ -0,0 +1,51 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strings"
+)
+
+// Case-insensitive keys
+//
+// With CASE_INSENSITIVE_KEYS, keys are lowercased before they reach the
+// handlers, so every command sees Foo and foo as the same item. VALUE lines
+// still carry the key as the client spelled it, as clients match them to
+// the keys they asked for.
+
+// foldKeys lowercases the keys of req if CASE_INSENSITIVE_KEYS is set. It
+// returns a function to call on the response, which puts back the client's
+// spelling of the keys in its values.
+func foldKeys(req *protocol.McRequest) func(res *protocol.McResponse) {
+	if !config().CaseInsensitiveKeys {
+		return keepKeys
+	}
+	req.Key = strings.ToLower(req.Key)
+	if req.Command == "invalidate_tag" && len(req.Args) > 0 {
+		req.Args = []string{strings.ToLower(req.Args[0])}
+	}
+	if len(req.Keys) == 0 {
+		return keepKeys
+	}
+
+	spelled := req.Keys
+	req.Keys = make([]string, len(spelled))
+	for i, key := range spelled {
+		req.Keys[i] = strings.ToLower(key)
+	}
+	folded := req.Keys
+	return func(res *protocol.McResponse) {
+		// values are in the order of the keys, without the misses
+		j := 0
+		for i := range res.Values {
+			for j < len(folded) && folded[j] != res.Values[i].Key {
+				j++
+			}
+			if j < len(folded) {
+				res.Values[i].Key = spelled[j]
+				j++
+			}
+		}
+	}
+}
+
+func keepKeys(res *protocol.McResponse) {}
@@ -0,0 +1,44 @@
+package rcdaemon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.CaseInsensitiveKeys = true })
+	srv, f := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	c.send(t, "set Foo 0 0 3\r\nbar\r\n")
+	if line := c.readLine(t); line != "STORED" {
+		t.Fatalf("set Foo %q", line)
+	}
+	if _, ok := f.data["foo"]; !ok {
+		t.Errorf("Redis keys %v, want foo", f.data)
+	}
+
+	c.send(t, "get foo\r\n")
+	want := []string{"VALUE foo 0 3", "bar", "END"}
+	if lines := c.readUntil(t, "END"); strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("get foo %q, want %q", lines, want)
+	}
+
+	// values keep the spelling of each key asked for
+	c.send(t, "get FOO missing fOo\r\n")
+	want = []string{"VALUE FOO 0 3", "bar", "VALUE fOo 0 3", "bar", "END"}
+	if lines := c.readUntil(t, "END"); strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("get FOO missing fOo %q, want %q", lines, want)
+	}
+}
+
+func TestCaseSensitiveKeysByDefault(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+	c.send(t, "set Foo 0 0 3\r\nbar\r\n")
+	c.readLine(t)
+	c.send(t, "get foo\r\n")
+	if line := c.readLine(t); line != "END" {
+		t.Errorf("get foo %q, want a miss", line)
+	}
+}
@@ -0,0 +1,74 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Chaos mode
+//
+// To exercise the timeouts and fallbacks of clients against a real cache
+// front-end, rather than a mock, redcached can inject faults: with
+// CHAOS_MODE set, a share CHAOS_LATENCY_RATE of requests is delayed by
+// CHAOS_LATENCY before it is served, and a share CHAOS_ERROR_RATE is not
+// served at all but answered chaosError. As a guard against running it in
+// production, CHAOS_MODE is refused unless every LISTEN address is a
+// loopback one, the other settings are refused without it, and it is only
+// read at startup. The ADMIN_SOCKET is left alone, so that operators can
+// still read stats and reconfigure while clients see faults.
+
+// chaosError is the response to the requests CHAOS_ERROR_RATE fails.
+const chaosError = "SERVER_ERROR injected by CHAOS_ERROR_RATE"
+
+// chaosDelays and chaosErrors count the requests delayed and failed by
+// chaos mode.
+var chaosDelays, chaosErrors uint64
+
+// injectChaos is the Middleware delaying and failing requests at random in
+// chaos mode, unless srv is an Admin one. It is installed by NewServer
+// inside the request counters, so failed requests are counted, and outside
+// the others, as the delay stands for the whole request.
+func (srv *Server) injectChaos(next HandlerFn) HandlerFn {
+	return func(req *protocol.McRequest, res *protocol.McResponse) error {
+		cfg := config()
+		if !cfg.ChaosMode || srv.Admin {
+			return next(req, res)
+		}
+		if cfg.ChaosLatency > 0 && chance(cfg.ChaosLatencyRate) {
+			atomic.AddUint64(&chaosDelays, 1)
+			time.Sleep(cfg.ChaosLatency)
+		}
+		if chance(cfg.ChaosErrorRate) {
+			atomic.AddUint64(&chaosErrors, 1)
+			res.Response = chaosError
+			return nil
+		}
+		return next(req, res)
+	}
+}
+
+// chance reports true with the probability rate, from 0 to 1.
+func chance(rate float64) bool {
+	return rate >= 1 || rate > 0 && rand.Float64() < rate
+}
+
+// checkChaosListen returns an error unless every address of listen, as in
+// LISTEN, is a loopback one. No LISTEN is the default address, on every
+// interface.
+func checkChaosListen(listen []string) error {
+	if len(listen) == 0 {
+		return fmt.Errorf("CHAOS_MODE needs LISTEN set to loopback addresses, such as 127.0.0.1:%d", DEFAULT_PORT)
+	}
+	for _, spec := range listen {
+		addr, _ := splitListenAddr(spec)
+		host, _, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("CHAOS_MODE refuses LISTEN %s, which is not a loopback address", spec)
+		}
+	}
+	return nil
+}
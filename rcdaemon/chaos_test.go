@@ -0,0 +1,120 @@
+package rcdaemon
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChaosMode(t *testing.T) {
+	srv, f := startTestServer(t)
+	c := dialTestServer(t, srv)
+	failed, delays := atomic.LoadUint64(&chaosErrors), atomic.LoadUint64(&chaosDelays)
+
+	withConfig(t, func(cfg *Config) {
+		cfg.ChaosMode = true
+		cfg.ChaosErrorRate = 1
+	})
+	c.send(t, "set k 0 0 1\r\nv\r\n")
+	if line := c.readLine(t); line != chaosError {
+		t.Errorf("set at CHAOS_ERROR_RATE 1 answered %q", line)
+	}
+	f.mu.Lock()
+	_, ok := f.data["k"]
+	f.mu.Unlock()
+	if ok {
+		t.Error("set failed by chaos mode served")
+	}
+
+	withConfig(t, func(cfg *Config) {
+		cfg.ChaosErrorRate = 0
+		cfg.ChaosLatency = 50 * time.Millisecond
+		cfg.ChaosLatencyRate = 1
+	})
+	start := time.Now()
+	c.send(t, "set k 0 0 1\r\nv\r\n")
+	if line := c.readLine(t); line != "STORED" {
+		t.Errorf("set at CHAOS_LATENCY_RATE 1 answered %q", line)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("set answered after %v, sooner than CHAOS_LATENCY", elapsed)
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.ChaosMode = false })
+	c.send(t, "set k 0 0 1\r\nv\r\n")
+	c.readLine(t)
+	if got := atomic.LoadUint64(&chaosErrors) - failed; got != 1 {
+		t.Errorf("%d chaos errors, want 1", got)
+	}
+	if got := atomic.LoadUint64(&chaosDelays) - delays; got != 1 {
+		t.Errorf("%d chaos delays, want 1", got)
+	}
+}
+
+func TestChaosModeGuard(t *testing.T) {
+	env := func(m map[string]string) map[string]string {
+		m["REDIS_ADDR"] = "x:1"
+		for _, name := range []string{"LISTEN", "MEMCACHED_PORT", "PORT"} {
+			if _, ok := m[name]; !ok {
+				m[name] = "" // whatever the environment says
+			}
+		}
+		return m
+	}
+	for _, m := range []map[string]string{
+		{"CHAOS_MODE": "true", "LISTEN": "127.0.0.1:11211"},
+		{"CHAOS_MODE": "true", "LISTEN": "localhost:11211, tls://[::1]:11212", "TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem"},
+		{"CHAOS_MODE": "true", "LISTEN": "127.0.0.1:11211", "CHAOS_LATENCY": "10ms", "CHAOS_LATENCY_RATE": "0.5", "CHAOS_ERROR_RATE": "0.01"},
+	} {
+		if _, _, err := loadWithOverrides(env(m)); err != nil {
+			t.Errorf("%v refused: %v", m, err)
+		}
+	}
+	for _, m := range []map[string]string{
+		{"CHAOS_MODE": "true"},
+		{"CHAOS_MODE": "true", "PORT": "11211"},
+		{"CHAOS_MODE": "true", "LISTEN": "0.0.0.0:11211"},
+		{"CHAOS_MODE": "true", "LISTEN": "127.0.0.1:11211,10.0.0.1:11211"},
+		{"CHAOS_MODE": "true", "LISTEN": ":11211"},
+		{"CHAOS_ERROR_RATE": "0.1", "LISTEN": "127.0.0.1:11211"},
+		{"CHAOS_MODE": "true", "LISTEN": "127.0.0.1:11211", "CHAOS_ERROR_RATE": "2"},
+	} {
+		if _, _, err := loadWithOverrides(env(m)); err == nil {
+			t.Errorf("%v accepted", m)
+		}
+	}
+}
+
+// The admin socket is left alone by chaos mode.
+func TestChaosModeSparesAdmin(t *testing.T) {
+	srv, _ := startTestServer(t)
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	admin, err := NewServer(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Admin = true
+	admin.RegisterFunc("stats", srv.StatsHandler)
+	admin.RegisterFunc("flush_all", FlushAllHandler)
+	go admin.ListenAndServeUnix()
+	withConfig(t, func(cfg *Config) {
+		cfg.ChaosMode = true
+		cfg.ChaosErrorRate = 1
+	})
+
+	c := dialUnixSocket(t, path)
+	c.send(t, "flush_all\r\nstats\r\n")
+	if line := c.readLine(t); line != "OK" {
+		t.Errorf("flush_all over the admin socket answered %q", line)
+	}
+	if line := c.readLine(t); line == chaosError {
+		t.Errorf("stats over the admin socket answered %q", line)
+	}
+
+	client := dialTestServer(t, srv)
+	client.send(t, "get k\r\n")
+	if line := client.readLine(t); line != chaosError {
+		t.Errorf("get over the network answered %q, want %q", line, chaosError)
+	}
+}
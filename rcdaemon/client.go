@@ -6,83 +6,253 @@ import (
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 )
 
 type HandlerFn func(req *protocol.McRequest, res *protocol.McResponse) error
 
 type Client struct {
+	ID      uint64               // assigned by the server, unique per process
 	Addr    string               // conn.RemoteAddr().String()
 	Conn    net.Conn             // i/o connection
 	methods map[string]HandlerFn // refer to Server.methods
+	srv     *Server
+
+	StartTime time.Time // when the connection was accepted
+
+	mu           sync.Mutex // guards the fields below, read by stats conns
+	LastActivity time.Time  // when the last command was received
+	LastCommand  string     // name of the last command received
+	Commands     int        // number of commands received
 }
 
 func NewClient(conn net.Conn, srv *Server) (c *Client, err error) {
-	// TODO set start time
-
 	// TODO set
 	//conn.SetKeepAlive(true)
 	//conn.SetKeepAlivePeriod(3 * time.Minute)
 
+	now := time.Now()
 	return &Client{
 		Addr:    conn.RemoteAddr().String(),
 		Conn:    conn,
 		methods: srv.methods,
+		srv:     srv,
+
+		StartTime:    now,
+		LastActivity: now,
 	}, nil
 }
 
+// touch records that cmd was received.
+func (client *Client) touch(cmd string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.LastActivity = time.Now()
+	client.LastCommand = cmd
+	client.Commands++
+}
+
+// activity returns the fields guarded by mu.
+func (client *Client) activity() (lastActivity time.Time, lastCommand string, commands int) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.LastActivity, client.LastCommand, client.Commands
+}
+
 func (client *Client) Serve() (err error) {
 	conn := client.Conn
+	client.srv.addClient(client)
+	defer client.srv.removeClient(client)
 	defer func() {
 		if err != nil {
 			// fmt.Fprintf(client.Conn, "-%s\n", err)
 		}
 		conn.Close()
+		_, _, commands := client.activity()
+		if err != nil && !expectedDisconnect(err) {
+			log.Printf("WARN: Client %s disconnected after %v, %d commands served: %v",
+				client.Addr, time.Since(client.StartTime), commands, err)
+		} else {
+			debugf("Client %s disconnected after %v, %d commands served",
+				client.Addr, time.Since(client.StartTime), commands)
+		}
 	}()
 
 	br := bufio.NewReader(conn)
-	bw := bufio.NewWriter(conn)
+	bw := bufio.NewWriter(deadlineWriter{conn})
+	var out []byte // serialized response, reused across requests
+
+	// the first byte decides the protocol for the whole connection
+	if first, err := br.Peek(1); err == nil && first[0] == protocol.BinaryRequestMagic {
+		return client.serveBinary(br, bw)
+	}
+
+	// Responses to pipelined requests are held in bw while further complete
+	// requests are already buffered, so a burst of them is answered in a
+	// few writes rather than one each. bw is flushed before the next read
+	// could block, before a response that would not fit in it, and after
+	// PIPELINE_LIMIT responses if set. A flush blocks once the client stops
+	// reading, which stops us reading more requests: that is the
+	// backpressure, nothing else queues up per connection.
+	//
+	// A client that never reads would block a flush for ever, so writes
+	// time out after WRITE_TIMEOUT, see deadlineWriter. bw then keeps
+	// failing, and the connection is closed before the next request.
+	pending := 0
+	respond := func(b []byte) {
+		if pending > 0 && len(b) > bw.Available() {
+			bw.Flush()
+			pending = 0
+		}
+		bw.Write(b)
+		pending++
+		if limit := config().PipelineLimit; limit > 0 && pending >= limit {
+			bw.Flush()
+			pending = 0
+		}
+	}
 
 	for {
+		if pending > 0 && !protocol.HasBufferedRequest(br) {
+			bw.Flush()
+			pending = 0
+		}
+		// an empty write reports the error of an earlier one, if any
+		if _, err := bw.Write(nil); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Printf("Client %s not reading responses for %v, connection closed", client.Addr, config().WriteTimeout)
+				return nil
+			}
+			return err
+		}
+
 		req, err := protocol.ReadRequest(br)
 		if perr, ok := err.(protocol.ProtocolError); ok {
 			log.Printf("%v ReadRequest protocol err: %v", conn, err)
-			bw.WriteString("CLIENT_ERROR " + perr.Error() + "\r\n")
-			bw.Flush()
+			debugVars.Add("protocol_errors", 1)
+			if perr.Kind == protocol.UnknownCommand || !perr.Noreply {
+				respond([]byte(protocolErrorResponse(perr) + "\r\n"))
+			}
+			if perr.Kind == protocol.LineTooLong {
+				bw.Flush()
+				return nil
+			}
 			continue
 		} else if err == io.EOF {
-			log.Printf("client closed connection (got EOF)")
+			debugf("Client %s closed the connection", client.Addr)
+			return nil
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() && client.srv.shuttingDown() {
+			bw.Flush()
 			return nil
 		} else if err != nil {
-			log.Printf("%v ReadRequest err: %v", conn, err)
-			return err
+			return err // logged as the client disconnects
 		}
-		log.Printf("%v Req: %+v\n", conn, req)
+		//log.Printf("%v Req: %+v\n", conn, req)
 
 		cmd := strings.ToLower(req.Command)
+		client.touch(cmd)
 		if cmd == "quit" {
-			log.Printf("client sent quit, connection closed")
+			// requests pipelined before quit have been served in order,
+			// their responses may still be held back
+			debugf("Client %s sent quit, connection closed", client.Addr)
+			bw.Flush()
 			return nil
 		}
 
 		res := &protocol.McResponse{}
 		fn, exists := client.methods[cmd]
 		if exists {
-			err := fn(req, res)
+			unfold := foldKeys(req)
+			err := call(fn, req, res)
+			unfold(res)
 			if err != nil {
 				log.Printf("ERROR: %v, Conn: %v, Req: %+v\n", err, conn, req)
-				res.Response = "SERVER_ERROR " + err.Error()
+				res.Response = "SERVER_ERROR " + backendError(err).Error()
 			}
+			res.Opaque = req.Opaque
 			if !req.Noreply {
 				//log.Printf("%v Res: %+v\n", conn, res)
-				bw.WriteString(res.Protocol())
-				bw.Flush()
+				out = res.AppendProtocol(out[:0])
+				respond(out)
 			}
 		} else {
-			res.Response = "ERROR not implemented cmd '" + cmd + "' in handler"
-			bw.WriteString(res.Protocol())
-			bw.Flush()
+			res.Response = unknownCommand("not implemented cmd '" + cmd + "' in handler")
+			out = res.AppendProtocol(out[:0])
+			respond(out)
 		}
 	}
 	return nil
 }
+
+// deadlineWriter writes to conn with a write deadline of WRITE_TIMEOUT
+// from the start of each write, if set.
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (w deadlineWriter) Write(b []byte) (int, error) {
+	if timeout := config().WriteTimeout; timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return w.conn.Write(b)
+}
+
+// serveBinary answers every request of a binary protocol connection with
+// BinaryUnknownCommand, until it closes or sends something else.
+func (client *Client) serveBinary(br *bufio.Reader, bw *bufio.Writer) error {
+	log.Printf("Client %s speaks the binary protocol, which is not supported", client.Addr)
+	var out []byte
+	for {
+		h, err := protocol.ReadBinaryRequest(br)
+		if err == protocol.ErrNotBinary {
+			log.Printf("Client %s switched protocols, connection closed", client.Addr)
+			return nil
+		} else if ne, ok := err.(net.Error); err == io.EOF || ok && ne.Timeout() && client.srv.shuttingDown() {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		client.touch("binary")
+		out = protocol.AppendBinaryError(out[:0], h, protocol.BinaryUnknownCommand, "Unknown command")
+		bw.Write(out)
+		bw.Flush()
+	}
+}
+
+// call runs the handler fn. A panic in it is logged with its stack and
+// answered SERVER_ERROR internal error, keeping the connection open.
+func call(fn HandlerFn, req *protocol.McRequest, res *protocol.McResponse) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("PANIC in %s handler: %v, Req: %+v\n%s", req.Command, p, req, debug.Stack())
+			*res = protocol.McResponse{Response: "SERVER_ERROR internal error"}
+			debugVars.Add("server_errors", 1)
+			err = nil
+		}
+	}()
+	return fn(req, res)
+}
+
+// protocolErrorResponse is the memcached response to a request ReadRequest
+// rejected with perr.
+func protocolErrorResponse(perr protocol.ProtocolError) string {
+	switch perr.Kind {
+	case protocol.UnknownCommand:
+		return unknownCommand(perr.Description)
+	case protocol.BadDataChunk:
+		return "CLIENT_ERROR bad data chunk"
+	}
+	return "CLIENT_ERROR " + perr.Description
+}
+
+// unknownCommand is the response to a command that is not supported:
+// plain ERROR as from memcached, or with VERBOSE_ERRORS the reason.
+func unknownCommand(reason string) string {
+	if config().VerboseErrors {
+		return "ERROR " + reason
+	}
+	return "ERROR"
+}
@@ -0,0 +1,184 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Get coalescing
+//
+// With COALESCE_GETS set, a get of a key that another get is already
+// fetching from Redis waits for that fetch and shares its result, rather
+// than reading the key again, so that a stampede on a hot key that just
+// expired costs Redis one read. A get never shares a fetch that started
+// before a write to the key through this process had completed, see
+// detachGets, so a client still reads its own writes.
+
+// flight is a fetch of one key from Redis by a get, shared by the gets of
+// the key that arrive while it runs.
+type flight struct {
+	done  chan struct{}
+	value *protocol.McValue // nil for a miss
+	err   error
+	// the get was answered with something else than values, such as
+	// CLIENT_ERROR with GET_WRONGTYPE=error: fetch the key again
+	unshared bool
+}
+
+var inFlight struct {
+	sync.Mutex
+	gets map[string]*flight
+}
+
+// errFetchPanicked fails the gets sharing a fetch whose get panicked, which
+// would otherwise wait for it for ever.
+var errFetchPanicked = errors.New("the get sharing its fetch panicked")
+
+// coalescedGets counts the keys of gets answered by another get's fetch.
+// Only accessed atomically.
+var coalescedGets uint64
+
+// coalesce returns get, sharing the fetches of keys with concurrent gets.
+func coalesce(get getFn) getFn {
+	return func(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error {
+		mine := make(map[string]*flight)
+		joined := make(map[string]*flight)
+		fetch := &protocol.McRequest{Command: req.Command}
+		inFlight.Lock()
+		if inFlight.gets == nil {
+			inFlight.gets = make(map[string]*flight)
+		}
+		for _, key := range req.Keys {
+			if mine[key] != nil || joined[key] != nil {
+				continue // a repeated key
+			}
+			if f := inFlight.gets[key]; f != nil {
+				joined[key] = f
+				continue
+			}
+			f := &flight{done: make(chan struct{})}
+			inFlight.gets[key] = f
+			mine[key] = f
+			fetch.Keys = append(fetch.Keys, key)
+		}
+		inFlight.Unlock()
+
+		fetched := &protocol.McResponse{Response: "END"}
+		if len(fetch.Keys) > 0 {
+			fetched.Response = ""
+			landed := false
+			defer func() {
+				if !landed { // get panicked, which goes on to call
+					land(cfg, mine, &protocol.McResponse{}, errFetchPanicked)
+				}
+			}()
+			err := get(cfg, fetch, fetched)
+			land(cfg, mine, fetched, err)
+			landed = true
+			if err != nil {
+				return err
+			}
+			if fetched.Response != "END" {
+				*res = *fetched
+				return nil
+			}
+		}
+
+		values := make(map[string]*protocol.McValue, len(req.Keys))
+		for i := range fetched.Values {
+			values[fetched.Values[i].Key] = &fetched.Values[i]
+		}
+		again := &protocol.McRequest{Command: req.Command}
+		for key, f := range joined {
+			<-f.done
+			switch {
+			case f.err != nil:
+				return f.err
+			case f.unshared:
+				again.Keys = append(again.Keys, key)
+			default:
+				values[key] = f.value
+				hotKeys.record(key)
+				atomic.AddUint64(&coalescedGets, 1)
+			}
+		}
+		if len(again.Keys) > 0 {
+			refetched := &protocol.McResponse{}
+			if err := get(cfg, again, refetched); err != nil {
+				return err
+			}
+			if refetched.Response != "END" {
+				*res = *refetched
+				return nil
+			}
+			for i := range refetched.Values {
+				values[refetched.Values[i].Key] = &refetched.Values[i]
+			}
+		}
+
+		// in the order of the keys, repeated ones included, as mget answers
+		seen := make(map[string]bool, len(req.Keys))
+		for _, key := range req.Keys {
+			if seen[key] {
+				hotKeys.record(key) // recorded once when fetched
+			}
+			seen[key] = true
+			if v := values[key]; v != nil {
+				res.Values = append(res.Values, *v)
+			}
+		}
+		res.Response = "END"
+		return nil
+	}
+}
+
+// land hands the result of a fetch of the keys of flights to the gets
+// waiting for them.
+func land(cfg *Config, flights map[string]*flight, fetched *protocol.McResponse, err error) {
+	values := make(map[string]protocol.McValue, len(fetched.Values))
+	for _, v := range fetched.Values {
+		if cfg.StaleGrace > 0 {
+			v = unelected(v, cfg.StaleFlag) // only the fetching get recomputes
+		}
+		values[v.Key] = v
+	}
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	for key, f := range flights {
+		if v, ok := values[key]; ok {
+			f.value = &v
+		}
+		f.err = err
+		f.unshared = err == nil && fetched.Response != "END"
+		if inFlight.gets[key] == f {
+			delete(inFlight.gets, key)
+		}
+		close(f.done)
+	}
+}
+
+// unelected returns v without the STALE_FLAG that elects the get it
+// answers to recompute the item.
+func unelected(v protocol.McValue, staleFlag uint32) protocol.McValue {
+	if flags, err := strconv.ParseUint(v.Flags, 10, 32); err == nil && uint32(flags)&staleFlag != 0 {
+		v.Flags = strconv.FormatUint(flags&^uint64(staleFlag), 10)
+	}
+	return v
+}
+
+// detachGets is called once keys have been written, or every key with
+// none, so that gets from then on fetch them anew rather than share a
+// fetch that may have read them before the write.
+func detachGets(keys ...string) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if len(keys) == 0 {
+		inFlight.gets = nil
+	}
+	for _, key := range keys {
+		delete(inFlight.gets, key)
+	}
+}
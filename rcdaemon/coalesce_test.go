@@ -0,0 +1,160 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// running pretends that a get is fetching key, until the returned function
+// lands the fetch with value.
+func running(key string) (end func(value string)) {
+	f := &flight{done: make(chan struct{})}
+	inFlight.Lock()
+	inFlight.gets = map[string]*flight{key: f}
+	inFlight.Unlock()
+	return func(value string) {
+		fetched := &protocol.McResponse{Response: "END", Values: []protocol.McValue{{Key: key, Flags: "0", Data: []byte(value)}}}
+		land(config(), map[string]*flight{key: f}, fetched, nil)
+	}
+}
+
+func storeValue(t *testing.T, key, value string) {
+	req := &protocol.McRequest{Command: "set", Key: key, Flags: "0", Value: []byte(value)}
+	if err := SetHandler(req, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalescedGet(t *testing.T) {
+	useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.CoalesceGets = true })
+	storeValue(t, "hot", "in redis")
+	storeValue(t, "cold", "in redis")
+	landHot := running("hot")
+	defer detachGets()
+
+	done := make(chan *protocol.McResponse)
+	go func() {
+		res := &protocol.McResponse{}
+		if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"cold", "hot", "hot"}}, res); err != nil {
+			t.Error(err)
+		}
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		t.Fatalf("answered %v before the fetch it shares landed", res.Values)
+	case <-time.After(20 * time.Millisecond):
+	}
+	landHot("shared")
+
+	res := <-done
+	var got []string
+	for _, v := range res.Values {
+		got = append(got, v.Key+"="+string(v.Data))
+	}
+	if want := "[cold=in redis hot=shared hot=shared]"; fmt.Sprint(got) != want {
+		t.Errorf("get: %v, want %s", got, want)
+	}
+}
+
+// A get after a write never shares a fetch that started before it.
+func TestCoalescedGetAfterWrite(t *testing.T) {
+	useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.CoalesceGets = true })
+	landHot := running("hot")
+	defer landHot("before the set")
+
+	storeValue(t, "hot", "set")
+	if got := getValues(t, "hot"); got["hot"] != "set" {
+		t.Errorf("get after set: %v, want hot=set", got)
+	}
+}
+
+func TestCoalescedGetsConcurrent(t *testing.T) {
+	useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.CoalesceGets = true })
+	storeValue(t, "hot", "v")
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				res := &protocol.McResponse{}
+				if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"hot", "missing"}}, res); err != nil {
+					t.Error(err)
+					return
+				}
+				if len(res.Values) != 1 || string(res.Values[0].Data) != "v" {
+					t.Errorf("get: %v, want hot=v", res.Values)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if len(inFlight.gets) != 0 {
+		t.Errorf("%d fetches left in flight", len(inFlight.gets))
+	}
+}
+
+// A get sharing the fetch of a get that panics fails rather than waits for
+// ever, and the key is fetched anew afterwards.
+func TestCoalescedGetPanic(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.CoalesceGets = true })
+	started, release := make(chan struct{}), make(chan struct{})
+	panicking := coalesce(func(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error {
+		close(started)
+		<-release
+		panic("lost connection")
+	})
+	fine := coalesce(func(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error {
+		res.Values = []protocol.McValue{{Key: "hot", Flags: "0", Data: []byte("v")}}
+		res.Response = "END"
+		return nil
+	})
+	get := func(get getFn) error {
+		return call(func(req *protocol.McRequest, res *protocol.McResponse) error {
+			return get(config(), req, res)
+		}, &protocol.McRequest{Command: "get", Keys: []string{"hot"}}, &protocol.McResponse{})
+	}
+
+	go get(panicking)
+	<-started
+	joined := make(chan error, 1)
+	go func() { joined <- get(fine) }()
+	select {
+	case err := <-joined:
+		t.Fatalf("answered %v before the fetch it shares landed", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-joined:
+		if err != errFetchPanicked {
+			t.Errorf("get sharing a panicking fetch failed with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("get sharing a panicking fetch still waiting")
+	}
+	if err := get(fine); err != nil {
+		t.Errorf("get after the panic: %v", err)
+	}
+}
+
+func TestUnelected(t *testing.T) {
+	v := unelected(protocol.McValue{Key: "k", Flags: fmt.Sprint(DefaultStaleFlag | 5)}, DefaultStaleFlag)
+	if v.Flags != "5" {
+		t.Errorf("flags %s, want 5", v.Flags)
+	}
+	if v := unelected(protocol.McValue{Key: "k", Flags: "5"}, DefaultStaleFlag); v.Flags != "5" {
+		t.Errorf("flags %s, want 5", v.Flags)
+	}
+}
@@ -0,0 +1,101 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Compatibility warnings
+//
+// Most requests are answered as memcached would, incr of a missing key and
+// decr below 0 included, but some are not: a flush_all delay is not
+// implemented, gets has no cas unique, and settings such as FLUSH_PREFIX or
+// TTL_MODE=relative change documented semantics. With STRICT_COMPAT set,
+// every request whose effect could differ from memcached's is logged as a
+// warning, with the setting it depends on, so that teams moving off
+// memcached can find the code relying on it. What is answered is unchanged.
+// Each kind of warning is logged at most once a second, with how many times
+// it was met since the start.
+
+// compatWarnings counts the requests met by compatibility warnings.
+var compatWarnings uint64
+
+// compatLog holds, for each kind of warning, the Unix time it was last
+// logged and how many times it was met.
+var compatLog = struct {
+	sync.Mutex
+	logged map[string]int64
+	met    map[string]uint64
+}{logged: map[string]int64{}, met: map[string]uint64{}}
+
+// compatStored are the commands storing an item with an exptime.
+var compatStored = map[string]bool{"set": true, "add": true, "append": true, "prepend": true, "add_get": true}
+
+// warnCompat is the Middleware logging the requests whose effect could
+// differ from memcached's, when STRICT_COMPAT is set. It is installed by
+// NewServer outside the others but auditNoreply, so that requests they
+// refuse are warned of too.
+func warnCompat(next HandlerFn) HandlerFn {
+	return func(req *protocol.McRequest, res *protocol.McResponse) error {
+		if cfg := config(); cfg.StrictCompat {
+			if kind, warning := compatGap(cfg, req); kind != "" {
+				logCompat(kind, req.Command+": "+warning)
+			}
+		}
+		return next(req, res)
+	}
+}
+
+// compatGap returns the kind of difference between the effect of req with
+// cfg and memcached's, and a warning saying what it is, or "" if it should
+// have none.
+func compatGap(cfg *Config, req *protocol.McRequest) (kind, warning string) {
+	if key, ok := reservedKey(req, cfg.ReservedPrefix); ok {
+		if cfg.RejectReservedKeys {
+			return "reserved key", fmt.Sprintf("key %s is refused, as REJECT_RESERVED_KEYS reserves RESERVED_PREFIX %q", key, cfg.ReservedPrefix)
+		}
+		return "reserved key", fmt.Sprintf("key %s is named like the keys redcached keeps, with RESERVED_PREFIX %q", key, cfg.ReservedPrefix)
+	}
+	switch cmd := req.Command; {
+	case cmd == "gets":
+		return "gets", "gets answers no cas unique, as cas is not implemented"
+	case cmd == "flush_all" && req.Exptime != 0:
+		return "flush delay", fmt.Sprintf("flush_all delay %d is not implemented, the flush is immediate", req.Exptime)
+	case cmd == "flush_all" && cfg.FlushPrefix != "":
+		return "flush prefix", fmt.Sprintf("flush_all only deletes the keys under FLUSH_PREFIX %q", cfg.FlushPrefix)
+	case cmd == "cache_memlimit" && cfg.CacheMemlimit == CacheMemlimitIgnore:
+		return cmd, "cache_memlimit is ignored, see CACHE_MEMLIMIT"
+	case (cmd == "lru_crawler" || cmd == "slabs") && cfg.SlabCommands == SlabCommandsIgnore:
+		return cmd, cmd + " is a no-op, see SLAB_COMMANDS"
+	case compatStored[cmd] && req.Exptime > 2592000 && cfg.TTLMode == TTLModeRelative:
+		return "relative exptime", fmt.Sprintf("exptime %d of %s is read as seconds from now by TTL_MODE=relative, memcached reads it as a Unix time", req.Exptime, req.Key)
+	case compatStored[cmd] && req.Exptime > 0 && cfg.TTLMode == TTLModeMilliseconds:
+		return "ms exptime", fmt.Sprintf("exptime %d of %s is read as milliseconds by TTL_MODE=milliseconds, memcached reads it as seconds", req.Exptime, req.Key)
+	case compatStored[cmd]:
+		ttl, err := parseExptime(req.Exptime)
+		if err == nil && !ttl.past && clampTTL(ttl, cfg.TTLMin, cfg.TTLMax) != ttl {
+			return "clamped exptime", fmt.Sprintf("exptime %d of %s is clamped by TTL_MIN/TTL_MAX", req.Exptime, req.Key)
+		}
+	}
+	return "", ""
+}
+
+// logCompat logs warning, of kind, unless a warning of that kind was logged
+// less than a second ago.
+func logCompat(kind, warning string) {
+	atomic.AddUint64(&compatWarnings, 1)
+	now := time.Now().Unix()
+	compatLog.Lock()
+	compatLog.met[kind]++
+	met := compatLog.met[kind]
+	logged := compatLog.logged[kind] == now
+	compatLog.logged[kind] = now
+	compatLog.Unlock()
+	if !logged {
+		log.Printf("COMPAT: %s (%s, %d so far)", warning, kind, met)
+	}
+}
@@ -0,0 +1,99 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetCompat forgets the compatibility warnings met, before and after the
+// test.
+func resetCompat(t *testing.T) {
+	reset := func() {
+		compatLog.Lock()
+		compatLog.logged, compatLog.met = map[string]int64{}, map[string]uint64{}
+		compatLog.Unlock()
+		atomic.StoreUint64(&compatWarnings, 0)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestStrictCompat(t *testing.T) {
+	srv, _ := startTestServer(t)
+	resetCompat(t)
+	withConfig(t, func(cfg *Config) { cfg.TTLMax = time.Hour })
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	c := dialTestServer(t, srv)
+
+	send := func() {
+		c.send(t, "set a 0 0 1\r\nv\r\nset b 0 7200 1\r\nv\r\ngets a\r\nflush_all 60\r\n")
+		for _, want := range []string{"STORED", "STORED", "VALUE a 0 1", "v", "END", "OK"} {
+			if line := c.readLine(t); line != want {
+				t.Fatalf("%q, want %q", line, want)
+			}
+		}
+	}
+	send()
+	if strings.Contains(logged.String(), "COMPAT") {
+		t.Errorf("warned without STRICT_COMPAT:\n%s", logged.String())
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.StrictCompat = true })
+	send()
+	send() // within the second, not logged again
+	log.SetOutput(os.Stderr)
+	out := logged.String()
+	for _, want := range []string{
+		"COMPAT: set: exptime 0 of a is clamped by TTL_MIN/TTL_MAX (clamped exptime, 1 so far)",
+		"COMPAT: gets: gets answers no cas unique, as cas is not implemented (gets, 1 so far)",
+		"COMPAT: flush_all: flush_all delay 60 is not implemented, the flush is immediate (flush delay, 1 so far)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log without %q:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "COMPAT"); n != 3 {
+		t.Errorf("%d warnings logged, want 3:\n%s", n, out)
+	}
+
+	c.send(t, "stats\r\n")
+	if stats := strings.Join(c.readUntil(t, "END"), "\n"); !strings.Contains(stats, "STAT compat_warnings 8\n") {
+		t.Errorf("stats\n%s", stats)
+	}
+}
+
+func TestCompatGap(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.TTLMode = TTLModeRelative
+		cfg.FlushPrefix = "app:"
+		cfg.RejectReservedKeys = true
+		cfg.CacheMemlimit = CacheMemlimitIgnore
+		cfg.SlabCommands = SlabCommandsIgnore
+	})
+	for _, tc := range []struct {
+		req  protocol.McRequest
+		kind string
+	}{
+		{protocol.McRequest{Command: "get", Keys: []string{"a", "__swr:k"}}, "reserved key"},
+		{protocol.McRequest{Command: "get", Keys: []string{"a"}}, ""},
+		{protocol.McRequest{Command: "incr", Key: "a"}, ""},
+		{protocol.McRequest{Command: "set", Key: "a", Exptime: 3000000}, "relative exptime"},
+		{protocol.McRequest{Command: "set", Key: "a", Exptime: 60}, ""},
+		{protocol.McRequest{Command: "flush_all"}, "flush prefix"},
+		{protocol.McRequest{Command: "flush_all", Exptime: 10}, "flush delay"},
+		{protocol.McRequest{Command: "slabs"}, "slabs"},
+		{protocol.McRequest{Command: "cache_memlimit"}, "cache_memlimit"},
+	} {
+		if kind, warning := compatGap(config(), &tc.req); kind != tc.kind {
+			t.Errorf("%s %s%v warned of %q (%s), want %q", tc.req.Command, tc.req.Key, tc.req.Keys, kind, warning, tc.kind)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package rcdaemon
+
+import (
+	"strings"
+	"testing"
+)
+
+// The responses memcached gives to storage and update commands, by the
+// state of the key: clients branch on these exact strings. Commands
+// without a handler yet are skipped, so their rows apply as soon as one is
+// registered in serveTestServer.
+func TestStorageResponses(t *testing.T) {
+	const (
+		absent  = ""
+		present = "v"
+		number  = "41"
+	)
+	srv, f := startTestServer(t)
+	c := dialTestServer(t, srv)
+	for _, tc := range []struct {
+		state, cmd, want string
+	}{
+		{absent, "set k 0 0 1\r\nx\r\n", "STORED"},
+		{present, "set k 0 0 1\r\nx\r\n", "STORED"},
+
+		{absent, "add k 0 0 1\r\nx\r\n", "STORED"},
+		{present, "add k 0 0 1\r\nx\r\n", "NOT_STORED"},
+
+		{absent, "replace k 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{present, "replace k 0 0 1\r\nx\r\n", "STORED"},
+
+		{absent, "append k 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{present, "append k 0 0 1\r\nx\r\n", "STORED"},
+		{absent, "prepend k 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{present, "prepend k 0 0 1\r\nx\r\n", "STORED"},
+
+		{absent, "cas k 0 0 1 1\r\nx\r\n", "NOT_FOUND"},
+		{present, "cas k 0 0 1 18446744073709551615\r\nx\r\n", "EXISTS"},
+
+		{absent, "delete k\r\n", "NOT_FOUND"},
+		{present, "delete k\r\n", "DELETED"},
+
+		{absent, "incr k 1\r\n", "NOT_FOUND"},
+		{number, "incr k 1\r\n", "42"},
+		{present, "incr k 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{absent, "decr k 1\r\n", "NOT_FOUND"},
+		{number, "decr k 1\r\n", "40"},
+		{present, "decr k 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+	} {
+		name := strings.Fields(tc.cmd)[0]
+		if _, ok := srv.methods[name]; !ok {
+			t.Logf("%s not implemented, skipped", name)
+			continue
+		}
+		f.mu.Lock()
+		delete(f.data, "k")
+		if tc.state != absent {
+			f.data["k"] = tc.state
+		}
+		f.mu.Unlock()
+		c.send(t, tc.cmd)
+		if line := c.readLine(t); line != tc.want {
+			t.Errorf("%q with k %q answered %q, want %q", tc.cmd, tc.state, line, tc.want)
+		}
+	}
+}
@@ -0,0 +1,688 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the settings read from the environment, or CONFIG_FILE, at startup.
+type Config struct {
+	RedisAddr     string // REDIS_ADDR, or REDIS_HOST and REDIS_PORT (default 6379)
+	RedisPoolSize int    // REDIS_POOL_SIZE: connections to Redis (default 100)
+
+	RedisIdleTimeout time.Duration // REDIS_IDLE_TIMEOUT: close connections idle this long (default 5m), 0 never
+	RedisMaxRetries  int           // REDIS_MAX_RETRIES: retries of commands failing on the network (default 1)
+	RedisWarmup      int           // REDIS_WARMUP: connections opened before listening, or all of the pool
+
+	Listen      []string // LISTEN: comma-separated host:port, or tls://host:port, to serve on; or MEMCACHED_PORT or PORT
+	TLSCertFile string   // TLS_CERT_FILE: certificate of the tls:// addresses, PEM encoded
+	TLSKeyFile  string   // TLS_KEY_FILE: its private key, PEM encoded
+
+	AllowCIDRs []*net.IPNet // ALLOW_CIDRS: comma-separated CIDR blocks, only they may connect
+	DenyCIDRs  []*net.IPNet // DENY_CIDRS: comma-separated CIDR blocks that may not connect
+
+	ReusePort   bool          // REUSEPORT: set SO_REUSEPORT on the listeners
+	AcceptLoops int           // ACCEPT_LOOPS: goroutines accepting on each listener (default 1)
+	TTLMode     string        // TTL_MODE: how exptimes are read, memcached (epochs above 30 days), relative or milliseconds
+	TTLMin      time.Duration // TTL_MIN: shorter TTLs are raised to this
+	TTLMax      time.Duration // TTL_MAX: longer and unlimited TTLs are capped to this
+	MaxTTL      time.Duration // MAX_TTL: no key is written to Redis with a longer or no TTL
+
+	PreloadFile string // PRELOAD_FILE: set commands replayed at startup
+
+	MaxLineLength int // MAX_LINE_LENGTH: longest accepted command line, in bytes
+	ItemSizeMax   int // ITEM_SIZE_MAX: largest item data stored, in bytes
+	PipelineLimit int // PIPELINE_LIMIT: most responses held back for a pipelining client, 0 no limit
+
+	DefaultFlags uint32 // DEFAULT_FLAGS: flags returned for items stored with flags 0
+
+	StaleGrace time.Duration // STALE_GRACE: serve items this long past their TTL
+	StaleFlag  uint32        // STALE_FLAG: flags bit marking the client elected to refresh
+
+	ShutdownGrace time.Duration // SHUTDOWN_GRACE: how long clients may finish on SIGTERM (default 10s)
+	WriteTimeout  time.Duration // WRITE_TIMEOUT: close clients not reading responses for this long (default 30s), 0 never
+
+	AdminCommands bool   // ADMIN_COMMANDS: register admin commands such as reconfigure
+	AdminSocket   string // ADMIN_SOCKET: Unix socket serving stats and admin commands
+	DebugAddr     string // DEBUG_ADDR: host:port serving the expvar counters on /debug/vars
+
+	CacheMemlimit   string  // CACHE_MEMLIMIT: what cache_memlimit does, ignore or redis
+	MemoryHighWater float64 // MEMORY_HIGH_WATER: share of the Redis memory limit above which writes are refused, 0 is off
+	SlabCommands    string  // SLAB_COMMANDS: what lru_crawler and slabs do, ignore or error
+
+	FlushPrefix    string // FLUSH_PREFIX: flush_all only deletes keys with this prefix
+	GetFlushing    string // GET_FLUSHING: get of a key a scoped flush_all is deleting, miss or value
+	DeleteMatching bool   // DELETE_MATCHING: enable the delete_matching admin command
+
+	InvalidationChannel string // INVALIDATION_CHANNEL: Redis pub/sub channel told of changed keys and flushes
+
+	GetWrongType string // GET_WRONGTYPE: get of a non-string Redis key, miss or error
+	ReadFailMode string // READ_FAIL_MODE: get when Redis fails, closed (SERVER_ERROR), open (miss) or partial
+
+	CompoundOps string // COMPOUND_OPS: how incr/decr, append/prepend and add_get run, lua scripts or watch transactions
+
+	VerboseErrors bool // VERBOSE_ERRORS: say why a command is answered ERROR
+	NoreplyAudit  bool // NOREPLY_AUDIT: log the key of every noreply request that fails
+	StrictCompat  bool // STRICT_COMPAT: log the requests whose effect could differ from memcached's
+
+	TagDelimiter string // TAG_DELIMITER: keys are tagged with what precedes it
+
+	ReservedPrefix     string // RESERVED_PREFIX: prefix of the keys redcached keeps itself (default __)
+	RejectReservedKeys bool   // REJECT_RESERVED_KEYS: answer CLIENT_ERROR for client keys with it
+
+	LogFile  string // LOG_FILE: stdout, stderr (default) or a file to append to
+	LogLevel string // LOG_LEVEL: info (default), or debug to log expected disconnects too
+
+	GetLatencyFloor time.Duration // GET_LATENCY_FLOOR: no get is answered sooner
+	MissReasons     bool          // MISS_REASONS: log why each get misses, at the cost of tombstones
+	CoalesceGets    bool          // COALESCE_GETS: concurrent gets of a key share one read of Redis
+
+	CaseInsensitiveKeys bool // CASE_INSENSITIVE_KEYS: lowercase keys before storing or looking them up
+
+	WriteBehindInterval time.Duration // WRITE_BEHIND_INTERVAL: buffer noreply sets this long, 0 is off
+	WriteBehindMax      int           // WRITE_BEHIND_MAX: write the buffer once this many keys are pending
+
+	HotKeysSampleRate float64       // HOTKEYS_SAMPLE_RATE: share of requests counted, 0 is off
+	HotKeysTop        int           // HOTKEYS_TOP: keys listed by stats hotkeys
+	HotKeysWindow     time.Duration // HOTKEYS_WINDOW: how long requests are counted
+
+	ChaosMode        bool          // CHAOS_MODE: inject faults, for testing clients; loopback LISTEN only
+	ChaosLatency     time.Duration // CHAOS_LATENCY: delay injected before requests
+	ChaosLatencyRate float64       // CHAOS_LATENCY_RATE: share of requests delayed by CHAOS_LATENCY
+	ChaosErrorRate   float64       // CHAOS_ERROR_RATE: share of requests answered SERVER_ERROR unserved
+}
+
+// CACHE_MEMLIMIT values
+const (
+	CacheMemlimitIgnore = "ignore" // acknowledge and do nothing
+	CacheMemlimitRedis  = "redis"  // CONFIG SET maxmemory on the backend
+)
+
+// SLAB_COMMANDS values
+const (
+	SlabCommandsIgnore = "ignore" // acknowledge and do nothing
+	SlabCommandsError  = "error"  // answer ERROR, as for unknown commands
+)
+
+// LOG_LEVEL values
+const (
+	LogLevelInfo  = "info"  // what needs attention, such as unexpected connection errors
+	LogLevelDebug = "debug" // and what happens in normal operation, such as clients disconnecting
+)
+
+// GET_WRONGTYPE values
+const (
+	WrongTypeMiss  = "miss"  // skip the key, as if it did not exist
+	WrongTypeError = "error" // answer CLIENT_ERROR for the whole get
+)
+
+// GET_FLUSHING values
+const (
+	FlushingMiss  = "miss"  // skip the key, as if already deleted
+	FlushingValue = "value" // answer the value until the key is deleted
+)
+
+// COMPOUND_OPS values
+const (
+	CompoundOpsLua   = "lua"   // EVAL a script
+	CompoundOpsWatch = "watch" // WATCH, then MULTI/EXEC, retried on conflicts
+)
+
+// TTL_MODE values
+const (
+	TTLModeMemcached    = "memcached"    // above 30 days an exptime is a Unix time
+	TTLModeRelative     = "relative"     // every exptime is seconds from now
+	TTLModeMilliseconds = "milliseconds" // every exptime is milliseconds from now
+)
+
+// READ_FAIL_MODE values
+const (
+	ReadFailClosed  = "closed"  // answer SERVER_ERROR
+	ReadFailOpen    = "open"    // answer END, as if every key missed
+	ReadFailPartial = "partial" // read in batches, the keys of those failing miss
+)
+
+// DefaultRedisPoolSize is the REDIS_POOL_SIZE used when none is configured.
+const DefaultRedisPoolSize = 100
+
+// Defaults of REDIS_IDLE_TIMEOUT and REDIS_MAX_RETRIES, used when they are
+// not set at all: both can be set to 0.
+const (
+	DefaultRedisIdleTimeout = 5 * time.Minute
+	DefaultRedisMaxRetries  = 1
+)
+
+// DefaultShutdownGrace is the SHUTDOWN_GRACE used when none is configured.
+const DefaultShutdownGrace = 10 * time.Second
+
+// DefaultWriteTimeout is the WRITE_TIMEOUT used when it is not set at all:
+// it can be set to 0.
+const DefaultWriteTimeout = 30 * time.Second
+
+// DefaultReservedPrefix is the RESERVED_PREFIX used when none is configured.
+const DefaultReservedPrefix = "__"
+
+// DefaultStaleFlag is the STALE_FLAG used when none is configured.
+const DefaultStaleFlag = 1 << 30
+
+// TLSConfig loads the certificate of the tls:// addresses of LISTEN, or
+// returns nil if none is configured.
+func (cfg *Config) TLSConfig() (*tls.Config, error) {
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// current holds the *Config the handlers run with, see Configure and Reload.
+var current atomic.Value
+
+func init() {
+	current.Store(&Config{StaleFlag: DefaultStaleFlag, LogLevel: LogLevelInfo, GetWrongType: WrongTypeMiss, GetFlushing: FlushingMiss, ReadFailMode: ReadFailClosed, CompoundOps: CompoundOpsLua, TTLMode: TTLModeMemcached, ReservedPrefix: DefaultReservedPrefix, ItemSizeMax: DefaultItemSizeMax})
+}
+
+// config returns the configuration currently in effect. Callers reading
+// several fields should call it once, as it may be swapped by Reload.
+func config() *Config {
+	return current.Load().(*Config)
+}
+
+// Configure makes cfg the configuration used by the handlers.
+func Configure(cfg *Config) {
+	current.Store(cfg)
+	if cfg.MaxLineLength > 0 {
+		protocol.MaxLineLength = cfg.MaxLineLength
+	}
+}
+
+// source looks up a setting by its environment variable name.
+type source func(name string) (string, bool)
+
+// ConfigFromEnv builds a Config from environment variables, falling back
+// to the settings in CONFIG_FILE. Unset variables keep their zero value,
+// which disables the feature.
+func ConfigFromEnv() (*Config, error) {
+	cfg, _, err := loadWithOverrides(nil)
+	return cfg, err
+}
+
+// loadWithOverrides loads the configuration with m taking precedence over
+// the environment, and the environment over CONFIG_FILE. It also returns
+// the names of all settings it read.
+func loadWithOverrides(m map[string]string) (*Config, map[string]bool, error) {
+	path := os.Getenv("CONFIG_FILE")
+	file, err := readConfigFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	known := make(map[string]bool)
+	cfg, err := loadConfig(func(name string) (string, bool) {
+		known[name] = true
+		if s, ok := m[name]; ok {
+			return s, true
+		}
+		if s, ok := os.LookupEnv(name); ok {
+			return s, true
+		}
+		s, ok := file[name]
+		return s, ok
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range sortedKeys(file) {
+		if !known[name] {
+			return nil, nil, fmt.Errorf("CONFIG_FILE %s: unknown setting %s", path, name)
+		}
+	}
+	return cfg, known, nil
+}
+
+// readConfigFile reads the settings in the JSON file at path, an object
+// mapping environment variable names to strings, numbers or booleans:
+//
+//	{"REDIS_ADDR": "redis:6379", "PIPELINE_LIMIT": 16, "REUSEPORT": true}
+//
+// An empty path is no file.
+func readConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %v", err)
+	}
+	var raw map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE %s: %v", path, err)
+	}
+	settings := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case string:
+			settings[name] = v
+		case json.Number:
+			settings[name] = v.String()
+		case bool:
+			settings[name] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("CONFIG_FILE %s: %s should be a string, number or boolean", path, name)
+		}
+	}
+	return settings, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func loadConfig(src source) (*Config, error) {
+	cfg := &Config{StaleFlag: DefaultStaleFlag, LogLevel: LogLevelInfo, CacheMemlimit: CacheMemlimitIgnore, SlabCommands: SlabCommandsIgnore, GetWrongType: WrongTypeMiss, GetFlushing: FlushingMiss, ReadFailMode: ReadFailClosed, CompoundOps: CompoundOpsLua, TTLMode: TTLModeMemcached, ReservedPrefix: DefaultReservedPrefix}
+	var err error
+
+	if cfg.RedisAddr, err = src.redisAddr(); err != nil {
+		return nil, err
+	}
+
+	if cfg.RedisPoolSize, err = src.getInt("REDIS_POOL_SIZE"); err != nil {
+		return nil, err
+	}
+	if cfg.RedisPoolSize == 0 {
+		cfg.RedisPoolSize = DefaultRedisPoolSize
+	}
+	if s, _ := src("REDIS_WARMUP"); s == "all" {
+		cfg.RedisWarmup = cfg.RedisPoolSize
+	} else if cfg.RedisWarmup, err = src.getInt("REDIS_WARMUP"); err != nil {
+		return nil, err
+	} else if cfg.RedisWarmup > cfg.RedisPoolSize {
+		return nil, fmt.Errorf("REDIS_WARMUP should be at most REDIS_POOL_SIZE (%d), or all", cfg.RedisPoolSize)
+	}
+	if cfg.RedisIdleTimeout, err = src.getDuration("REDIS_IDLE_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	if _, exists := src("REDIS_IDLE_TIMEOUT"); !exists {
+		cfg.RedisIdleTimeout = DefaultRedisIdleTimeout
+	}
+	if cfg.RedisMaxRetries, err = src.getInt("REDIS_MAX_RETRIES"); err != nil {
+		return nil, err
+	}
+	if _, exists := src("REDIS_MAX_RETRIES"); !exists {
+		cfg.RedisMaxRetries = DefaultRedisMaxRetries
+	}
+
+	listen, err := src.listen()
+	if err != nil {
+		return nil, err
+	}
+	if listen != "" {
+		for _, spec := range strings.Split(listen, ",") {
+			spec = strings.TrimSpace(spec)
+			addr, _ := splitListenAddr(spec)
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("LISTEN should be host:port or tls://host:port addresses separated by commas")
+			}
+			cfg.Listen = append(cfg.Listen, spec)
+		}
+	}
+	if s, _ := src("ALLOW_CIDRS"); s != "" {
+		if cfg.AllowCIDRs, err = parseCIDRs("ALLOW_CIDRS", s); err != nil {
+			return nil, err
+		}
+	}
+	if s, _ := src("DENY_CIDRS"); s != "" {
+		if cfg.DenyCIDRs, err = parseCIDRs("DENY_CIDRS", s); err != nil {
+			return nil, err
+		}
+	}
+	cfg.TLSCertFile, _ = src("TLS_CERT_FILE")
+	cfg.TLSKeyFile, _ = src("TLS_KEY_FILE")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE should be set together")
+	}
+	for _, spec := range cfg.Listen {
+		if _, useTLS := splitListenAddr(spec); useTLS && cfg.TLSCertFile == "" {
+			return nil, fmt.Errorf("LISTEN %s needs TLS_CERT_FILE and TLS_KEY_FILE", spec)
+		}
+	}
+	if cfg.ReusePort, err = src.getBool("REUSEPORT"); err != nil {
+		return nil, err
+	}
+	if cfg.AcceptLoops, err = src.getInt("ACCEPT_LOOPS"); err != nil {
+		return nil, err
+	}
+	if cfg.AcceptLoops == 0 {
+		cfg.AcceptLoops = 1
+	}
+	if s, exists := src("TTL_MODE"); exists {
+		if s != TTLModeMemcached && s != TTLModeRelative && s != TTLModeMilliseconds {
+			return nil, fmt.Errorf("TTL_MODE should be %q, %q or %q", TTLModeMemcached, TTLModeRelative, TTLModeMilliseconds)
+		}
+		cfg.TTLMode = s
+	}
+	if cfg.TTLMin, err = src.getDuration("TTL_MIN"); err != nil {
+		return nil, err
+	}
+	if cfg.TTLMax, err = src.getDuration("TTL_MAX"); err != nil {
+		return nil, err
+	}
+	if cfg.TTLMax > 0 && cfg.TTLMin > cfg.TTLMax {
+		return nil, fmt.Errorf("TTL_MIN (%v) is greater than TTL_MAX (%v)", cfg.TTLMin, cfg.TTLMax)
+	}
+	if cfg.MaxTTL, err = src.getDuration("MAX_TTL"); err != nil {
+		return nil, err
+	}
+
+	cfg.PreloadFile, _ = src("PRELOAD_FILE")
+	if cfg.MaxLineLength, err = src.getInt("MAX_LINE_LENGTH"); err != nil {
+		return nil, err
+	}
+	if cfg.ItemSizeMax, err = src.getInt("ITEM_SIZE_MAX"); err != nil {
+		return nil, err
+	}
+	if cfg.ItemSizeMax == 0 {
+		cfg.ItemSizeMax = DefaultItemSizeMax
+	}
+	if cfg.ItemSizeMax < 0 || cfg.ItemSizeMax > MaxItemSizeMax {
+		return nil, fmt.Errorf("ITEM_SIZE_MAX should be at most %d", MaxItemSizeMax)
+	}
+	if cfg.PipelineLimit, err = src.getInt("PIPELINE_LIMIT"); err != nil {
+		return nil, err
+	}
+	if s, exists := src("DEFAULT_FLAGS"); exists {
+		flags, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("DEFAULT_FLAGS should be a 32 bit integer")
+		}
+		cfg.DefaultFlags = uint32(flags)
+	}
+	if cfg.StaleGrace, err = src.getDuration("STALE_GRACE"); err != nil {
+		return nil, err
+	}
+	if s, exists := src("STALE_FLAG"); exists {
+		flag, err := strconv.ParseUint(s, 0, 32)
+		if err != nil || flag == 0 {
+			return nil, fmt.Errorf("STALE_FLAG should be a non-zero 32 bit integer")
+		}
+		cfg.StaleFlag = uint32(flag)
+	}
+	if cfg.ShutdownGrace, err = src.getDuration("SHUTDOWN_GRACE"); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownGrace == 0 {
+		cfg.ShutdownGrace = DefaultShutdownGrace
+	}
+	if cfg.WriteTimeout, err = src.getDuration("WRITE_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	if _, exists := src("WRITE_TIMEOUT"); !exists {
+		cfg.WriteTimeout = DefaultWriteTimeout
+	}
+	if cfg.AdminCommands, err = src.getBool("ADMIN_COMMANDS"); err != nil {
+		return nil, err
+	}
+	cfg.AdminSocket, _ = src("ADMIN_SOCKET")
+	cfg.DebugAddr, _ = src("DEBUG_ADDR")
+	if s, exists := src("CACHE_MEMLIMIT"); exists {
+		if s != CacheMemlimitIgnore && s != CacheMemlimitRedis {
+			return nil, fmt.Errorf("CACHE_MEMLIMIT should be %q or %q", CacheMemlimitIgnore, CacheMemlimitRedis)
+		}
+		cfg.CacheMemlimit = s
+	}
+	if s, exists := src("MEMORY_HIGH_WATER"); exists {
+		share, err := strconv.ParseFloat(s, 64)
+		if err != nil || share < 0 || share > 1 {
+			return nil, fmt.Errorf("MEMORY_HIGH_WATER should be a number from 0 to 1")
+		}
+		cfg.MemoryHighWater = share
+	}
+	if s, exists := src("SLAB_COMMANDS"); exists {
+		if s != SlabCommandsIgnore && s != SlabCommandsError {
+			return nil, fmt.Errorf("SLAB_COMMANDS should be %q or %q", SlabCommandsIgnore, SlabCommandsError)
+		}
+		cfg.SlabCommands = s
+	}
+	cfg.FlushPrefix, _ = src("FLUSH_PREFIX")
+	cfg.InvalidationChannel, _ = src("INVALIDATION_CHANNEL")
+	if cfg.DeleteMatching, err = src.getBool("DELETE_MATCHING"); err != nil {
+		return nil, err
+	}
+	if s, exists := src("GET_WRONGTYPE"); exists {
+		if s != WrongTypeMiss && s != WrongTypeError {
+			return nil, fmt.Errorf("GET_WRONGTYPE should be %q or %q", WrongTypeMiss, WrongTypeError)
+		}
+		cfg.GetWrongType = s
+	}
+	if s, exists := src("GET_FLUSHING"); exists {
+		if s != FlushingMiss && s != FlushingValue {
+			return nil, fmt.Errorf("GET_FLUSHING should be %q or %q", FlushingMiss, FlushingValue)
+		}
+		cfg.GetFlushing = s
+	}
+	if s, exists := src("COMPOUND_OPS"); exists {
+		if s != CompoundOpsLua && s != CompoundOpsWatch {
+			return nil, fmt.Errorf("COMPOUND_OPS should be %q or %q", CompoundOpsLua, CompoundOpsWatch)
+		}
+		cfg.CompoundOps = s
+	}
+	if s, exists := src("READ_FAIL_MODE"); exists {
+		if s != ReadFailClosed && s != ReadFailOpen && s != ReadFailPartial {
+			return nil, fmt.Errorf("READ_FAIL_MODE should be %q, %q or %q", ReadFailClosed, ReadFailOpen, ReadFailPartial)
+		}
+		cfg.ReadFailMode = s
+	}
+	if cfg.VerboseErrors, err = src.getBool("VERBOSE_ERRORS"); err != nil {
+		return nil, err
+	}
+	if cfg.NoreplyAudit, err = src.getBool("NOREPLY_AUDIT"); err != nil {
+		return nil, err
+	}
+	if cfg.StrictCompat, err = src.getBool("STRICT_COMPAT"); err != nil {
+		return nil, err
+	}
+	cfg.TagDelimiter, _ = src("TAG_DELIMITER")
+	if s, exists := src("RESERVED_PREFIX"); exists {
+		if s == "" {
+			return nil, fmt.Errorf("RESERVED_PREFIX cannot be empty")
+		}
+		cfg.ReservedPrefix = s
+	}
+	if cfg.RejectReservedKeys, err = src.getBool("REJECT_RESERVED_KEYS"); err != nil {
+		return nil, err
+	}
+	cfg.LogFile, _ = src("LOG_FILE")
+	if s, exists := src("LOG_LEVEL"); exists {
+		if s != LogLevelInfo && s != LogLevelDebug {
+			return nil, fmt.Errorf("LOG_LEVEL should be %q or %q", LogLevelInfo, LogLevelDebug)
+		}
+		cfg.LogLevel = s
+	}
+	if cfg.GetLatencyFloor, err = src.getDuration("GET_LATENCY_FLOOR"); err != nil {
+		return nil, err
+	}
+	if cfg.MissReasons, err = src.getBool("MISS_REASONS"); err != nil {
+		return nil, err
+	}
+	if cfg.CoalesceGets, err = src.getBool("COALESCE_GETS"); err != nil {
+		return nil, err
+	}
+	if cfg.CaseInsensitiveKeys, err = src.getBool("CASE_INSENSITIVE_KEYS"); err != nil {
+		return nil, err
+	}
+	if cfg.WriteBehindInterval, err = src.getDuration("WRITE_BEHIND_INTERVAL"); err != nil {
+		return nil, err
+	}
+	if cfg.WriteBehindMax, err = src.getInt("WRITE_BEHIND_MAX"); err != nil {
+		return nil, err
+	}
+	if cfg.WriteBehindMax == 0 {
+		cfg.WriteBehindMax = DefaultWriteBehindMax
+	}
+	if s, exists := src("HOTKEYS_SAMPLE_RATE"); exists {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("HOTKEYS_SAMPLE_RATE should be a number from 0 to 1")
+		}
+		cfg.HotKeysSampleRate = rate
+	}
+	if cfg.HotKeysTop, err = src.getInt("HOTKEYS_TOP"); err != nil {
+		return nil, err
+	}
+	if cfg.HotKeysTop == 0 {
+		cfg.HotKeysTop = DefaultHotKeysTop
+	}
+	if cfg.HotKeysTop < 0 || cfg.HotKeysTop > MaxHotKeysTop {
+		return nil, fmt.Errorf("HOTKEYS_TOP should be at most %d", MaxHotKeysTop)
+	}
+	if cfg.HotKeysWindow, err = src.getDuration("HOTKEYS_WINDOW"); err != nil {
+		return nil, err
+	}
+	if cfg.HotKeysWindow == 0 {
+		cfg.HotKeysWindow = DefaultHotKeysWindow
+	}
+	if cfg.ChaosMode, err = src.getBool("CHAOS_MODE"); err != nil {
+		return nil, err
+	}
+	if cfg.ChaosLatency, err = src.getDuration("CHAOS_LATENCY"); err != nil {
+		return nil, err
+	}
+	for _, rate := range []struct {
+		name string
+		to   *float64
+	}{{"CHAOS_LATENCY_RATE", &cfg.ChaosLatencyRate}, {"CHAOS_ERROR_RATE", &cfg.ChaosErrorRate}} {
+		if s, exists := src(rate.name); exists {
+			share, err := strconv.ParseFloat(s, 64)
+			if err != nil || share < 0 || share > 1 {
+				return nil, fmt.Errorf("%s should be a number from 0 to 1", rate.name)
+			}
+			*rate.to = share
+		}
+	}
+	if !cfg.ChaosMode && (cfg.ChaosLatency > 0 || cfg.ChaosLatencyRate > 0 || cfg.ChaosErrorRate > 0) {
+		return nil, fmt.Errorf("CHAOS_LATENCY, CHAOS_LATENCY_RATE and CHAOS_ERROR_RATE need CHAOS_MODE")
+	}
+	if cfg.ChaosMode {
+		if err := checkChaosListen(cfg.Listen); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// redisAddr prefers REDIS_ADDR and falls back to REDIS_HOST and
+// REDIS_PORT. An empty host is an error rather than an implicit localhost.
+func (src source) redisAddr() (string, error) {
+	// all three are read, so that they are known to reconfigure and in
+	// CONFIG_FILE whichever is used
+	addr := strings.TrimSpace(src.getString("REDIS_ADDR"))
+	host := strings.TrimSpace(src.getString("REDIS_HOST"))
+	port := strings.TrimSpace(src.getString("REDIS_PORT"))
+	if addr != "" {
+		return addr, nil
+	}
+	if host == "" {
+		return "", fmt.Errorf("REDIS_ADDR/REDIS_HOST is required")
+	}
+	if port == "" {
+		port = "6379"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("REDIS_PORT should be a port number: %v", err)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// listen prefers LISTEN and falls back to MEMCACHED_PORT, then PORT, as
+// set for memcached, on all interfaces. Without any of them it is empty,
+// for the default address of the server.
+func (src source) listen() (string, error) {
+	// all three are read, as in redisAddr
+	listen := strings.TrimSpace(src.getString("LISTEN"))
+	memcachedPort := strings.TrimSpace(src.getString("MEMCACHED_PORT"))
+	port := strings.TrimSpace(src.getString("PORT"))
+	if listen != "" {
+		return listen, nil
+	}
+	name := "MEMCACHED_PORT"
+	if memcachedPort == "" {
+		name, memcachedPort = "PORT", port
+	}
+	if memcachedPort == "" {
+		return "", nil
+	}
+	if _, err := strconv.ParseUint(memcachedPort, 10, 16); err != nil {
+		return "", fmt.Errorf("%s should be a port number: %v", name, err)
+	}
+	return net.JoinHostPort("0.0.0.0", memcachedPort), nil
+}
+
+func (src source) getString(name string) string {
+	s, _ := src(name)
+	return s
+}
+
+func (src source) getBool(name string) (bool, error) {
+	s, exists := src(name)
+	if !exists {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("%s should be a boolean: %v", name, err)
+	}
+	return b, nil
+}
+
+func (src source) getInt(name string) (int, error) {
+	s, exists := src(name)
+	if !exists {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s should be an integer: %v", name, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s cannot be negative", name)
+	}
+	return n, nil
+}
+
+// getDuration parses a Go duration such as "30s" or "1h".
+func (src source) getDuration(name string) (time.Duration, error) {
+	s, exists := src(name)
+	if !exists {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s should be a duration: %v", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s cannot be negative", name)
+	}
+	return d, nil
+}
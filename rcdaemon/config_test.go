@@ -0,0 +1,194 @@
+package rcdaemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisAddrFromEnv(t *testing.T) {
+	tests := []struct {
+		addr, host, port string
+		want             string
+	}{
+		{"", "redis", "", "redis:6379"},
+		{"", "redis", "6380", "redis:6380"},
+		{"other:1234", "redis", "6380", "other:1234"},
+		{"", "::1", "", "[::1]:6379"},
+	}
+	for _, tt := range tests {
+		t.Setenv("REDIS_ADDR", tt.addr)
+		t.Setenv("REDIS_HOST", tt.host)
+		t.Setenv("REDIS_PORT", tt.port)
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Errorf("%+v: %v", tt, err)
+			continue
+		}
+		if cfg.RedisAddr != tt.want {
+			t.Errorf("%+v: RedisAddr %q, want %q", tt, cfg.RedisAddr, tt.want)
+		}
+	}
+}
+
+func TestRedisHostRequired(t *testing.T) {
+	t.Setenv("REDIS_ADDR", "")
+	for _, host := range []string{"", "  "} {
+		t.Setenv("REDIS_HOST", host)
+		_, err := ConfigFromEnv()
+		if err == nil || err.Error() != "REDIS_ADDR/REDIS_HOST is required" {
+			t.Errorf("REDIS_HOST=%q: err %v", host, err)
+		}
+	}
+}
+
+// useConfigFile points CONFIG_FILE at a file with contents for the test.
+func useConfigFile(t *testing.T, contents string) {
+	path := filepath.Join(t.TempDir(), "redcached.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	for _, name := range []string{"REDIS_ADDR", "REDIS_HOST", "PIPELINE_LIMIT", "REUSEPORT", "TTL_MAX"} {
+		if s, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			t.Cleanup(func() { os.Setenv(name, s) })
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	useConfigFile(t, `{"REDIS_ADDR": "file:6379", "PIPELINE_LIMIT": 16, "REUSEPORT": true, "TTL_MAX": "1h"}`)
+	t.Setenv("PIPELINE_LIMIT", "4")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RedisAddr != "file:6379" || !cfg.ReusePort || cfg.TTLMax != time.Hour {
+		t.Errorf("settings from file: %+v", cfg)
+	}
+	if cfg.PipelineLimit != 4 {
+		t.Errorf("PIPELINE_LIMIT %d, want the environment's 4", cfg.PipelineLimit)
+	}
+	if cfg.RedisPoolSize != DefaultRedisPoolSize {
+		t.Errorf("REDIS_POOL_SIZE %d", cfg.RedisPoolSize)
+	}
+	if cfg.AcceptLoops != 1 {
+		t.Errorf("ACCEPT_LOOPS %d, want 1", cfg.AcceptLoops)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"REDIS_ADDR": "r:1", "REDIS_HOST": "h", "PIPELINE_LIMT": 1}`: "unknown setting PIPELINE_LIMT",
+		`{"REDIS_ADDR": "r:1", "TTL_MAX": [1]}`:                        "TTL_MAX should be a string, number or boolean",
+		`{"REDIS_ADDR": "r:1", "TTL_MAX": 60}`:                         "TTL_MAX should be a duration",
+		`{"REDIS_ADDR": "r:1",}`:                                       "invalid character",
+	}
+	for contents, want := range tests {
+		useConfigFile(t, contents)
+		if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err %v, want %q", contents, err, want)
+		}
+	}
+}
+
+func TestRedisRetryDefaults(t *testing.T) {
+	cfg, _, err := loadWithOverrides(map[string]string{"REDIS_ADDR": "x:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RedisIdleTimeout != DefaultRedisIdleTimeout || cfg.RedisMaxRetries != DefaultRedisMaxRetries {
+		t.Errorf("defaults %v, %d", cfg.RedisIdleTimeout, cfg.RedisMaxRetries)
+	}
+	cfg, _, err = loadWithOverrides(map[string]string{"REDIS_ADDR": "x:1", "REDIS_IDLE_TIMEOUT": "0", "REDIS_MAX_RETRIES": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RedisIdleTimeout != 0 || cfg.RedisMaxRetries != 0 {
+		t.Errorf("set to 0: %v, %d", cfg.RedisIdleTimeout, cfg.RedisMaxRetries)
+	}
+}
+
+func TestWriteTimeoutDefault(t *testing.T) {
+	for value, want := range map[string]time.Duration{"": DefaultWriteTimeout, "0": 0, "5s": 5 * time.Second} {
+		env := map[string]string{"REDIS_ADDR": "x:1"}
+		if value != "" {
+			env["WRITE_TIMEOUT"] = value
+		}
+		cfg, _, err := loadWithOverrides(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.WriteTimeout != want {
+			t.Errorf("WRITE_TIMEOUT=%q: %v, want %v", value, cfg.WriteTimeout, want)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	cfg, _, err := loadWithOverrides(map[string]string{"REDIS_ADDR": "x:1", "LISTEN": "127.0.0.1:11212, tls://:11213",
+		"TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:11212", "tls://:11213"}; strings.Join(cfg.Listen, ",") != strings.Join(want, ",") {
+		t.Errorf("LISTEN parsed as %q, want %q", cfg.Listen, want)
+	}
+
+	for _, m := range []map[string]string{
+		{"LISTEN": "11212"},
+		{"LISTEN": "tls://:11213"},
+		{"LISTEN": ":11212", "TLS_CERT_FILE": "cert.pem"},
+		{"LISTEN": "", "MEMCACHED_PORT": "memcache"},
+		{"LISTEN": "", "MEMCACHED_PORT": "", "PORT": "70000"},
+	} {
+		m["REDIS_ADDR"] = "x:1"
+		if _, _, err := loadWithOverrides(m); err == nil {
+			t.Errorf("%v accepted", m)
+		}
+	}
+}
+
+func TestListenFromMemcachedPort(t *testing.T) {
+	for _, c := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"PORT": "8080"}, "0.0.0.0:8080"},
+		{map[string]string{"PORT": "8080", "MEMCACHED_PORT": "11211"}, "0.0.0.0:11211"},
+		{map[string]string{"PORT": "8080", "MEMCACHED_PORT": "11211", "LISTEN": "127.0.0.1:11213"}, "127.0.0.1:11213"},
+	} {
+		env := map[string]string{"REDIS_ADDR": "x:1", "LISTEN": "", "MEMCACHED_PORT": "", "PORT": ""} // whatever the environment says
+		for name, value := range c.env {
+			env[name] = value
+		}
+		cfg, _, err := loadWithOverrides(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(cfg.Listen, ","); got != c.want {
+			t.Errorf("%v: listening on %q, want %q", c.env, got, c.want)
+		}
+	}
+}
+
+func TestRedisWarmup(t *testing.T) {
+	for value, want := range map[string]int{"0": 0, "10": 10, "all": 20} {
+		cfg, _, err := loadWithOverrides(map[string]string{"REDIS_ADDR": "x:1", "REDIS_POOL_SIZE": "20", "REDIS_WARMUP": value})
+		if err != nil {
+			t.Fatalf("REDIS_WARMUP=%s: %v", value, err)
+		}
+		if cfg.RedisWarmup != want {
+			t.Errorf("REDIS_WARMUP=%s: %d, want %d", value, cfg.RedisWarmup, want)
+		}
+	}
+	if _, _, err := loadWithOverrides(map[string]string{"REDIS_ADDR": "x:1", "REDIS_POOL_SIZE": "20", "REDIS_WARMUP": "21"}); err == nil {
+		t.Errorf("warmup beyond the pool accepted")
+	}
+}
@@ -0,0 +1,105 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugKeyScript returns the Redis type of KEYS[1], its PTTL, its value if
+// it is a string, and the soft deadline of STALE_GRACE in the companion key
+// ARGV[1], in one round trip.
+var debugKeyScript = newScript(`
+local t = redis.call('TYPE', KEYS[1]).ok
+local v = false
+if t == 'string' then
+  v = redis.call('GET', KEYS[1])
+end
+return {t, redis.call('PTTL', KEYS[1]), v, redis.call('GET', ARGV[1])}
+`)
+
+// debugRawMax bounds the stored bytes shown by debug key.
+const debugRawMax = 1024
+
+// `debug` handler, an admin extension
+//
+//	debug key <key>\r\n
+//
+// Answers what is known of key, one `<field> <value>` line each, then END:
+// whether it exists, its Redis type and TTL in milliseconds (-1 for none),
+// and for an item its flags, data size, value header, the soft deadline of
+// STALE_GRACE, whether write-behind still buffers a set of it, and the
+// bytes stored in Redis, quoted and cut at debugRawMax. There are no cas
+// tokens to show, as cas is not implemented. Like ttl it needs Lua scripts.
+func DebugHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	if !scripting() {
+		res.Response = unknownCommand("debug key needs Lua scripts, which Redis refuses")
+		return nil
+	}
+	key := req.Args[1]
+	if config().CaseInsensitiveKeys {
+		key = strings.ToLower(key)
+	}
+	result, err := debugKeyScript.Run([]string{key}, []string{staleMetaKey(key)}).Result()
+	if err != nil {
+		return err
+	}
+	fields, _ := result.([]interface{})
+	if len(fields) != 4 {
+		fields = make([]interface{}, 4)
+	}
+	kind, _ := fields[0].(string)
+	pttl, _ := fields[1].(int64)
+	value, isString := fields[2].(string)
+
+	var b strings.Builder
+	line := func(field, value string) {
+		b.WriteString(field)
+		b.WriteByte(' ')
+		b.WriteString(value)
+		b.WriteString("\r\n")
+	}
+	line("key", key)
+	if kind == "" || kind == "none" {
+		line("exists", "no")
+	} else {
+		line("exists", "yes")
+		line("type", kind)
+		line("ttl", strconv.FormatInt(pttl, 10))
+	}
+	if isString {
+		if flags, data, ok := decodeValue(value); ok {
+			line("flags", strconv.FormatUint(uint64(flags), 10))
+			line("size", strconv.Itoa(len(data)))
+		}
+		switch {
+		case !strings.HasPrefix(value, valueMagic) || len(value) == len(valueMagic):
+			line("header", "none")
+		case value[len(valueMagic)] == valueVersion1 && len(value) >= valueHeaderLen1:
+			line("header", "version 1")
+		default:
+			line("header", "unknown, as stored by a later version")
+		}
+		raw := value
+		if len(raw) > debugRawMax {
+			raw = raw[:debugRawMax]
+		}
+		line("raw", strconv.Quote(raw))
+		if len(value) > debugRawMax {
+			line("raw_cut", strconv.Itoa(len(value)-debugRawMax)+" bytes")
+		}
+	}
+	meta, _ := fields[3].(string)
+	if soft, err := strconv.ParseInt(meta, 10, 64); err == nil {
+		line("stale_deadline", time.Unix(0, soft*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano))
+	}
+	if buffered := bufferedValues([]string{key}); buffered != nil && buffered[0] != nil {
+		line("buffered", "yes")
+	} else {
+		line("buffered", "no")
+	}
+	b.WriteString("END")
+	res.Response = b.String()
+	return nil
+}
@@ -0,0 +1,48 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+func debugKey(t *testing.T, key string) string {
+	res := &protocol.McResponse{}
+	if err := DebugHandler(&protocol.McRequest{Command: "debug", Args: []string{"key", key}}, res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Response
+}
+
+func TestDebugKey(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.StaleGrace = time.Minute })
+	if err := SetHandler(&protocol.McRequest{Command: "set", Key: "k", Flags: "7", Exptime: 60, Value: []byte("hello")}, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	f.others["l"] = "list"
+
+	got := debugKey(t, "k")
+	for _, want := range []string{
+		"key k\r\nexists yes\r\ntype string\r\nttl 120000\r\n",
+		"flags 7\r\nsize 5\r\nheader version 1\r\nraw \"\\x00RC\\x01\\x00\\x00\\x00\\ahello\"\r\n",
+		"\r\nstale_deadline ",
+		"\r\nbuffered no\r\nEND",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("debug key k without %q:\n%s", want, got)
+		}
+	}
+	if got, want := debugKey(t, "l"), "key l\r\nexists yes\r\ntype list\r\nttl -1\r\nbuffered no\r\nEND"; got != want {
+		t.Errorf("debug key of a list %q, want %q", got, want)
+	}
+	if got, want := debugKey(t, "missing"), "key missing\r\nexists no\r\nbuffered no\r\nEND"; got != want {
+		t.Errorf("debug key of a missing key %q, want %q", got, want)
+	}
+
+	f.set("big", strings.Repeat("x", debugRawMax+10), 0)
+	if got := debugKey(t, "big"); !strings.Contains(got, "header none\r\n") || !strings.Contains(got, "raw_cut 10 bytes\r\n") {
+		t.Errorf("debug key of a large raw value:\n%s", got)
+	}
+}
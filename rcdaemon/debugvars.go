@@ -0,0 +1,41 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"expvar"
+	"net/http"
+	"strings"
+)
+
+// Debug variables
+//
+// The core counters are also published with expvar, as the map redcached,
+// and served as JSON on /debug/vars of DEBUG_ADDR, for a quick look at a
+// running process without a metrics stack. Unlike the stats, they add up
+// every Server of the process, admin socket included, and stats reset
+// leaves them alone.
+
+var debugVars = expvar.NewMap("redcached")
+
+// countDebug records in the debug variables that req was answered with
+// res, or failed with err.
+func countDebug(req *protocol.McRequest, res *protocol.McResponse, err error) {
+	cmd := strings.ToLower(req.Command)
+	debugVars.Add("cmd_"+cmd, 1)
+	if err != nil {
+		debugVars.Add("server_errors", 1)
+		return
+	}
+	if cmd == "get" || cmd == "gets" {
+		debugVars.Add("get_hits", int64(len(res.Values)))
+		debugVars.Add("get_misses", int64(len(req.Keys)-len(res.Values)))
+	}
+}
+
+// DebugServer returns the server of the debug variables on /debug/vars of
+// addr, to be started with ListenAndServe and stopped with Shutdown.
+func DebugServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,46 @@
+package rcdaemon
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"testing"
+)
+
+func debugVar(name string) int64 {
+	if v, ok := debugVars.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestDebugVars(t *testing.T) {
+	want := map[string]int64{"total_connections": 1, "cmd_set": 1, "cmd_get": 1, "get_hits": 1, "get_misses": 1, "protocol_errors": 1}
+	before := make(map[string]int64)
+	for name := range want {
+		before[name] = debugVar(name)
+	}
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	c.send(t, "set k 0 0 1\r\nv\r\nget k missing\r\nincr k\r\n")
+	c.readUntil(t, "END")
+	c.readLine(t)
+	for name, up := range want {
+		if got := debugVar(name) - before[name]; got != up {
+			t.Errorf("%s up by %d, want %d", name, got, up)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars struct {
+		Redcached map[string]int64 `json:"redcached"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Redcached["cmd_set"] != debugVar("cmd_set") {
+		t.Errorf("/debug/vars: %v", vars.Redcached)
+	}
+}
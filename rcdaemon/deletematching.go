@@ -0,0 +1,55 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strconv"
+	"strings"
+)
+
+// `delete_matching` handler, an admin extension
+//
+//	delete_matching <pattern>\r\n
+//
+// Deletes the keys matching pattern, a SCAN MATCH glob such as
+// `session:*`, and answers `DELETED <count>`. With FLUSH_PREFIX set the
+// pattern is matched after the prefix, so that no other tenant's key can
+// match. Unlike a scoped flush_all it answers once the keys are gone,
+// deleting them a SCAN batch at a time, each published to
+// INVALIDATION_CHANNEL once deleted, see publishDeleted. As it walks the whole keyspace it
+// answers ERROR unless DELETE_MATCHING is set.
+func DeleteMatchingHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	cfg := config()
+	if !cfg.DeleteMatching {
+		res.Response = unknownCommand("delete_matching is disabled, see DELETE_MATCHING")
+		return nil
+	}
+	pattern := req.Args[0]
+	if cfg.CaseInsensitiveKeys {
+		pattern = strings.ToLower(pattern)
+	}
+
+	// buffered sets are written first, or they would outlive the delete
+	writeBehindFlush()
+	defer detachGets()
+	var deleted int64
+	err := scanKeys(globEscape(cfg.FlushPrefix)+pattern, func(keys []string) error {
+		n, err := backend.Del(keys...).Result()
+		deleted += n
+		if err == nil {
+			publishDeleted(keys)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// the stale-while-revalidate companion keys go with their items
+	err = scanKeys(globEscape(staleMetaKey(cfg.FlushPrefix))+pattern, func(keys []string) error {
+		return backend.Del(keys...).Err()
+	})
+	if err != nil {
+		return err
+	}
+	res.Response = "DELETED " + strconv.FormatInt(deleted, 10)
+	return nil
+}
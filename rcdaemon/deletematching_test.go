@@ -0,0 +1,67 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func deleteMatching(t *testing.T, pattern string) string {
+	res := &protocol.McResponse{}
+	if err := DeleteMatchingHandler(&protocol.McRequest{Command: "delete_matching", Args: []string{pattern}}, res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Response
+}
+
+func TestDeleteMatchingDisabled(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["session:1"] = "v"
+	if res := deleteMatching(t, "session:*"); res != "ERROR" {
+		t.Errorf("without DELETE_MATCHING %q, want ERROR", res)
+	}
+	if _, ok := f.data["session:1"]; !ok {
+		t.Errorf("deleted without DELETE_MATCHING")
+	}
+}
+
+func TestDeleteMatchingWithinPrefix(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.DeleteMatching = true
+		cfg.FlushPrefix = "t1:"
+	})
+	for i := 0; i < 2500; i++ {
+		f.data[fmt.Sprintf("t1:session:%d", i)] = "v"
+	}
+	f.data[staleMetaKey("t1:session:1")] = "1"
+	f.data["t1:user:1"] = "v"
+	f.data["t2:session:1"] = "other tenant"
+	f.data["session:1"] = "outside the prefix"
+
+	if res := deleteMatching(t, "session:*"); res != "DELETED 2500" {
+		t.Errorf("delete_matching %q, want DELETED 2500", res)
+	}
+	if len(f.data) != 3 || f.data["t1:user:1"] == "" || f.data["t2:session:1"] == "" || f.data["session:1"] == "" {
+		t.Errorf("left after delete_matching: %v", f.data)
+	}
+	if res := deleteMatching(t, "session:*"); res != "DELETED 0" {
+		t.Errorf("delete_matching again %q, want DELETED 0", res)
+	}
+}
+
+func TestDeleteMatchingBuffered(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 100)
+	withConfig(t, func(cfg *Config) { cfg.DeleteMatching = true })
+
+	SetHandler(bufferedSetReq("s:1", "0", 0, "v"), &protocol.McResponse{})
+	if res := deleteMatching(t, "s:?"); res != "DELETED 1" {
+		t.Errorf("delete_matching %q, want DELETED 1", res)
+	}
+	writeBehindFlush()
+	if _, ok := f.data["s:1"]; ok {
+		t.Errorf("buffered item written after delete_matching")
+	}
+}
@@ -0,0 +1,72 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// Value encoding
+//
+// A value is stored in Redis as the client sent it (the legacy format)
+// unless there is more to keep: currently non-zero flags. It then starts
+// with a header, valueMagic and a version byte, followed by the fields of
+// that version:
+//
+//	version 1: flags, 4 bytes big-endian, then the data
+//
+// Values without a header are read as legacy data with flags 0, so items
+// stored by earlier versions need no flush, and counters and plain values
+// stay readable by other Redis clients. A value the client sent that
+// happens to start with valueMagic is stored with a header, so it cannot
+// be mistaken for one. Values with a version this build does not know are
+// misses rather than garbage.
+
+// valueMagic starts the header of encoded values.
+const valueMagic = "\x00RC"
+
+const (
+	valueVersion1   = 1
+	valueHeaderLen1 = len(valueMagic) + 1 + 4
+)
+
+// encodeValue returns the Redis value storing data with flags.
+func encodeValue(flags uint32, data []byte) []byte {
+	if flags == 0 && !strings.HasPrefix(string(data), valueMagic) {
+		return data
+	}
+	b := make([]byte, valueHeaderLen1, valueHeaderLen1+len(data))
+	copy(b, valueMagic)
+	b[len(valueMagic)] = valueVersion1
+	binary.BigEndian.PutUint32(b[len(valueMagic)+1:], flags)
+	return append(b, data...)
+}
+
+// decodeValue returns the flags and data of a Redis value, or ok false if
+// it was encoded by a later version. Flags 0, which legacy values have,
+// are returned as DEFAULT_FLAGS.
+func decodeValue(s string) (flags uint32, data string, ok bool) {
+	if !strings.HasPrefix(s, valueMagic) || len(s) == len(valueMagic) {
+		return config().DefaultFlags, s, true
+	}
+	switch s[len(valueMagic)] {
+	case valueVersion1:
+		if len(s) < valueHeaderLen1 {
+			return 0, "", false
+		}
+		f := s[len(valueMagic)+1:]
+		flags = uint32(f[0])<<24 | uint32(f[1])<<16 | uint32(f[2])<<8 | uint32(f[3])
+		if flags == 0 {
+			flags = config().DefaultFlags
+		}
+		return flags, s[valueHeaderLen1:], true
+	}
+	return 0, "", false
+}
+
+// storedValue is the Redis value for a storage command.
+func storedValue(req *protocol.McRequest) []byte {
+	flags, _ := strconv.ParseUint(req.Flags, 10, 32) // checked by the parser
+	return encodeValue(uint32(flags), req.Value)
+}
@@ -0,0 +1,91 @@
+package rcdaemon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValueEncodingRoundTrip(t *testing.T) {
+	tests := []struct {
+		flags  uint32
+		data   string
+		legacy bool // stored as is
+	}{
+		{0, "hello", true},
+		{0, "", true},
+		{0, "\x00R", true},
+		{0, valueMagic, false},
+		{0, valueMagic + "\x01\x00\x00\x00\x05x", false},
+		{5, "hello", false},
+		{1<<32 - 1, "", false},
+		{1, "a\r\nb", false},
+	}
+	for _, tt := range tests {
+		stored := string(encodeValue(tt.flags, []byte(tt.data)))
+		if legacy := stored == tt.data; legacy != tt.legacy {
+			t.Errorf("encodeValue(%d, %q) = %q, legacy %v", tt.flags, tt.data, stored, legacy)
+		}
+		flags, data, ok := decodeValue(stored)
+		if !ok || flags != tt.flags || data != tt.data {
+			t.Errorf("decodeValue(encodeValue(%d, %q)) = %d, %q, %v", tt.flags, tt.data, flags, data, ok)
+		}
+	}
+}
+
+func TestDecodeLegacyValue(t *testing.T) {
+	for _, s := range []string{"hello", "", "42", "\x00\x01", "\x00RC"} {
+		if flags, data, ok := decodeValue(s); !ok || flags != 0 || data != s {
+			t.Errorf("decodeValue(%q) = %d, %q, %v", s, flags, data, ok)
+		}
+	}
+}
+
+func TestDecodeUnknownVersion(t *testing.T) {
+	for _, s := range []string{valueMagic + "\x02data", valueMagic + "\x01\x00\x00"} {
+		if _, _, ok := decodeValue(s); ok {
+			t.Errorf("decodeValue(%q) accepted", s)
+		}
+	}
+}
+
+func TestFlagsStored(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["legacy"] = "old"
+	f.data["future"] = valueMagic + "\x09data"
+	c := dialTestServer(t, srv)
+
+	c.send(t, "set k 42 0 3\r\nabc\r\n")
+	if line := c.readLine(t); line != "STORED" {
+		t.Fatalf("set %q", line)
+	}
+	c.send(t, "get k legacy future\r\n")
+	want := []string{"VALUE k 42 3", "abc", "VALUE legacy 0 3", "old", "END"}
+	if lines := c.readUntil(t, "END"); strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("get %q, want %q", lines, want)
+	}
+
+	c.send(t, "set n 7 0 2\r\n41\r\nincr n 1\r\nget n\r\n")
+	want = []string{"STORED", "42", "VALUE n 7 2", "42", "END"}
+	if lines := c.readUntil(t, "END"); strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("incr of a value with flags %q, want %q", lines, want)
+	}
+}
+
+func TestDefaultFlags(t *testing.T) {
+	srv, f := startTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.DefaultFlags = 16 })
+	f.data["legacy"] = "old"
+	c := dialTestServer(t, srv)
+
+	c.send(t, "set zero 0 0 1\r\na\r\nset explicit 3 0 1\r\nb\r\n")
+	c.readLine(t)
+	c.readLine(t)
+	if f.data["zero"] != "a" {
+		t.Errorf("item with flags 0 stored as %q, want it plain", f.data["zero"])
+	}
+	c.send(t, "get zero explicit legacy\r\n")
+	want := []string{"VALUE zero 16 1", "a", "VALUE explicit 3 1", "b", "VALUE legacy 16 3", "old", "END"}
+	if lines := c.readUntil(t, "END"); strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("get %q, want %q", lines, want)
+	}
+}
@@ -0,0 +1,223 @@
+package rcdaemon
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scoped flush
+//
+// With FLUSH_PREFIX set, flush_all only deletes the keys starting with the
+// prefix, for a Redis shared with other applications. Redis has no command
+// for that, so the keys are found with SCAN and deleted batch by batch in a
+// background goroutine: flush_all answers OK right away, as deleting
+// millions of keys would outlast any client timeout. Its progress is
+// logged, and a flush_all sent meanwhile is folded into one more pass
+// rather than starting a scan of its own.
+//
+// Stores racing the flush are settled by when they reach this process:
+// items stored before flush_all are deleted, those stored after it are
+// kept, wherever the SCAN cursor is. See beginWrite. Stores through other
+// redcached processes sharing the Redis are not tracked and may go either
+// way.
+
+const (
+	flushScanCount = 1000             // SCAN COUNT hint, so roughly the DEL batch size
+	flushPause     = time.Millisecond // between batches, to let other commands through
+)
+
+// flushProgressInterval is how often a running scoped flush logs how far
+// it got.
+var flushProgressInterval = 10 * time.Second
+
+var scopedFlush struct {
+	sync.Mutex
+	running bool
+	again   bool            // flush_all was sent while running: scan again when done
+	written map[string]bool // keys stored since the last flush_all, to keep
+
+	// Held shared by stores and exclusively by flush_all and while a batch
+	// is deleted, so that a store is entirely before or after either.
+	writes sync.RWMutex
+}
+
+// startScopedFlush deletes the keys under FLUSH_PREFIX in the background.
+// A flush_all sent while one is running starts another pass after it, so
+// that keys stored in between are deleted too.
+func startScopedFlush() {
+	// wait for stores in progress, which come before the flush
+	scopedFlush.writes.Lock()
+	defer scopedFlush.writes.Unlock()
+	scopedFlush.Lock()
+	defer scopedFlush.Unlock()
+	scopedFlush.written = make(map[string]bool)
+	if scopedFlush.running {
+		if !scopedFlush.again {
+			log.Printf("flush_all while a flush is running, flushing again once it is done")
+		}
+		scopedFlush.again = true
+		return
+	}
+	scopedFlush.running = true
+	go runScopedFlush()
+}
+
+// beginWrite is called before storing key and the returned function once
+// it is stored. While a scoped flush runs, key is then recorded so that the
+// flush leaves it alone, and get no longer takes it for flushed. No batch
+// is deleted in between, so whether it is recorded at the start or the end
+// makes no difference to the flush. Gets from then on no longer share a
+// fetch of key, see detachGets.
+func beginWrite(key string) (end func()) {
+	scopedFlush.writes.RLock()
+	return func() {
+		detachGets(key)
+		scopedFlush.Lock()
+		if scopedFlush.running {
+			scopedFlush.written[key] = true
+			scopedFlush.written[staleMetaKey(key)] = true
+		}
+		scopedFlush.Unlock()
+		scopedFlush.writes.RUnlock()
+	}
+}
+
+// flushingKeys returns those of keys that a running scoped flush is to
+// delete though they may still be in Redis: keys under FLUSH_PREFIX not
+// stored since flush_all. Stores are only recorded once complete, so a key
+// recorded as stored holds its new value, or a later one, when Redis is
+// read after the call. It returns nil if no scoped flush is running.
+func flushingKeys(prefix string, keys []string) map[string]bool {
+	scopedFlush.Lock()
+	defer scopedFlush.Unlock()
+	if !scopedFlush.running {
+		return nil
+	}
+	flushing := make(map[string]bool)
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) && !scopedFlush.written[key] {
+			flushing[key] = true
+		}
+	}
+	return flushing
+}
+
+// unwritten returns the keys not stored since flush_all.
+func unwritten(keys []string) []string {
+	scopedFlush.Lock()
+	defer scopedFlush.Unlock()
+	var out []string
+	for _, key := range keys {
+		if !scopedFlush.written[key] {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// flushInProgress reports whether a scoped flush is running.
+func flushInProgress() bool {
+	scopedFlush.Lock()
+	defer scopedFlush.Unlock()
+	return scopedFlush.running
+}
+
+func runScopedFlush() {
+	for {
+		if prefix := config().FlushPrefix; prefix != "" {
+			start, before := time.Now(), atomic.LoadUint64(&flushedKeys)
+			deleted := func() uint64 { return atomic.LoadUint64(&flushedKeys) - before }
+			log.Printf("flush_all of the keys under %q started", prefix)
+			ticker := time.NewTicker(flushProgressInterval)
+			done := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-ticker.C:
+						log.Printf("flush_all of the keys under %q: %d deleted in %v so far", prefix, deleted(), time.Since(start).Round(time.Millisecond))
+					case <-done:
+						return
+					}
+				}
+			}()
+			// the stale-while-revalidate companion keys go with their items
+			for _, match := range []string{globEscape(prefix) + "*", globEscape(staleMetaKey(prefix)) + "*"} {
+				if err := scanDelete(match); err != nil {
+					log.Printf("flush_all of %q: %v", match, err)
+				}
+			}
+			ticker.Stop()
+			close(done)
+			log.Printf("flush_all of the keys under %q done, %d deleted in %v", prefix, deleted(), time.Since(start).Round(time.Millisecond))
+		}
+
+		scopedFlush.Lock()
+		if !scopedFlush.again {
+			scopedFlush.running = false
+			scopedFlush.written = nil
+			scopedFlush.Unlock()
+			return
+		}
+		scopedFlush.again = false
+		scopedFlush.Unlock()
+	}
+}
+
+// scanDelete deletes the keys matching the SCAN pattern match.
+func scanDelete(match string) error {
+	return scanKeys(match, deleteUnwritten)
+}
+
+// scanKeys calls fn with each non-empty batch of the keys matching the
+// SCAN pattern match, pausing between batches.
+func scanKeys(match string, fn func(keys []string) error) error {
+	var cursor int64
+	for {
+		next, keys, err := backend.Scan(cursor, match, flushScanCount).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+		time.Sleep(flushPause)
+	}
+}
+
+// deleteUnwritten deletes the keys that were not stored since flush_all,
+// holding off stores meanwhile.
+func deleteUnwritten(keys []string) error {
+	scopedFlush.writes.Lock()
+	defer scopedFlush.writes.Unlock()
+	keys = unwritten(keys)
+	if len(keys) == 0 {
+		return nil
+	}
+	n, err := backend.Del(keys...).Result()
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&flushedKeys, uint64(n))
+	return nil
+}
+
+// globEscape quotes the characters special to SCAN MATCH patterns.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
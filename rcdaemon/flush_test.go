@@ -0,0 +1,201 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScopedFlush(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.FlushPrefix = "app*:" })
+	for i := 0; i < 2500; i++ {
+		f.data[fmt.Sprintf("app*:%d", i)] = "v"
+	}
+	f.data[staleMetaKey("app*:1")] = "1"
+	f.data["app:1"] = "not matched by the literal *"
+	f.data["other"] = "v"
+
+	res := &protocol.McResponse{}
+	if err := FlushAllHandler(&protocol.McRequest{Command: "flush_all"}, res); err != nil || res.Response != "OK" {
+		t.Fatalf("flush_all: %q, %v", res.Response, err)
+	}
+	waitFor(t, "scoped flush", func() bool { return !flushInProgress() })
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.data) != 2 || f.data["app:1"] == "" || f.data["other"] == "" {
+		t.Errorf("left after flush: %v", f.data)
+	}
+}
+
+// A flush too large to finish before flush_all answers runs in the
+// background, logs its progress, and folds the flush_alls sent meanwhile
+// into a single further pass.
+func TestScopedFlushLargeKeyspace(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.FlushPrefix = "app:" })
+	for i := 0; i < 20000; i++ {
+		f.data[fmt.Sprintf("app:%05d", i)] = "v"
+	}
+	prevInterval := flushProgressInterval
+	flushProgressInterval = time.Millisecond
+	defer func() { flushProgressInterval = prevInterval }()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for i := 0; i < 3; i++ {
+		res := &protocol.McResponse{}
+		if err := FlushAllHandler(&protocol.McRequest{Command: "flush_all"}, res); err != nil || res.Response != "OK" {
+			t.Fatalf("flush_all: %q, %v", res.Response, err)
+		}
+		if !flushInProgress() {
+			t.Fatalf("flush_all %d answered after the flush finished", i+1)
+		}
+	}
+	waitFor(t, "scoped flush", func() bool { return !flushInProgress() })
+
+	log.SetOutput(os.Stderr)
+	out := logged.String()
+	if n := strings.Count(out, `flush_all of the keys under "app:" started`); n != 2 {
+		t.Errorf("%d passes for 3 flush_alls sent while running, want 2:\n%s", n, out)
+	}
+	for _, want := range []string{"deleted in ", "so far", `under "app:" done, 20000 deleted in `, "flushing again once it is done"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log without %q:\n%s", want, out)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.data) != 0 {
+		t.Errorf("%d keys left after flush", len(f.data))
+	}
+}
+
+func TestGlobEscape(t *testing.T) {
+	if got, want := globEscape(`a*b?[c]\`), `a\*b\?\[c\]\\`; got != want {
+		t.Errorf("globEscape: %q, want %q", got, want)
+	}
+}
+
+// Items stored before flush_all are deleted and items stored after it are
+// kept, whether the scan has passed their key yet or not.
+func TestScopedFlushConcurrentStores(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.FlushPrefix = "app:" })
+	for i := 0; i < 5000; i++ {
+		f.data[fmt.Sprintf("app:%04d", i)] = "old"
+	}
+
+	set := func(key string) {
+		req := &protocol.McRequest{Command: "set", Key: key, Value: []byte("new")}
+		if err := SetHandler(req, &protocol.McResponse{}); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := FlushAllHandler(&protocol.McRequest{Command: "flush_all"}, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 5000; i += 40 {
+				set(fmt.Sprintf("app:%04d", i)) // overwrites, passed or not yet scanned
+				set(fmt.Sprintf("app:new%d", i))
+			}
+		}(w)
+	}
+	wg.Wait()
+	waitFor(t, "scoped flush", func() bool { return !flushInProgress() })
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, v := range f.data {
+		if v != "new" {
+			t.Errorf("%s=%s survived the flush", key, v)
+		}
+	}
+	if len(f.data) != 1000 {
+		t.Errorf("%d items left, want the 1000 stored after flush_all", len(f.data))
+	}
+}
+
+// flushWindow makes a scoped flush run without deleting anything, as if
+// its scan had not yet reached the keys, until the returned function is
+// called.
+func flushWindow() (end func()) {
+	scopedFlush.Lock()
+	scopedFlush.running, scopedFlush.written = true, make(map[string]bool)
+	scopedFlush.Unlock()
+	return func() {
+		scopedFlush.Lock()
+		scopedFlush.running, scopedFlush.written = false, nil
+		scopedFlush.Unlock()
+	}
+}
+
+func getValues(t *testing.T, keys ...string) map[string]string {
+	res := &protocol.McResponse{}
+	if err := GetHandler(&protocol.McRequest{Command: "get", Keys: keys}, res); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	for _, v := range res.Values {
+		values[v.Key] = string(v.Data)
+	}
+	return values
+}
+
+func TestGetDuringScopedFlush(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.FlushPrefix = "app:" })
+	f.data["app:old"] = "old"
+	f.data["app:overwritten"] = "old"
+	f.data["other"] = "kept"
+	defer flushWindow()()
+
+	req := &protocol.McRequest{Command: "set", Key: "app:overwritten", Flags: "0", Value: []byte("new")}
+	if err := SetHandler(req, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	got := getValues(t, "app:old", "app:overwritten", "other")
+	if len(got) != 2 || got["app:overwritten"] != "new" || got["other"] != "kept" {
+		t.Errorf("get while flushing: %v, want app:overwritten=new and other=kept", got)
+	}
+	if f.data["app:old"] != "old" {
+		t.Fatalf("app:old deleted, the test no longer covers a key still in Redis")
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.GetFlushing = FlushingValue })
+	if got := getValues(t, "app:old"); got["app:old"] != "old" {
+		t.Errorf("get with GET_FLUSHING=value: %v, want app:old=old", got)
+	}
+}
+
+// Right after flush_all, before or after the scan has reached them, the
+// keys under the prefix are misses.
+func TestGetRightAfterScopedFlush(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.FlushPrefix = "app:" })
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("app:%04d", i)
+		f.data[keys[i]] = "old"
+	}
+	if err := FlushAllHandler(&protocol.McRequest{Command: "flush_all"}, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := getValues(t, keys...); len(got) != 0 {
+		t.Errorf("%d hits right after flush_all", len(got))
+	}
+	waitFor(t, "scoped flush", func() bool { return !flushInProgress() })
+}
@@ -3,20 +3,14 @@ package rcdaemon
 import (
 	"fmt"
 	"../protocol"
-	"gopkg.in/redis.v3"
+	"log"
 	"strconv"
+	"sync/atomic"
 	"time"
-	"os"
 )
 
-var backend *redis.Client
-
-func init() {
-	backend = redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_HOST") + ":6379",
-		PoolSize: 100,
-	})
-}
+// backend is the Redis the handlers operate on, see Connect.
+var backend Backend
 
 type ttl struct {
 	secs      time.Duration
@@ -24,14 +18,73 @@ type ttl struct {
 	past      bool
 }
 
+// expirationParser converts a memcached exptime to a ttl, clamped to the
+// configured TTL_MIN/TTL_MAX. Expirations in the past are never clamped.
 func expirationParser(t int64) (ttl, error) {
+	ttl, err := parseExptime(t)
+	if err != nil || ttl.past {
+		return ttl, err
+	}
+	cfg := config()
+	return clampTTL(ttl, cfg.TTLMin, cfg.TTLMax), nil
+}
+
+func clampTTL(ttl ttl, min, max time.Duration) ttl {
+	if ttl.unlimited {
+		if max > 0 {
+			ttl.unlimited = false
+			ttl.secs = max
+		}
+		return ttl
+	}
+	if min > 0 && ttl.secs < min {
+		ttl.secs = min
+	}
+	if max > 0 && ttl.secs > max {
+		ttl.secs = max
+	}
+	return ttl
+}
+
+// cappedTTLs counts the writes whose TTL MAX_TTL capped, and
+// cappedTTLLogged is the Unix time they were last logged.
+var cappedTTLs, cappedTTLLogged int64
+
+// capRedisTTL caps d, the expiration of a key written to Redis, 0 for none,
+// to MAX_TTL if set. Unlike TTL_MAX this is a backstop on memory applied to
+// the final TTL, after STALE_GRACE, so caps are counted and logged, at most
+// once a second.
+func capRedisTTL(d time.Duration) time.Duration {
+	max := maxTTL(d)
+	if max == d {
+		return d
+	}
+	n := atomic.AddInt64(&cappedTTLs, 1)
+	if now := time.Now().Unix(); atomic.SwapInt64(&cappedTTLLogged, now) != now {
+		log.Printf("MAX_TTL capped the TTL of a write to %v, %d writes capped so far", max, n)
+	}
+	return max
+}
+
+// maxTTL is d capped as by capRedisTTL, without counting it.
+func maxTTL(d time.Duration) time.Duration {
+	if max := config().MaxTTL; max > 0 && (d <= 0 || d > max) {
+		return max
+	}
+	return d
+}
+
+func parseExptime(t int64) (ttl, error) {
 	ttl := ttl{}
 
 	if t == 0 {
 		// it's an error to set the expiration to 0 in Redis
 		ttl.unlimited = true
 		return ttl, nil
-	} else if t > 2592000 { // above 30 days is an epoch in Memcached
+	} else if t > protocol.MaxExptime {
+		// rejected by the parser, time.Unix and Sub would overflow
+		return ttl, fmt.Errorf("Expiration too far in the future")
+	} else if t > 2592000 && config().TTLMode == TTLModeMemcached { // above 30 days is an epoch in Memcached
 		now := time.Now()
 		expire_at := time.Unix(t, 0)
 		secs := expire_at.Sub(now)
@@ -45,8 +98,11 @@ func expirationParser(t int64) (ttl, error) {
 	} else if t < 0 {
 		return ttl, fmt.Errorf("Expiration cannot be negative")
 	} else {
-		secs := time.Duration(t) * time.Second
-		ttl.secs = secs
+		unit := time.Second
+		if config().TTLMode == TTLModeMilliseconds {
+			unit = time.Millisecond
+		}
+		ttl.secs = time.Duration(t) * unit
 		return ttl, nil
 	}
 }
@@ -57,29 +113,161 @@ func expirationParser(t int64) (ttl, error) {
 //
 // In Redis, GET is only for getting one key.
 // In Memcached, GET is a variadic command, accepting multiple keys.
+// All keys are fetched with a single MGET; the Server counts hits and
+// misses per key, not per command. MGET answers each position, so values come
+// back in request order, once per occurrence of a repeated key, as with
+// memcached.
+//
+// Values are decoded as described in encodeValue; the flags stored with
+// them are returned. Items buffered by write-behind are answered from the
+// buffer.
+//
+// Keys holding another Redis type (a list, a hash...) are misses for MGET.
+// With GET_WRONGTYPE=error the get fails with CLIENT_ERROR instead, which
+// costs an EXISTS per miss to tell them from missing keys.
+//
+// While a scoped flush_all runs, the keys it is to delete are misses
+// though still in Redis, unless GET_FLUSHING=value, see flushingKeys.
+//
+// With COALESCE_GETS set, concurrent gets of a key share one read of it,
+// see coalesce.
+//
+// With MISS_REASONS set, the misses are logged with their reason, see
+// logMissReasons.
+//
+// With GET_LATENCY_FLOOR set, every get takes at least that long, so that
+// hits and misses cannot be told apart by timing.
+//
+// A Redis error fails the get with SERVER_ERROR, or with
+// READ_FAIL_MODE=open makes it a miss of every key. A get without keys is
+// answered ERROR, as memcached does.
 func GetHandler(req *protocol.McRequest, res *protocol.McResponse) error {
-	for _, key := range req.Keys {
-		// TODO: Use MGET for multiple keys
-		value, err := backend.Get(key).Result()
-		if err == redis.Nil {
+	if len(req.Keys) == 0 {
+		res.Response = unknownCommand("get without keys") // as ReadRequest answers it
+		return nil
+	}
+	cfg := config()
+	get := mget
+	if cfg.StaleGrace > 0 && scripting() {
+		get = getWithStale
+	}
+	if cfg.ReadFailMode == ReadFailPartial {
+		get = partial(get)
+	}
+	if cfg.CoalesceGets {
+		get = coalesce(get)
+	}
+	return readKeys(cfg, req, res, get)
+}
+
+// readKeys answers the keys of req looked up with get, as every read of
+// clients is: after GET_LATENCY_FLOOR, from the write-behind buffer, without
+// the keys a scoped flush_all is deleting, with READ_FAIL_MODE and
+// MISS_REASONS. It serves get and mg.
+func readKeys(cfg *Config, req *protocol.McRequest, res *protocol.McResponse, get getFn) error {
+	if cfg.GetLatencyFloor > 0 {
+		defer padLatency(time.Now(), cfg.GetLatencyFloor)
+	}
+	var flushing map[string]bool
+	if cfg.FlushPrefix != "" && cfg.GetFlushing == FlushingMiss {
+		flushing = flushingKeys(cfg.FlushPrefix, req.Keys) // before Redis is read
+	}
+	var err error
+	if buffered := bufferedValues(req.Keys); buffered != nil {
+		err = getBuffered(cfg, req, res, buffered, get)
+	} else {
+		err = get(cfg, req, res)
+	}
+	if err != nil && cfg.ReadFailMode != ReadFailClosed {
+		log.Printf("ERROR: %v, get answered as a miss, Keys: %v", err, req.Keys)
+		res.Values = nil
+		res.Response = "END"
+		return nil
+	}
+	if err == nil && len(flushing) > 0 {
+		values := res.Values[:0]
+		for _, v := range res.Values {
+			if !flushing[v.Key] {
+				values = append(values, v)
+			}
+		}
+		res.Values = values
+	}
+	if err == nil && cfg.MissReasons && res.Response == "END" && scripting() {
+		logMissReasons(req.Keys, res.Values)
+	}
+	return err
+}
+
+// getFn looks up the keys of a get in Redis.
+type getFn func(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error
+
+// mget is the getFn unless STALE_GRACE is set.
+func mget(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error {
+	if len(req.Keys) == 0 {
+		res.Response = "END" // MGET without keys is a Redis error
+		return nil
+	}
+	values, err := backend.MGet(req.Keys...).Result()
+	if err != nil {
+		return err
+	}
+	res.Values = make([]protocol.McValue, 0, len(values))
+	for i, value := range values {
+		hotKeys.record(req.Keys[i])
+		s, ok := value.(string)
+		if !ok {
+			if cfg.GetWrongType == WrongTypeError {
+				exists := backend.Exists(req.Keys[i])
+				if exists.Err() != nil {
+					return exists.Err()
+				}
+				if exists.Val() {
+					wrongType(req.Keys[i], res)
+					return nil
+				}
+			}
 			continue // key did not exist
-		} else if err != nil {
-			return err
 		}
-		res.Values = append(res.Values, protocol.McValue{key, "0", []byte(value)})
+		flags, data, ok := decodeValue(s)
+		if !ok {
+			continue // stored by a later version
+		}
+		res.Values = append(res.Values, protocol.McValue{Key: req.Keys[i], Flags: strconv.FormatUint(uint64(flags), 10), Data: []byte(data)})
 	}
 	res.Response = "END"
 	return nil
 }
 
+// padLatency sleeps until floor has passed since start.
+func padLatency(start time.Time, floor time.Duration) {
+	time.Sleep(floor - time.Since(start))
+}
+
+// wrongType answers a get that read key, which holds a non-string Redis
+// value, with GET_WRONGTYPE=error.
+func wrongType(key string, res *protocol.McResponse) {
+	res.Values = nil
+	res.Response = "CLIENT_ERROR key " + key + " holds a non-string Redis value"
+}
+
 func SetHandler(req *protocol.McRequest, res *protocol.McResponse) error {
 	key := req.Key
-	value := req.Value
+	value := storedValue(req)
+	defer beginWrite(key)()
+	hotKeys.record(key)
 	exp, err := expirationParser(req.Exptime)
 	if err != nil {
 		return err
 	}
 
+	if req.Noreply && config().WriteBehindInterval > 0 && !exp.past && scripting() {
+		bufferSet(req, exp)
+		res.Response = "STORED"
+		return nil
+	}
+	forgetWrite(key)
+
 	// Don't store it and set the expiration if in the past
 	if exp.past {
 		backend.Expire(key, exp.secs)
@@ -87,10 +275,19 @@ func SetHandler(req *protocol.McRequest, res *protocol.McResponse) error {
 		return nil
 	}
 
-	err = backend.Set(key, value, exp.secs).Err()
+	err = backend.Set(key, value, hardTTL(exp)).Err()
 	if err != nil {
 		return err
 	}
+	if err := setStaleDeadline(key, exp); err != nil {
+		return err
+	}
+	if err := tagItem(key); err != nil {
+		return err
+	}
+	if err := recordStore(key, exp); err != nil {
+		return err
+	}
 
 	res.Response = "STORED"
 	return nil
@@ -103,18 +300,34 @@ func SetHandler(req *protocol.McRequest, res *protocol.McResponse) error {
 // - If an item already exists and an add fails, it promotes the item to the front of the LRU anyway.
 func AddHandler(req *protocol.McRequest, res *protocol.McResponse) error {
 	key := req.Key
-	value := req.Value
+	value := storedValue(req)
+	defer beginWrite(key)()
+	hotKeys.record(key)
 	exp, err := expirationParser(req.Exptime)
 	if err != nil {
 		return err
 	}
+	settleWrite(key)
 
-	result := backend.SetNX(key, value, exp.secs)
+	expiration := exp.secs // a past exptime is not capped by MAX_TTL
+	if !exp.past {
+		expiration = hardTTL(exp)
+	}
+	result := backend.SetNX(key, value, expiration)
 	if result.Err() != nil {
 		return result.Err()
 	}
 
 	if result.Val() {
+		if err := setStaleDeadline(key, exp); err != nil {
+			return err
+		}
+		if err := tagItem(key); err != nil {
+			return err
+		}
+		if err := recordStore(key, exp); err != nil {
+			return err
+		}
 		res.Response = "STORED"
 	} else {
 		res.Response = "NOT_STORED"
@@ -124,6 +337,9 @@ func AddHandler(req *protocol.McRequest, res *protocol.McResponse) error {
 
 func DeleteHandler(req *protocol.McRequest, res *protocol.McResponse) error {
 	key := req.Key
+	hotKeys.record(key)
+	buffered := forgetWrite(key)
+	defer detachGets(key)
 
 	result := backend.Del(key)
 	if result.Err() != nil {
@@ -131,7 +347,10 @@ func DeleteHandler(req *protocol.McRequest, res *protocol.McResponse) error {
 	}
 	count := result.Val()
 
-	if count > 0 {
+	if count > 0 || buffered {
+		if err := recordDelete(key); err != nil {
+			return err
+		}
 		res.Response = "DELETED"
 	} else {
 		res.Response = "NOT_FOUND"
@@ -150,57 +369,118 @@ func DeleteHandler(req *protocol.McRequest, res *protocol.McResponse) error {
 //
 // In Redis, INCR is only for bumping up one. You use INCRBY for more.
 // In Memcached, the increment amount is a required argument of INCR.
+//
+// Overflow:
+//
+// In Redis, INCRBY is signed and fails on overflow.
+// In Memcached, counters are unsigned 64-bit and wrap around, see incrScript.
+//
+// Retries:
+//
+// incr and decr are not idempotent, so they are never retried. If the
+// connection fails after the command may have reached Redis, the client
+// gets `SERVER_ERROR outcome unknown` rather than a guess either way.
 func IncrHandler(req *protocol.McRequest, res *protocol.McResponse) error {
-	key := req.Key
-	increment := req.Increment
+	return arith("incr", req, res)
+}
 
-	exists := backend.Exists(key)
-	if !exists.Val() {
-		res.Response = "NOT_FOUND"
+// `decr` handler, see IncrHandler.
+func DecrHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	return arith("decr", req, res)
+}
+
+// `flush_all` handler
+//
+// Flushes the whole Redis database, or with FLUSH_PREFIX starts deleting
+// the keys with that prefix in the background, see startScopedFlush.
+func FlushAllHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	recordFlush()
+	defer detachGets()
+	discardWrites(config().FlushPrefix)
+	if config().FlushPrefix != "" {
+		startScopedFlush()
+		res.Response = "OK"
 		return nil
 	}
 
-	result := backend.IncrBy(key, increment)
+	result := backend.FlushAll()
 	if result.Err() != nil {
 		return result.Err()
 	}
-	val := strconv.FormatInt(result.Val(), 10)
 
-	res.Response = val
+	res.Response = "OK"
 	return nil
 }
 
-func DecrHandler(req *protocol.McRequest, res *protocol.McResponse) error {
-	key := req.Key
-	increment := req.Increment
-
-	exists := backend.Exists(key)
-	if !exists.Val() {
-		res.Response = "NOT_FOUND"
+// `cache_memlimit` handler
+//
+// Eviction is governed by Redis' maxmemory, so the limit is advisory at
+// best. By default it is acknowledged and ignored; with
+// CACHE_MEMLIMIT=redis it is forwarded with CONFIG SET maxmemory, which
+// managed Redis offerings may refuse.
+func CacheMemlimitHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	memlimit, err := strconv.ParseUint(req.Args[0], 10, 32)
+	if err != nil {
+		res.Response = "ERROR"
 		return nil
 	}
-
-	result := backend.DecrBy(key, increment)
-	if result.Err() != nil {
-		return result.Err()
+	if memlimit < 8 {
+		res.Response = "MEMLIMIT_TOO_SMALL cannot set maxbytes to less than 8m"
+		return nil
+	}
+	if memlimit > 1000000000 {
+		res.Response = "MEMLIMIT_ADJUST_FAILED input value is megabytes not bytes"
+		return nil
 	}
-	val := strconv.FormatInt(result.Val(), 10)
 
-	res.Response = val
+	if config().CacheMemlimit == CacheMemlimitRedis {
+		maxmemory := strconv.FormatUint(memlimit*1024*1024, 10)
+		if err := backend.ConfigSet("maxmemory", maxmemory).Err(); err != nil {
+			res.Response = "MEMLIMIT_ADJUST_FAILED " + err.Error()
+			return nil
+		}
+	}
+	res.Response = "OK"
 	return nil
 }
 
-func FlushAllHandler(req *protocol.McRequest, res *protocol.McResponse) error {
-	result := backend.FlushAll()
-	if result.Err() != nil {
-		return result.Err()
+// `lru_crawler` and `slabs` handler
+//
+// Redis manages memory, so there are no slabs or LRU to act on and these
+// only satisfy tooling that sends them: lru_crawler metadump lists no keys
+// and the other known subcommands are acknowledged. With
+// SLAB_COMMANDS=error they are answered ERROR like unknown commands.
+func SlabsHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	if config().SlabCommands == SlabCommandsError {
+		res.Response = unknownCommand(req.Command + " is not supported, Redis manages memory")
+		return nil
+	}
+	sub := ""
+	if len(req.Args) > 0 {
+		sub = req.Args[0]
+	}
+	switch {
+	case req.Command == "lru_crawler" && sub == "metadump":
+		res.Response = "END"
+	case req.Command == "lru_crawler" && (sub == "crawl" || sub == "enable" || sub == "disable" || sub == "sleep" || sub == "tocrawl"),
+		req.Command == "slabs" && (sub == "reassign" || sub == "automove"):
+		res.Response = "OK"
+	default:
+		res.Response = "ERROR"
 	}
-
-	res.Response = "OK"
 	return nil
 }
 
+const Version = "redcached-0.1"
+
 func VersionHandler(req *protocol.McRequest, res *protocol.McResponse) error {
-	res.Response = "VERSION redcached-0.1"
+	res.Response = "VERSION " + Version
+	return nil
+}
+
+// `noop` and `ping` handler, an extension for keepalive probes that
+// touches neither Redis nor the stats.
+func NoopHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	res.Response = "OK"
 	return nil
 }
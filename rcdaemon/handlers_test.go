@@ -0,0 +1,472 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withConfig runs the test with a copy of the current config modified by fn.
+func withConfig(t testing.TB, fn func(cfg *Config)) {
+	prev := config()
+	cfg := *prev
+	fn(&cfg)
+	current.Store(&cfg)
+	t.Cleanup(func() { current.Store(prev) })
+}
+
+// memcached answers every occurrence of a key, in request order.
+func TestGetDuplicateKeysInOrder(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["a"] = "1"
+	f.data["b"] = "2"
+
+	for _, grace := range []time.Duration{0, 10 * time.Second} {
+		withConfig(t, func(cfg *Config) { cfg.StaleGrace = grace })
+		req := &protocol.McRequest{Command: "get", Keys: []string{"b", "x", "a", "b", "x", "b"}}
+		res := &protocol.McResponse{}
+		if err := GetHandler(req, res); err != nil {
+			t.Fatalf("GetHandler: %v", err)
+		}
+		var got []string
+		for _, v := range res.Values {
+			got = append(got, v.Key+"="+string(v.Data))
+		}
+		if want := "b=2 a=1 b=2 b=2"; strings.Join(got, " ") != want {
+			t.Errorf("STALE_GRACE %v: values %q, want %q", grace, got, want)
+		}
+	}
+}
+
+func TestGetLatencyFloor(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["hit"] = "v"
+	withConfig(t, func(cfg *Config) { cfg.GetLatencyFloor = 20 * time.Millisecond })
+
+	for _, key := range []string{"hit", "miss"} {
+		start := time.Now()
+		if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{key}}, &protocol.McResponse{}); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 20*time.Millisecond {
+			t.Errorf("get %s answered after %v", key, d)
+		}
+	}
+}
+
+func TestGetWrongType(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["s"] = "v"
+	f.others["l"] = "list"
+
+	for _, grace := range []time.Duration{0, 10 * time.Second} {
+		withConfig(t, func(cfg *Config) { cfg.StaleGrace, cfg.GetWrongType = grace, WrongTypeMiss })
+		req := &protocol.McRequest{Command: "get", Keys: []string{"s", "l", "missing"}}
+		res := &protocol.McResponse{}
+		if err := GetHandler(req, res); err != nil || len(res.Values) != 1 || res.Response != "END" {
+			t.Errorf("STALE_GRACE %v, miss: %+v, %v", grace, res, err)
+		}
+
+		withConfig(t, func(cfg *Config) { cfg.GetWrongType = WrongTypeError })
+		res = &protocol.McResponse{}
+		if err := GetHandler(req, res); err != nil || len(res.Values) != 0 ||
+			res.Response != "CLIENT_ERROR key l holds a non-string Redis value" {
+			t.Errorf("STALE_GRACE %v, error: %+v, %v", grace, res, err)
+		}
+	}
+}
+
+// Exptimes up to 30 days are relative; anything larger is a Unix time, so
+// 2592001 is a second into 1970 and already past.
+func TestExpirationThirtyDayBoundary(t *testing.T) {
+	tests := []struct {
+		exptime int64
+		want    ttl
+	}{
+		{1, ttl{secs: time.Second}},
+		{2592000, ttl{secs: 30 * 24 * time.Hour}},
+	}
+	for _, tt := range tests {
+		got, err := expirationParser(tt.exptime)
+		if err != nil || got != tt.want {
+			t.Errorf("expirationParser(%d) = %+v, %v, want %+v", tt.exptime, got, err, tt.want)
+		}
+	}
+
+	got, err := expirationParser(2592001)
+	if err != nil || !got.past || got.unlimited || got.secs >= 0 {
+		t.Errorf("expirationParser(2592001) = %+v, %v, want past", got, err)
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	got, err = expirationParser(future)
+	if err != nil || got.past || got.unlimited || got.secs <= 59*time.Minute || got.secs > time.Hour {
+		t.Errorf("expirationParser(now+1h) = %+v, %v", got, err)
+	}
+}
+
+// With TTL_MODE=relative there are no epochs, on either side of 30 days.
+func TestExpirationRelativeMode(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.TTLMode = TTLModeRelative })
+	for _, exptime := range []int64{1, 2592000, 2592001, 3024000} {
+		got, err := expirationParser(exptime)
+		if want := (ttl{secs: time.Duration(exptime) * time.Second}); err != nil || got != want {
+			t.Errorf("expirationParser(%d) = %+v, %v, want %+v", exptime, got, err, want)
+		}
+	}
+	if got, err := expirationParser(0); err != nil || !got.unlimited {
+		t.Errorf("expirationParser(0) = %+v, %v, want unlimited", got, err)
+	}
+}
+
+// With TTL_MODE=milliseconds every exptime is milliseconds from now.
+func TestExpirationMillisecondsMode(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.TTLMode = TTLModeMilliseconds })
+	for _, exptime := range []int64{1, 500, 2592001, protocol.MaxExptime} {
+		got, err := expirationParser(exptime)
+		if want := (ttl{secs: time.Duration(exptime) * time.Millisecond}); err != nil || got != want {
+			t.Errorf("expirationParser(%d) = %+v, %v, want %+v", exptime, got, err, want)
+		}
+	}
+	if got, err := expirationParser(0); err != nil || !got.unlimited {
+		t.Errorf("expirationParser(0) = %+v, %v, want unlimited", got, err)
+	}
+}
+
+// A 500ms exptime is read as 500ms, and written to Redis as such.
+func TestMillisecondTTL(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.TTLMode = TTLModeMilliseconds })
+	if got, err := expirationParser(500); err != nil || got.secs != 500*time.Millisecond {
+		t.Errorf("expirationParser(500) = %+v, %v, want 500ms", got, err)
+	}
+	if err := SetHandler(&protocol.McRequest{Command: "set", Key: "k", Flags: "0", Exptime: 500, Value: []byte("v")}, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	got := f.ttls["k"]
+	f.mu.Unlock()
+	if got != 500*time.Millisecond {
+		t.Errorf("TTL of k in Redis %v, want 500ms", got)
+	}
+}
+
+// Exptimes past the parser's ceiling never reach time.Unix, where they
+// would overflow into the past or a nonsensical TTL.
+func TestExpirationHuge(t *testing.T) {
+	if got, err := expirationParser(math.MaxInt64); err == nil {
+		t.Errorf("expirationParser(MaxInt64) = %+v, want an error", got)
+	}
+	got, err := expirationParser(protocol.MaxExptime)
+	if err != nil || got.past || got.unlimited || got.secs < 50*365*24*time.Hour {
+		t.Errorf("expirationParser(MaxExptime) = %+v, %v", got, err)
+	}
+}
+
+func TestExpirationClampedToBounds(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.TTLMin = 10 * time.Second
+		cfg.TTLMax = time.Hour
+	})
+
+	tests := []struct {
+		exptime int64
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{10, 10 * time.Second},
+		{60, time.Minute},
+		{3600, time.Hour},
+		{7200, time.Hour},
+	}
+	for _, tt := range tests {
+		ttl, err := expirationParser(tt.exptime)
+		if err != nil {
+			t.Fatalf("expirationParser(%d): %v", tt.exptime, err)
+		}
+		if ttl.unlimited || ttl.past || ttl.secs != tt.want {
+			t.Errorf("expirationParser(%d) = %+v, want %v", tt.exptime, ttl, tt.want)
+		}
+	}
+}
+
+func TestExpirationUnlimitedWithMax(t *testing.T) {
+	ttl, err := expirationParser(0)
+	if err != nil || !ttl.unlimited {
+		t.Fatalf("expirationParser(0) without TTL_MAX = %+v, %v", ttl, err)
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.TTLMax = time.Hour })
+	ttl, err = expirationParser(0)
+	if err != nil {
+		t.Fatalf("expirationParser(0): %v", err)
+	}
+	if ttl.unlimited || ttl.secs != time.Hour {
+		t.Errorf("expirationParser(0) with TTL_MAX = %+v, want %v", ttl, time.Hour)
+	}
+}
+
+func TestExpirationPastNotClamped(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.TTLMin = time.Minute })
+
+	ttl, err := expirationParser(time.Now().Add(-time.Hour).Unix())
+	if err != nil {
+		t.Fatalf("expirationParser: %v", err)
+	}
+	if !ttl.past || ttl.secs > 0 {
+		t.Errorf("expirationParser(past) = %+v", ttl)
+	}
+}
+
+func cacheMemlimit(t *testing.T, mb string) string {
+	res := &protocol.McResponse{}
+	req := &protocol.McRequest{Command: "cache_memlimit", Args: []string{mb}}
+	if err := CacheMemlimitHandler(req, res); err != nil {
+		t.Fatalf("CacheMemlimitHandler: %v", err)
+	}
+	return res.Response
+}
+
+func TestCacheMemlimitIgnored(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.CacheMemlimit = CacheMemlimitIgnore })
+
+	if res := cacheMemlimit(t, "64"); res != "OK" {
+		t.Errorf("cache_memlimit 64: %q", res)
+	}
+	if len(f.config) != 0 {
+		t.Errorf("backend reconfigured: %v", f.config)
+	}
+}
+
+func TestCacheMemlimitForwardedToRedis(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.CacheMemlimit = CacheMemlimitRedis })
+
+	if res := cacheMemlimit(t, "64"); res != "OK" {
+		t.Errorf("cache_memlimit 64: %q", res)
+	}
+	if f.config["maxmemory"] != "67108864" {
+		t.Errorf("maxmemory %q", f.config["maxmemory"])
+	}
+
+	for mb, want := range map[string]string{
+		"4":          "MEMLIMIT_TOO_SMALL cannot set maxbytes to less than 8m",
+		"2000000000": "MEMLIMIT_ADJUST_FAILED input value is megabytes not bytes",
+		"lots":       "ERROR",
+	} {
+		if res := cacheMemlimit(t, mb); res != want {
+			t.Errorf("cache_memlimit %s: %q, want %q", mb, res, want)
+		}
+	}
+	if f.config["maxmemory"] != "67108864" {
+		t.Errorf("rejected limit changed maxmemory to %q", f.config["maxmemory"])
+	}
+}
+
+func TestGetWithoutKeys(t *testing.T) {
+	f := useFakeBackend(t)
+	f.fail["mget"] = errors.New("ERR wrong number of arguments for 'mget' command")
+	res := &protocol.McResponse{}
+	if err := GetHandler(&protocol.McRequest{Command: "get"}, res); err != nil || res.Response != "ERROR" {
+		t.Errorf("get without keys: %q, %v, want ERROR", res.Response, err)
+	}
+	res = &protocol.McResponse{}
+	if err := mget(config(), &protocol.McRequest{Command: "get"}, res); err != nil || res.Response != "END" {
+		t.Errorf("mget without keys: %q, %v, want END", res.Response, err)
+	}
+}
+
+func TestReadFailMode(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["k"] = "v"
+	f.fail["mget"] = io.ErrUnexpectedEOF
+	f.fail["eval"] = io.ErrUnexpectedEOF
+	get := func() (*protocol.McResponse, error) {
+		res := &protocol.McResponse{}
+		return res, GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"k"}}, res)
+	}
+
+	for _, grace := range []time.Duration{0, time.Minute} {
+		withConfig(t, func(cfg *Config) { cfg.StaleGrace = grace })
+		if _, err := get(); err != io.ErrUnexpectedEOF {
+			t.Errorf("STALE_GRACE=%v: closed get error %v", grace, err)
+		}
+
+		withConfig(t, func(cfg *Config) { cfg.ReadFailMode = ReadFailOpen })
+		if res, err := get(); err != nil || res.Response != "END" || len(res.Values) != 0 {
+			t.Errorf("STALE_GRACE=%v: open get %+v, %v, want a miss", grace, res, err)
+		}
+		withConfig(t, func(cfg *Config) { cfg.ReadFailMode = ReadFailClosed })
+	}
+}
+
+func TestSlabsHandler(t *testing.T) {
+	tests := map[string]string{
+		"lru_crawler metadump all": "END",
+		"lru_crawler crawl all":    "OK",
+		"slabs reassign 1 2":       "OK",
+		"slabs automove 1":         "OK",
+		"slabs":                    "ERROR",
+		"lru_crawler bogus":        "ERROR",
+	}
+	for line, want := range tests {
+		arr := strings.Fields(line)
+		res := &protocol.McResponse{}
+		if err := SlabsHandler(&protocol.McRequest{Command: arr[0], Args: arr[1:]}, res); err != nil || res.Response != want {
+			t.Errorf("%s: %q, %v, want %q", line, res.Response, err, want)
+		}
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.SlabCommands = SlabCommandsError })
+	res := &protocol.McResponse{}
+	SlabsHandler(&protocol.McRequest{Command: "slabs", Args: []string{"automove", "1"}}, res)
+	if res.Response != "ERROR" {
+		t.Errorf("slabs automove 1 with SLAB_COMMANDS=error: %q", res.Response)
+	}
+}
+
+func TestIncrAmbiguousFailure(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["n"] = "1"
+
+	for _, fail := range []error{io.EOF, &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}} {
+		f.fail["eval"] = fail
+		for _, handler := range []HandlerFn{IncrHandler, DecrHandler} {
+			err := handler(&protocol.McRequest{Key: "n", Increment: 1}, &protocol.McResponse{})
+			if _, ok := err.(outcomeUnknownError); !ok || !strings.HasPrefix(err.Error(), "outcome unknown: ") {
+				t.Errorf("%v: err %v, want outcome unknown", fail, err)
+			}
+		}
+	}
+
+	// Redis replied: the command was not applied and the error says so.
+	f.fail["eval"] = errors.New("ERR value is not an integer or out of range")
+	err := IncrHandler(&protocol.McRequest{Key: "n", Increment: 1}, &protocol.McResponse{})
+	if _, ok := err.(outcomeUnknownError); ok || err == nil {
+		t.Errorf("reply error reported as %v", err)
+	}
+
+	// Could not connect: nothing was sent.
+	f.fail["eval"] = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	err = IncrHandler(&protocol.McRequest{Key: "n", Increment: 1}, &protocol.McResponse{})
+	if _, ok := err.(outcomeUnknownError); ok || err == nil {
+		t.Errorf("dial error reported as %v", err)
+	}
+}
+
+func BenchmarkGetHandler(b *testing.B) {
+	f := useFakeBackend(b)
+	for _, key := range []string{"key1", "key2", "key3"} {
+		f.data[key] = strings.Repeat("x", 100)
+	}
+	req := &protocol.McRequest{Command: "get", Keys: []string{"key1", "key2", "key3"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := GetHandler(req, &protocol.McResponse{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetHandler(b *testing.B) {
+	useFakeBackend(b)
+	req := &protocol.McRequest{Command: "set", Key: "key", Flags: "0", Value: make([]byte, 100)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := SetHandler(req, &protocol.McResponse{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkHandler(b *testing.B, fn HandlerFn, req *protocol.McRequest) {
+	f := useFakeBackend(b)
+	f.data[req.Key] = "1"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := fn(req, &protocol.McResponse{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIncrHandler(b *testing.B) {
+	benchmarkHandler(b, IncrHandler, &protocol.McRequest{Command: "incr", Key: "n", Increment: 1})
+}
+
+func BenchmarkIncrHandlerNoreply(b *testing.B) {
+	benchmarkHandler(b, IncrHandler, &protocol.McRequest{Command: "incr", Key: "n", Increment: 1, Noreply: true})
+}
+
+func BenchmarkDeleteHandlerNoreply(b *testing.B) {
+	benchmarkHandler(b, DeleteHandler, &protocol.McRequest{Command: "delete", Key: "n", Noreply: true})
+}
+
+func TestMaxTTL(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.MaxTTL = time.Minute
+		cfg.StaleGrace = 30 * time.Second
+		cfg.TagDelimiter = ":"
+	})
+	before := atomic.LoadInt64(&cappedTTLs)
+
+	set := func(key string, exptime int64) {
+		req := &protocol.McRequest{Command: "set", Key: key, Flags: "0", Exptime: exptime, Value: []byte("v")}
+		if err := SetHandler(req, &protocol.McResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("forever", 0)
+	set("long", 3600)
+	set("graced", 45) // 45s + 30s of STALE_GRACE
+	set("short", 10)
+	set("user:1", 10)
+	for key, want := range map[string]time.Duration{
+		"forever":    time.Minute,
+		"long":       time.Minute,
+		"graced":     time.Minute,
+		"short":      40 * time.Second,
+		"__tag:user": time.Minute,
+	} {
+		if f.ttls[key] != want {
+			t.Errorf("TTL of %s %v, want %v", key, f.ttls[key], want)
+		}
+	}
+	// the meta keys of forever, long and graced are capped too
+	if n := atomic.LoadInt64(&cappedTTLs) - before; n != 5 {
+		t.Errorf("%d writes capped, want 5", n)
+	}
+
+	res := &protocol.McResponse{}
+	if err := AddHandler(&protocol.McRequest{Command: "add", Key: "added", Flags: "0", Value: []byte("v")}, res); err != nil {
+		t.Fatal(err)
+	}
+	if f.ttls["added"] != time.Minute {
+		t.Errorf("TTL of an add without exptime %v", f.ttls["added"])
+	}
+}
+
+// A past exptime writes no TTL, so MAX_TTL has none to cap.
+func TestMaxTTLPastExptime(t *testing.T) {
+	useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.MaxTTL = time.Minute })
+	before := atomic.LoadInt64(&cappedTTLs)
+
+	for _, handler := range []HandlerFn{AddHandler, AddGetHandler} {
+		req := &protocol.McRequest{Command: "add", Key: "past", Flags: "0", Exptime: 2592001, Value: []byte("v")}
+		if err := handler(req, &protocol.McResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&cappedTTLs) - before; n != 0 {
+		t.Errorf("%d writes capped, want 0", n)
+	}
+}
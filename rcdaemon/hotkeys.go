@@ -0,0 +1,184 @@
+package rcdaemon
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hot keys
+//
+// With HOTKEYS_SAMPLE_RATE set, a sample of the keys requested is counted
+// in a count-min sketch, which bounds the memory used whatever the number
+// of keys, and the HOTKEYS_TOP keys with the highest counts are listed by
+// `stats hotkeys`. Counts cover the current and the previous
+// HOTKEYS_WINDOW, so between one and two windows, and are scaled up by the
+// sample rate: they are estimates, and never too low but for sampling.
+//
+// Keys are the only unbounded label of any stat, so the memory they take is
+// bounded too, whatever clients send: at most MaxHotKeysTop keys are kept,
+// each of at most hotKeyMaxLen bytes, copied so as not to pin the command
+// line they came in.
+
+const (
+	sketchDepth = 4
+	sketchWidth = 2048 // with the depth, 64KiB for the two windows
+
+	DefaultHotKeysTop    = 10
+	DefaultHotKeysWindow = time.Minute
+
+	// MaxHotKeysTop bounds HOTKEYS_TOP, and the work of record with it.
+	MaxHotKeysTop = 1000
+
+	// hotKeyMaxLen is the longest key counted, that of memcached; longer
+	// keys are counted by their first hotKeyMaxLen bytes.
+	hotKeyMaxLen = 250
+)
+
+type sketch [sketchDepth][sketchWidth]uint32
+
+// cells returns the cell of key in each row of a sketch.
+func cells(key string) (idx [sketchDepth]uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % sketchWidth
+	}
+	return idx
+}
+
+type hotKeyTracker struct {
+	mu          sync.Mutex
+	cur, prev   *sketch
+	windowStart time.Time
+	top         map[string]bool // candidate keys, at most HOTKEYS_TOP
+}
+
+var hotKeys hotKeyTracker
+
+// count returns the estimated count of the key with cells idx.
+func (h *hotKeyTracker) count(idx [sketchDepth]uint32) uint32 {
+	var min uint32
+	for i, j := range idx {
+		if n := h.cur[i][j] + h.prev[i][j]; i == 0 || n < min {
+			min = n
+		}
+	}
+	return min
+}
+
+// record counts a request for key, if it is sampled.
+func (h *hotKeyTracker) record(key string) {
+	cfg := config()
+	if cfg.HotKeysSampleRate <= 0 || (cfg.HotKeysSampleRate < 1 && rand.Float64() >= cfg.HotKeysSampleRate) {
+		return
+	}
+	if len(key) > hotKeyMaxLen {
+		key = key[:hotKeyMaxLen]
+	}
+	idx := cells(key)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rotate(cfg.HotKeysWindow)
+	for i, j := range idx {
+		h.cur[i][j]++
+	}
+
+	if h.top[key] {
+		return
+	}
+	for len(h.top) > cfg.HotKeysTop { // lowered by a reload
+		h.evictColdest()
+	}
+	if len(h.top) < cfg.HotKeysTop {
+		h.top[string([]byte(key))] = true
+		return
+	}
+	// replace the coldest candidate if key is hotter
+	n := h.count(idx)
+	coldest, coldestCount := "", n
+	for k := range h.top {
+		if c := h.count(cells(k)); c < coldestCount {
+			coldest, coldestCount = k, c
+		}
+	}
+	if coldest != "" {
+		delete(h.top, coldest)
+		h.top[string([]byte(key))] = true
+	}
+}
+
+// evictColdest drops the candidate with the lowest count.
+func (h *hotKeyTracker) evictColdest() {
+	coldest, coldestCount := "", uint32(0)
+	for k := range h.top {
+		if c := h.count(cells(k)); coldest == "" || c < coldestCount {
+			coldest, coldestCount = k, c
+		}
+	}
+	delete(h.top, coldest)
+}
+
+// rotate starts a new window once window has passed.
+func (h *hotKeyTracker) rotate(window time.Duration) {
+	now := time.Now()
+	if h.cur == nil {
+		h.cur, h.prev, h.top, h.windowStart = new(sketch), new(sketch), make(map[string]bool), now
+		return
+	}
+	if now.Sub(h.windowStart) < window {
+		return
+	}
+	if now.Sub(h.windowStart) >= 2*window {
+		*h.prev = sketch{} // idle for a whole window
+	} else {
+		*h.prev = *h.cur
+	}
+	*h.cur = sketch{}
+	h.windowStart = now
+	for k := range h.top {
+		if h.count(cells(k)) == 0 {
+			delete(h.top, k)
+		}
+	}
+}
+
+type hotKey struct {
+	key   string
+	count uint64
+}
+
+// hottest returns the candidate keys, hottest first, with their estimated
+// number of requests.
+func (h *hotKeyTracker) hottest() []hotKey {
+	cfg := config()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cur == nil {
+		return nil
+	}
+	h.rotate(cfg.HotKeysWindow)
+	keys := make([]hotKey, 0, len(h.top))
+	for k := range h.top {
+		n := float64(h.count(cells(k)))
+		if cfg.HotKeysSampleRate > 0 {
+			n /= cfg.HotKeysSampleRate
+		}
+		keys = append(keys, hotKey{k, uint64(n)})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].count != keys[j].count {
+			return keys[i].count > keys[j].count
+		}
+		return keys[i].key < keys[j].key
+	})
+	if len(keys) > cfg.HotKeysTop {
+		keys = keys[:cfg.HotKeysTop]
+	}
+	return keys
+}
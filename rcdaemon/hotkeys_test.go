@@ -0,0 +1,144 @@
+package rcdaemon
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useHotKeys enables hot-key sampling of every request with a fresh tracker.
+func useHotKeys(t *testing.T, top int, window time.Duration) {
+	withConfig(t, func(cfg *Config) {
+		cfg.HotKeysSampleRate = 1
+		cfg.HotKeysTop = top
+		cfg.HotKeysWindow = window
+	})
+	hotKeys = hotKeyTracker{}
+	t.Cleanup(func() { hotKeys = hotKeyTracker{} })
+}
+
+func TestHotKeysTop(t *testing.T) {
+	useHotKeys(t, 3, time.Hour)
+	for i := 0; i < 1000; i++ {
+		hotKeys.record(fmt.Sprintf("cold%d", i))
+		if i%2 == 0 {
+			hotKeys.record("hot")
+		}
+		if i%4 == 0 {
+			hotKeys.record("warm")
+		}
+	}
+
+	keys := hotKeys.hottest()
+	if len(keys) != 3 {
+		t.Fatalf("hottest %v, want 3 keys", keys)
+	}
+	if keys[0].key != "hot" || keys[0].count < 500 {
+		t.Errorf("hottest %v, want hot first with at least 500", keys)
+	}
+	if keys[1].key != "warm" || keys[1].count < 250 {
+		t.Errorf("hottest %v, want warm second with at least 250", keys)
+	}
+}
+
+// However many distinct keys are sent, and however long, the tracker keeps
+// HOTKEYS_TOP keys of hotKeyMaxLen bytes at most.
+func TestHotKeysBounded(t *testing.T) {
+	useHotKeys(t, 3, time.Hour)
+	long := strings.Repeat("k", 10000)
+	for i := 0; i < 10000; i++ {
+		hotKeys.record(fmt.Sprintf("%d%s", i, long))
+	}
+	if len(hotKeys.top) != 3 {
+		t.Errorf("%d candidate keys, want 3", len(hotKeys.top))
+	}
+	for k := range hotKeys.top {
+		if len(k) > hotKeyMaxLen {
+			t.Errorf("candidate key of %d bytes", len(k))
+		}
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.HotKeysTop = 2 })
+	if keys := hotKeys.hottest(); len(keys) != 2 {
+		t.Errorf("hottest after lowering HOTKEYS_TOP %v", keys)
+	}
+	hotKeys.record("other")
+	if len(hotKeys.top) != 2 {
+		t.Errorf("%d candidate keys after lowering HOTKEYS_TOP, want 2", len(hotKeys.top))
+	}
+}
+
+func TestHotKeysWindow(t *testing.T) {
+	useHotKeys(t, 10, time.Hour)
+	hotKeys.record("old")
+	hotKeys.windowStart = hotKeys.windowStart.Add(-time.Hour)
+	hotKeys.record("new")
+	if keys := hotKeys.hottest(); len(keys) != 2 {
+		t.Errorf("hottest after one window %v, want old and new", keys)
+	}
+
+	hotKeys.windowStart = hotKeys.windowStart.Add(-time.Hour)
+	hotKeys.record("newer")
+	keys := hotKeys.hottest()
+	if len(keys) != 2 || keys[0].key != "new" || keys[1].key != "newer" {
+		t.Errorf("hottest after two windows %v, want new and newer", keys)
+	}
+}
+
+func TestHotKeysOffByDefault(t *testing.T) {
+	hotKeys = hotKeyTracker{}
+	hotKeys.record("k")
+	if hotKeys.cur != nil {
+		t.Errorf("request counted with HOTKEYS_SAMPLE_RATE unset")
+	}
+}
+
+func TestHotKeysScaledBySampleRate(t *testing.T) {
+	useHotKeys(t, 10, time.Hour)
+	withConfig(t, func(cfg *Config) { cfg.HotKeysSampleRate = 0.5 })
+	for i := 0; i < 2000; i++ {
+		hotKeys.record("k")
+	}
+	if keys := hotKeys.hottest(); len(keys) != 1 || keys[0].count < 1600 || keys[0].count > 2400 {
+		t.Errorf("hottest %v, want k at about 2000", keys)
+	}
+}
+
+func TestStatsHotKeys(t *testing.T) {
+	useHotKeys(t, 10, time.Hour)
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+	for i := 0; i < 3; i++ {
+		c.send(t, "get a b\r\n")
+		c.readUntil(t, "END")
+	}
+	c.send(t, "get b\r\n")
+	c.readUntil(t, "END")
+
+	c.send(t, "stats hotkeys\r\n")
+	lines := c.readUntil(t, "END")
+	if want := []string{"STAT b 4", "STAT a 3", "END"}; strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("stats hotkeys %q, want %q", lines, want)
+	}
+}
+
+func TestHotKeysConfig(t *testing.T) {
+	cfg, _, err := loadWithOverrides(map[string]string{"REDIS_ADDR": "x:1", "HOTKEYS_SAMPLE_RATE": "0.01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HotKeysSampleRate != 0.01 || cfg.HotKeysTop != DefaultHotKeysTop || cfg.HotKeysWindow != DefaultHotKeysWindow {
+		t.Errorf("config %+v", cfg)
+	}
+	for _, rate := range []string{"x", "-1", "2"} {
+		_, _, err := loadWithOverrides(map[string]string{"REDIS_ADDR": "x:1", "HOTKEYS_SAMPLE_RATE": rate})
+		if err == nil || !strings.Contains(err.Error(), "HOTKEYS_SAMPLE_RATE") {
+			t.Errorf("HOTKEYS_SAMPLE_RATE=%s: %v", rate, err)
+		}
+	}
+	_, _, err = loadWithOverrides(map[string]string{"REDIS_ADDR": "x:1", "HOTKEYS_TOP": "1000000"})
+	if err == nil || !strings.Contains(err.Error(), "HOTKEYS_TOP") {
+		t.Errorf("HOTKEYS_TOP=1000000: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"gopkg.in/redis.v3"
+	"strconv"
+)
+
+// Unsigned arithmetic
+//
+// memcached counters are unsigned 64-bit integers: incr wraps around at
+// 2^64 and decr stops at 0. Redis INCRBY is signed and fails on overflow,
+// so incr and decr run incrScript instead. Lua numbers are doubles, which
+// cannot hold 64 bits, so the script computes on base 10^7 limbs.
+
+// incrScript applies ARGV[1] ('incr' or 'decr') by the decimal uint64
+// ARGV[2] to KEYS[1], keeping its TTL and the header of its value, see
+// encodeValue. It returns the new value, nil if the key does not exist, or
+// a NONNUMERIC error if the value is not a uint64.
+var incrScript = newScript(`
+local base = 10000000
+local function limbs(s)
+  s = string.gsub(s, '^0+', '')
+  local t = {}
+  local i = #s
+  while i > 0 do
+    local j = math.max(1, i - 6)
+    t[#t + 1] = tonumber(string.sub(s, j, i))
+    i = j - 1
+  end
+  return t
+end
+local function tostr(t)
+  if #t == 0 then
+    return '0'
+  end
+  local out = {tostring(t[#t])}
+  for i = #t - 1, 1, -1 do
+    out[#out + 1] = string.format('%07d', t[i])
+  end
+  return table.concat(out)
+end
+local function less(a, b)
+  if #a ~= #b then
+    return #a < #b
+  end
+  for i = #a, 1, -1 do
+    if a[i] ~= b[i] then
+      return a[i] < b[i]
+    end
+  end
+  return false
+end
+local function add(a, b)
+  local t, carry = {}, 0
+  for i = 1, math.max(#a, #b) do
+    local s = (a[i] or 0) + (b[i] or 0) + carry
+    carry = math.floor(s / base)
+    t[i] = s % base
+  end
+  if carry > 0 then
+    t[#t + 1] = carry
+  end
+  return t
+end
+local function sub(a, b)
+  local t, borrow = {}, 0
+  for i = 1, #a do
+    local s = a[i] - (b[i] or 0) - borrow
+    borrow = 0
+    if s < 0 then
+      s = s + base
+      borrow = 1
+    end
+    t[i] = s
+  end
+  while #t > 0 and t[#t] == 0 do
+    t[#t] = nil
+  end
+  return t
+end
+
+local wrap = limbs('18446744073709551616')
+local v = redis.call('GET', KEYS[1])
+if not v then
+  return false
+end
+local header = ''
+if string.sub(v, 1, 4) == '\0RC\1' and #v >= 8 then
+  header, v = string.sub(v, 1, 8), string.sub(v, 9)
+end
+if not string.find(v, '^%d+$') or not less(limbs(v), wrap) then
+  return redis.error_reply('NONNUMERIC')
+end
+
+local n, delta = limbs(v), limbs(ARGV[2])
+if ARGV[1] == 'incr' then
+  n = add(n, delta)
+  if not less(n, wrap) then
+    n = sub(n, wrap)
+  end
+elseif less(n, delta) then
+  n = {}
+else
+  n = sub(n, delta)
+end
+
+local s = tostr(n)
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl > 0 then
+  redis.call('PSETEX', KEYS[1], pttl, header .. s)
+else
+  redis.call('SET', KEYS[1], header .. s)
+end
+return s
+`)
+
+// arith runs incr or decr for req, see IncrHandler. The response is the
+// string the script, or incrWatch, returns, so there is nothing to skip for noreply.
+func arith(op string, req *protocol.McRequest, res *protocol.McResponse) error {
+	hotKeys.record(req.Key)
+	settleWrite(req.Key)
+	defer detachGets(req.Key)
+	// not retried: a retry after the script was applied would apply it twice
+	var result interface{}
+	var err error
+	if watchOps() {
+		result, err = incrWatch(noRetry(), req.Key, op, req.Increment)
+	} else {
+		result, err = incrScript.RunOn(noRetry(), []string{req.Key}, []string{op, strconv.FormatUint(req.Increment, 10)}).Result()
+	}
+	switch {
+	case err == redis.Nil:
+		res.Response = "NOT_FOUND"
+		return nil
+	case err != nil && err.Error() == "NONNUMERIC":
+		res.Response = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+		return nil
+	case err != nil:
+		return unlessApplied(err)
+	}
+	res.Response, _ = result.(string)
+	return nil
+}
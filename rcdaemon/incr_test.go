@@ -0,0 +1,93 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"gopkg.in/redis.v3"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var incrTests = []struct {
+	value, op, delta, want string
+}{
+	{"0", "incr", "1", "1"},
+	{"9223372036854775807", "incr", "1", "9223372036854775808"},
+	{"9223372036854775808", "decr", "1", "9223372036854775807"},
+	{"18446744073709551615", "incr", "1", "0"},
+	{"18446744073709551615", "incr", "18446744073709551615", "18446744073709551614"},
+	{"18446744073709551614", "incr", "1", "18446744073709551615"},
+	{"9999999", "incr", "1", "10000000"},
+	{"10000000", "decr", "1", "9999999"},
+	{"5", "decr", "6", "0"},
+	{"18446744073709551615", "decr", "18446744073709551615", "0"},
+	{"007", "incr", "1", "8"},
+	{"\x00RC\x01\x00\x00\x00\x07" + "41", "incr", "1", "42"}, // flags 7
+	{"18446744073709551616", "incr", "1", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+	{"-1", "incr", "1", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+	{"abc", "decr", "1", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+}
+
+func runIncrTests(t *testing.T, f func(key, value string)) {
+	handlers := map[string]HandlerFn{"incr": IncrHandler, "decr": DecrHandler}
+	for _, tt := range incrTests {
+		f("n", tt.value)
+		req := &protocol.McRequest{Command: tt.op, Key: "n"}
+		req.Increment, _ = strconv.ParseUint(tt.delta, 10, 64)
+		res := &protocol.McResponse{}
+		if err := handlers[tt.op](req, res); err != nil {
+			t.Errorf("%s %s by %s: %v", tt.op, tt.value, tt.delta, err)
+		} else if res.Response != tt.want {
+			t.Errorf("%s %s by %s: %q, want %q", tt.op, tt.value, tt.delta, res.Response, tt.want)
+		}
+	}
+}
+
+func TestIncrUnsigned(t *testing.T) {
+	fb := useFakeBackend(t)
+	runIncrTests(t, func(key, value string) { fb.data[key] = value })
+
+	res := &protocol.McResponse{}
+	if err := IncrHandler(&protocol.McRequest{Command: "incr", Key: "missing", Increment: 1}, res); err != nil || res.Response != "NOT_FOUND" {
+		t.Errorf("incr missing: %q, %v", res.Response, err)
+	}
+}
+
+// TestIncrScript runs incrScript itself, which the fake backend only
+// mimics, on the Redis at TEST_REDIS_ADDR. It uses and deletes key "n".
+func TestIncrScript(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+	prev := backend
+	backend = client
+	defer func() { backend = prev }()
+	defer client.Del("n")
+
+	runIncrTests(t, func(key, value string) {
+		if err := client.Set(key, value, 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// With retries on, incr runs on the backend that does not retry.
+func TestIncrNotRetried(t *testing.T) {
+	retried := useFakeBackend(t)
+	prev := unretried
+	once := &fakeBackend{data: map[string]string{"n": "1"}, ttls: make(map[string]time.Duration), scripts: make(map[string]string), fail: make(map[string]error)}
+	unretried = once
+	t.Cleanup(func() { unretried = prev })
+
+	res := &protocol.McResponse{}
+	if err := IncrHandler(&protocol.McRequest{Command: "incr", Key: "n", Increment: 1}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "2" || once.evals == 0 || retried.evals != 0 {
+		t.Errorf("incr %q, %d scripts on the backend without retries, %d on the other", res.Response, once.evals, retried.evals)
+	}
+}
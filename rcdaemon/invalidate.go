@@ -0,0 +1,133 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Invalidation channel
+//
+// Other services caching what redcached serves need to know when an item
+// changes. With INVALIDATION_CHANNEL set, every successful set, append,
+// prepend, incr, decr and delete publishes "invalidate <key>" to that Redis
+// pub/sub channel, and every flush_all "flush", or "flush <prefix>" with
+// FLUSH_PREFIX. invalidate_tag and delete_matching, which may delete
+// millions of keys, publish them invalidationBatch at a time, as
+// "invalidate <key> <key>...". Memcached keys have no spaces, so none of
+// these can be confused. Publishing is best-effort: messages are queued and published
+// by one goroutine, so the requests never wait for it, and those that do
+// not fit in the queue or that Redis fails to publish are counted in
+// invalidations_dropped and lost. A set buffered by write-behind is
+// published once it is written, so that a service reading Redis on the
+// message finds the new value.
+
+const (
+	invalidationQueue = 10000 // bounds the messages waiting to be published
+	invalidationBatch = 100   // most keys of a message of publishDeleted
+)
+
+var invalidations = struct {
+	start   sync.Once
+	queue   chan string
+	dropped uint64 // accessed atomically
+}{
+	queue: make(chan string, invalidationQueue),
+}
+
+// invalidatingCommands are the commands publishing the key they change.
+var invalidatingCommands = map[string]bool{
+	"set": true, "append": true, "prepend": true, "incr": true, "decr": true, "delete": true,
+}
+
+// publishInvalidations is the Middleware publishing the keys changed by
+// successful commands, when INVALIDATION_CHANNEL is set. It is installed
+// by NewServer inside the memory guard, so refused writes publish nothing.
+func publishInvalidations(next HandlerFn) HandlerFn {
+	return func(req *protocol.McRequest, res *protocol.McResponse) error {
+		err := next(req, res)
+		if err != nil || config().InvalidationChannel == "" {
+			return err
+		}
+		switch {
+		case req.Command == "flush_all" && res.Response == "OK":
+			if prefix := config().FlushPrefix; prefix != "" {
+				publishInvalidation("flush " + prefix)
+			} else {
+				publishInvalidation("flush")
+			}
+		case req.Command == "set" && req.Noreply && buffered(req.Key):
+			// published by writeBuffered once written
+		case invalidatingCommands[req.Command] && changed(res.Response):
+			publishInvalidation("invalidate " + req.Key)
+		}
+		return err
+	}
+}
+
+// buffered reports whether write-behind holds a set of key, still to be
+// written. A set written meanwhile is published twice, which is harmless.
+func buffered(key string) bool {
+	b := bufferedValues([]string{key})
+	return b != nil && b[0] != nil
+}
+
+// changed reports whether response is that of a command changing its key:
+// STORED, DELETED or the new value of incr and decr.
+func changed(response string) bool {
+	if response == "STORED" || response == "DELETED" {
+		return true
+	}
+	if response == "" {
+		return false
+	}
+	for i := 0; i < len(response); i++ {
+		if response[i] < '0' || response[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// publishDeleted publishes keys, deleted by invalidate_tag or
+// delete_matching, when INVALIDATION_CHANNEL is set.
+func publishDeleted(keys []string) {
+	if config().InvalidationChannel == "" {
+		return
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > invalidationBatch {
+			n = invalidationBatch
+		}
+		publishInvalidation("invalidate " + strings.Join(keys[:n], " "))
+		keys = keys[n:]
+	}
+}
+
+// publishInvalidation queues msg for INVALIDATION_CHANNEL, or drops it if
+// the queue is full.
+func publishInvalidation(msg string) {
+	invalidations.start.Do(func() { go publishLoop() })
+	select {
+	case invalidations.queue <- msg:
+	default:
+		atomic.AddUint64(&invalidations.dropped, 1)
+	}
+}
+
+// publishLoop publishes the queued messages, one at a time.
+func publishLoop() {
+	for msg := range invalidations.queue {
+		channel := config().InvalidationChannel
+		if channel == "" {
+			continue // unset since
+		}
+		if err := backend.Publish(channel, msg).Err(); err != nil {
+			atomic.AddUint64(&invalidations.dropped, 1)
+			log.Printf("ERROR: publishing %q to %s: %v", msg, channel, err)
+		}
+	}
+}
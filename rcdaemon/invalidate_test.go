@@ -0,0 +1,115 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidationChannel(t *testing.T) {
+	srv, f := startTestServer(t)
+	c := dialTestServer(t, srv)
+	published := func() string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return strings.Join(f.published, "\n")
+	}
+
+	c.send(t, "set quiet 0 0 1\r\nv\r\n")
+	c.readLine(t)
+
+	withConfig(t, func(cfg *Config) { cfg.InvalidationChannel = "invalidations" })
+	c.send(t, "set k 0 0 1\r\n1\r\nset n 0 0 1 noreply\r\n1\r\nincr n 1\r\nappend missing 0 0 1\r\nx\r\n"+
+		"delete missing\r\ndelete k\r\nget n\r\nflush_all\r\n")
+	for _, want := range []string{"STORED", "2", "NOT_STORED", "NOT_FOUND", "DELETED", "VALUE n 0 1", "2", "END", "OK"} {
+		if line := c.readLine(t); line != want {
+			t.Errorf("%q, want %q", line, want)
+		}
+	}
+	want := "invalidations invalidate k\ninvalidations invalidate n\ninvalidations invalidate n\ninvalidations invalidate k\ninvalidations flush"
+	waitFor(t, "the invalidations to be published", func() bool { return published() == want })
+
+	f.mu.Lock()
+	f.published = nil
+	f.mu.Unlock()
+	withConfig(t, func(cfg *Config) { cfg.FlushPrefix = "app:" })
+	c.send(t, "flush_all\r\n")
+	c.readLine(t)
+	waitFor(t, "the scoped flush to be published", func() bool { return published() == "invalidations flush app:" })
+}
+
+// A set buffered by write-behind is published once it is in Redis.
+func TestInvalidationAfterWriteBehind(t *testing.T) {
+	srv, f := startTestServer(t)
+	useWriteBehind(t, time.Hour, 100)
+	withConfig(t, func(cfg *Config) { cfg.InvalidationChannel = "invalidations" })
+	c := dialTestServer(t, srv)
+	c.send(t, "set w 0 0 1 noreply\r\nv\r\nversion\r\n")
+	c.readLine(t)
+	time.Sleep(20 * time.Millisecond) // for a message wrongly queued to be published
+	f.mu.Lock()
+	early := len(f.published)
+	f.mu.Unlock()
+	if early != 0 {
+		t.Fatal("buffered set published before it was written")
+	}
+
+	writeBehindFlush()
+	waitFor(t, "the written set to be published", func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return strings.Join(f.published, "\n") == "invalidations invalidate w" && f.data["w"] == "v"
+	})
+}
+
+// invalidate_tag and delete_matching publish the keys they delete, in
+// batches.
+func TestInvalidationOfDeletedKeys(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.InvalidationChannel = "invalidations"
+		cfg.TagDelimiter = ":"
+		cfg.DeleteMatching = true
+	})
+	published := func() []string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return append([]string(nil), f.published...)
+	}
+
+	for _, key := range []string{"user42:profile", "user42:cart"} {
+		if err := SetHandler(&protocol.McRequest{Command: "set", Key: key, Value: []byte("v")}, &protocol.McResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := InvalidateTagHandler(&protocol.McRequest{Command: "invalidate_tag", Args: []string{"user42"}}, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the tag's keys to be published", func() bool {
+		msgs := published()
+		return len(msgs) == 1 && (msgs[0] == "invalidations invalidate user42:profile user42:cart" || msgs[0] == "invalidations invalidate user42:cart user42:profile")
+	})
+
+	f.mu.Lock()
+	f.published = nil
+	for i := 0; i < invalidationBatch+50; i++ {
+		f.data[fmt.Sprintf("session:%d", i)] = "v"
+	}
+	f.mu.Unlock()
+	deleteMatching(t, "session:*")
+	waitFor(t, "the matched keys to be published", func() bool {
+		keys := 0
+		msgs := published()
+		for _, msg := range msgs {
+			keys += len(strings.Fields(strings.TrimPrefix(msg, "invalidations invalidate ")))
+		}
+		return keys == invalidationBatch+50 && len(msgs) >= 2
+	})
+	for _, msg := range published() {
+		if n := len(strings.Fields(msg)) - 2; n > invalidationBatch {
+			t.Errorf("message of %d keys, more than invalidationBatch", n)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package rcdaemon
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Item counts
+//
+// curr_items of stats is the DBSIZE of Redis, which Redis keeps in O(1),
+// read at most memoryInfoTTL old like bytes. It is exact, but counts every
+// key of the database: those redcached keeps itself under RESERVED_PREFIX
+// and, on a shared Redis, those of other applications. With FLUSH_PREFIX
+// it only counts the keys under the prefix, which Redis cannot count
+// without a SCAN of the whole keyspace: they are counted in the
+// background, at most every itemCountInterval, and stats answers the last
+// count, approximate since keys come and go during and after the SCAN, or 0
+// until the first is done. A failed DBSIZE or count leaves the last value,
+// so that dashboards charting curr_items see no gap. A counter maintained by
+// the writes would be no more exact, as it would miss the keys Redis
+// expires and evicts.
+
+// itemCountInterval is how long a count of the keys under FLUSH_PREFIX is
+// reused.
+var itemCountInterval = time.Minute
+
+var items struct {
+	sync.Mutex
+	at       time.Time // of the last DBSIZE, or the start of the last count
+	prefix   string    // of the last count, "" for DBSIZE
+	n        int64
+	counting bool
+}
+
+// currItems returns curr_items, the last value known.
+func currItems() int64 {
+	prefix := config().FlushPrefix
+	items.Lock()
+	defer items.Unlock()
+	if prefix != items.prefix {
+		items.prefix, items.at, items.n = prefix, time.Time{}, 0
+	}
+	if prefix == "" {
+		if time.Since(items.at) >= memoryInfoTTL {
+			items.at = time.Now()
+			if n, err := backend.DbSize().Result(); err == nil {
+				items.n = n
+			}
+		}
+		return items.n
+	}
+	if !items.counting && time.Since(items.at) >= itemCountInterval {
+		items.at, items.counting = time.Now(), true
+		go countItems(prefix)
+	}
+	return items.n
+}
+
+// countItems counts the keys under prefix with SCAN, for currItems.
+func countItems(prefix string) {
+	var n int64
+	err := scanKeys(globEscape(prefix)+"*", func(keys []string) error {
+		n += int64(len(keys))
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: counting the keys under %q: %v", prefix, err)
+	}
+	items.Lock()
+	defer items.Unlock()
+	items.counting = false
+	if err == nil && prefix == items.prefix {
+		items.n = n
+	}
+}
@@ -0,0 +1,80 @@
+package rcdaemon
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetItems forgets the item counts, before and after the test.
+func resetItems(t *testing.T) {
+	reset := func() {
+		items.Lock()
+		items.at, items.prefix, items.n = time.Time{}, "", 0
+		items.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestStatsItems(t *testing.T) {
+	srv, f := startTestServer(t)
+	resetItems(t)
+	c := dialTestServer(t, srv)
+	stats := func() string {
+		c.send(t, "stats\r\n")
+		return strings.Join(c.readUntil(t, "END"), "\n") + "\n"
+	}
+
+	c.send(t, "set a 0 0 1\r\nv\r\nset b 0 0 1\r\nv\r\nadd a 0 0 1\r\nv\r\nappend b 0 0 1\r\nw\r\n")
+	for _, want := range []string{"STORED", "STORED", "NOT_STORED", "STORED"} {
+		if line := c.readLine(t); line != want {
+			t.Fatalf("%q, want %q", line, want)
+		}
+	}
+	f.set("app:1", "v", 0)
+	if general := stats(); !strings.Contains(general, "STAT curr_items 3\n") || !strings.Contains(general, "STAT total_items 3\n") {
+		t.Errorf("stats\n%s", general)
+	}
+	// a failed DBSIZE, or a count not done yet, leaves a value to chart
+	f.mu.Lock()
+	f.fail["dbsize"], f.fail["scan"] = errors.New("LOADING"), errors.New("LOADING")
+	f.mu.Unlock()
+	items.Lock()
+	items.at = time.Time{}
+	items.Unlock()
+	if general := stats(); !strings.Contains(general, "STAT curr_items 3\n") {
+		t.Errorf("stats after DBSIZE failed\n%s", general)
+	}
+	withConfig(t, func(cfg *Config) { cfg.FlushPrefix = "app:" })
+	if general := stats(); !strings.Contains(general, "STAT curr_items 0\n") {
+		t.Errorf("stats before the keys under the prefix are counted\n%s", general)
+	}
+	waitFor(t, "the failed count to end", func() bool {
+		items.Lock()
+		defer items.Unlock()
+		return !items.counting
+	})
+	f.mu.Lock()
+	delete(f.fail, "dbsize")
+	delete(f.fail, "scan")
+	f.mu.Unlock()
+	items.Lock()
+	items.at = time.Time{}
+	items.Unlock()
+
+	waitFor(t, "the keys under the prefix to be counted", func() bool {
+		return strings.Contains(stats(), "STAT curr_items 1\n")
+	})
+	f.set("app:2", "v", 0)
+	if general := stats(); !strings.Contains(general, "STAT curr_items 1\n") {
+		t.Errorf("count not reused for itemCountInterval\n%s", general)
+	}
+
+	c.send(t, "stats reset\r\n")
+	c.readLine(t)
+	if general := stats(); !strings.Contains(general, "STAT total_items 0\n") {
+		t.Errorf("stats after reset\n%s", general)
+	}
+}
@@ -0,0 +1,37 @@
+package rcdaemon
+
+import (
+	"../protocol"
+)
+
+// Item size
+//
+// memcached stores no item larger than its item size, 1 MiB by default,
+// and neither does redcached, with ITEM_SIZE_MAX bytes of data: a set, add
+// or add_get of more is answered SERVER_ERROR object too large for cache,
+// and an append or prepend growing an item past it SERVER_ERROR out of
+// memory storing object, as in memcached, leaving the item as it was.
+
+const (
+	DefaultItemSizeMax = 1 << 20
+
+	// MaxItemSizeMax bounds ITEM_SIZE_MAX to the largest Redis string.
+	MaxItemSizeMax = 512 << 20
+)
+
+// itemSized are the commands whose data is an item of their own.
+var itemSized = map[string]bool{"set": true, "add": true, "add_get": true}
+
+// limitItemSize is the Middleware refusing the commands of itemSized with
+// more than ITEM_SIZE_MAX bytes of data. concat checks append and prepend
+// itself, as only Redis knows the size of the item they grow. It is
+// installed by NewServer inside the request counters, like guardMemory.
+func limitItemSize(next HandlerFn) HandlerFn {
+	return func(req *protocol.McRequest, res *protocol.McResponse) error {
+		if itemSized[req.Command] && len(req.Value) > config().ItemSizeMax {
+			res.Response = "SERVER_ERROR object too large for cache"
+			return nil
+		}
+		return next(req, res)
+	}
+}
@@ -0,0 +1,62 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"testing"
+)
+
+func TestItemSizeMax(t *testing.T) {
+	srv, f := startTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.ItemSizeMax = 4 })
+	c := dialTestServer(t, srv)
+
+	for _, cmd := range []string{"set k 0 0 5\r\nvalue\r\n", "add k 0 0 5\r\nvalue\r\n", "add_get k 0 0 5\r\nvalue\r\n"} {
+		c.send(t, cmd)
+		if line := c.readLine(t); line != "SERVER_ERROR object too large for cache" {
+			t.Errorf("%q answered %q", cmd, line)
+		}
+	}
+	f.mu.Lock()
+	_, ok := f.data["k"]
+	f.mu.Unlock()
+	if ok {
+		t.Error("item larger than ITEM_SIZE_MAX stored")
+	}
+	c.send(t, "set k 0 0 4\r\nvalu\r\n")
+	if line := c.readLine(t); line != "STORED" {
+		t.Errorf("set of ITEM_SIZE_MAX bytes answered %q", line)
+	}
+}
+
+func TestItemSizeMaxConcat(t *testing.T) {
+	for _, mode := range []string{CompoundOpsLua, CompoundOpsWatch} {
+		useFakeBackend(t)
+		withConfig(t, func(cfg *Config) {
+			cfg.CompoundOps = mode
+			cfg.ItemSizeMax = 4
+		})
+		run := func(fn HandlerFn, req *protocol.McRequest) string {
+			res := &protocol.McResponse{}
+			if err := fn(req, res); err != nil {
+				t.Fatalf("COMPOUND_OPS=%s %s: %v", mode, req.Command, err)
+			}
+			return res.Response
+		}
+
+		run(SetHandler, &protocol.McRequest{Command: "set", Key: "k", Flags: "7", Value: []byte("ab")})
+		if got := run(AppendHandler, &protocol.McRequest{Command: "append", Key: "k", Flags: "0", Value: []byte("cd")}); got != "STORED" {
+			t.Errorf("COMPOUND_OPS=%s append up to ITEM_SIZE_MAX: %q", mode, got)
+		}
+		for _, fn := range []HandlerFn{AppendHandler, PrependHandler} {
+			if got := run(fn, &protocol.McRequest{Command: "append", Key: "k", Flags: "0", Value: []byte("e")}); got != "SERVER_ERROR out of memory storing object" {
+				t.Errorf("COMPOUND_OPS=%s growing past ITEM_SIZE_MAX: %q", mode, got)
+			}
+		}
+		res := &protocol.McResponse{}
+		if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"k"}}, res); err != nil || len(res.Values) != 1 {
+			t.Fatalf("COMPOUND_OPS=%s get: %v, %v", mode, res.Values, err)
+		} else if v := res.Values[0]; v.Flags != "7" || string(v.Data) != "abcd" {
+			t.Errorf("COMPOUND_OPS=%s after refused appends: flags %s, %q, want 7 and abcd", mode, v.Flags, v.Data)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package rcdaemon
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// logFile is the log output when LOG_FILE names a file. Writes go straight
+// to the file, unbuffered, and ReopenLog swaps in a new descriptor, so the
+// file can be rotated by renaming it and sending SIGHUP.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+var logOutput *logFile
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// SetupLog directs the log to LOG_FILE: "stdout", "stderr" (the default)
+// or the path of a file to append to.
+func SetupLog(cfg *Config) error {
+	var w io.Writer
+	switch cfg.LogFile {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		f, err := openLogFile(cfg.LogFile)
+		if err != nil {
+			return err
+		}
+		logOutput = &logFile{path: cfg.LogFile, f: f}
+		w = logOutput
+	}
+	log.SetOutput(w)
+	return nil
+}
+
+// ReopenLog reopens the log file, after it has been rotated. It is a no-op
+// when logging to stdout or stderr.
+func ReopenLog() error {
+	l := logOutput
+	if l == nil {
+		return nil
+	}
+	f, err := openLogFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	return old.Close()
+}
+
+// debugf logs like log.Printf if LOG_LEVEL is debug. It is for what happens
+// in normal operation, such as clients disconnecting, which would flood the
+// log of a server with many short-lived connections.
+func debugf(format string, v ...interface{}) {
+	if config().LogLevel == LogLevelDebug {
+		log.Printf(format, v...)
+	}
+}
+
+// expectedDisconnect tells whether err is how a connection ends when its
+// client goes away: EOF, a reset or broken pipe, or the connection closed
+// by redcached itself, as on shutdown.
+func expectedDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,116 @@
+package rcdaemon
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestReopenLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redcached.log")
+	if err := SetupLog(&Config{LogFile: path}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		logOutput.f.Close()
+		logOutput = nil
+	})
+
+	log.Printf("before rotation")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReopenLog(); err != nil {
+		t.Fatal(err)
+	}
+	log.Printf("after rotation")
+
+	for name, want := range map[string]string{path + ".1": "before rotation", path: "after rotation"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 1 || !strings.HasSuffix(lines[0], want) {
+			t.Errorf("%s: %q, want one line %q", filepath.Base(name), b, want)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer the log and a test can share.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+func TestLogLevel(t *testing.T) {
+	srv, _ := startTestServer(t)
+	var logged lockedBuffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	disconnect := func(end string) {
+		c := dialTestServer(t, srv)
+		c.send(t, "version\r\n"+end)
+		c.readLine(t)
+		c.Close()
+		waitFor(t, "the client to disconnect", func() bool { return srv.clientCount() == 0 })
+	}
+
+	disconnect("")
+	disconnect("quit\r\n")
+	if out := logged.String(); strings.Contains(out, "disconnected") || strings.Contains(out, "quit") {
+		t.Errorf("expected disconnects logged at LOG_LEVEL info:\n%s", out)
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.LogLevel = LogLevelDebug })
+	disconnect("")
+	disconnect("quit\r\n")
+	out := logged.String()
+	for _, want := range []string{"closed the connection", "sent quit, connection closed", "disconnected after"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log at LOG_LEVEL debug without %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "WARN") {
+		t.Errorf("expected disconnects logged as warnings:\n%s", out)
+	}
+}
+
+func TestExpectedDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{io.EOF, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed}, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ETIMEDOUT)}, false},
+		{errors.New("bufio: buffer full"), false},
+	} {
+		if got := expectedDisconnect(tc.err); got != tc.want {
+			t.Errorf("expectedDisconnect(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"sync/atomic"
+)
+
+// Memory guard
+//
+// When Redis reaches maxmemory it evicts keys, or with the noeviction
+// policy fails every write, at once and for all clients. With
+// MEMORY_HIGH_WATER set, redcached refuses commands storing new data while
+// Redis uses more than that share of its limit, as memcached does when it
+// cannot allocate: the write is answered SERVER_ERROR out of memory storing
+// object, and reads and deletes, which free memory, still work. The memory
+// figures are those of stats, read from INFO at most memoryInfoTTL old; if
+// INFO fails, writes are let through.
+
+// memoryGuarded are the commands refused above MEMORY_HIGH_WATER.
+var memoryGuarded = map[string]bool{"set": true, "add": true, "add_get": true, "append": true, "prepend": true}
+
+// memoryRejects counts the writes refused above MEMORY_HIGH_WATER.
+var memoryRejects uint64
+
+// guardMemory is the Middleware refusing the commands of memoryGuarded
+// while Redis is above MEMORY_HIGH_WATER. It is installed by NewServer
+// inside the request counters, so refused writes are counted, as in
+// memcached.
+func guardMemory(next HandlerFn) HandlerFn {
+	return func(req *protocol.McRequest, res *protocol.McResponse) error {
+		if highWater := config().MemoryHighWater; highWater > 0 && memoryGuarded[req.Command] {
+			bytes, limit, err := redisMemory()
+			if err == nil && limit > 0 && float64(bytes) > highWater*float64(limit) {
+				atomic.AddUint64(&memoryRejects, 1)
+				res.Response = "SERVER_ERROR out of memory storing object"
+				return nil
+			}
+		}
+		return next(req, res)
+	}
+}
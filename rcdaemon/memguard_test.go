@@ -0,0 +1,58 @@
+package rcdaemon
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryHighWater(t *testing.T) {
+	srv, f := startTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.MemoryHighWater = 0.9 })
+	memoryInfo.at = time.Time{}
+	t.Cleanup(func() { memoryInfo.at = time.Time{} })
+	c := dialTestServer(t, srv)
+	f.set("kept", "v", 0)
+	before := atomic.LoadUint64(&memoryRejects)
+
+	f.info = "used_memory:95\r\nmaxmemory:100\r\n"
+	c.send(t, "set k 0 0 1\r\nv\r\nadd k 0 0 1\r\nv\r\nappend kept 0 0 1\r\nw\r\nadd_get g 0 0 1\r\nv\r\n")
+	for i := 0; i < 4; i++ {
+		if line := c.readLine(t); line != "SERVER_ERROR out of memory storing object" {
+			t.Errorf("write above the high water mark answered %q", line)
+		}
+	}
+	for _, key := range []string{"k", "g"} {
+		if _, ok := f.data[key]; ok {
+			t.Errorf("refused write of %s stored", key)
+		}
+	}
+	c.send(t, "get kept\r\n")
+	if lines := c.readUntil(t, "END"); len(lines) != 3 || lines[1] != "v" {
+		t.Errorf("get above the high water mark: %q", lines)
+	}
+	c.send(t, "delete kept\r\n")
+	if line := c.readLine(t); line != "DELETED" {
+		t.Errorf("delete above the high water mark answered %q", line)
+	}
+	c.send(t, "stats\r\n")
+	if stats := strings.Join(c.readUntil(t, "END"), "\n"); !strings.Contains(stats, fmt.Sprintf("STAT memory_rejected_writes %d\n", before+4)) {
+		t.Errorf("stats after 4 refused writes\n%s", stats)
+	}
+
+	// below the mark, or without memory figures, writes go through
+	for _, info := range []string{"used_memory:85\r\nmaxmemory:100\r\n", ""} {
+		memoryInfo.at = time.Time{}
+		f.info = info
+		if info == "" {
+			f.fail["info"] = io.ErrUnexpectedEOF
+		}
+		c.send(t, "set k 0 0 1\r\nv\r\n")
+		if line := c.readLine(t); line != "STORED" {
+			t.Errorf("set with INFO %q answered %q", info, line)
+		}
+	}
+}
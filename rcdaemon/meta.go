@@ -0,0 +1,122 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"gopkg.in/redis.v3"
+	"strconv"
+	"strings"
+)
+
+// metaSizeScript returns the length of the value at KEYS[1] and its first
+// ARGV[1] bytes, enough to hold the header described in encodeValue, or
+// nil if the key does not exist or is not a string. The rest of the value
+// is not transferred.
+var metaSizeScript = newScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return false
+end
+local n = redis.pcall('STRLEN', KEYS[1])
+if type(n) == 'table' then
+  return false
+end
+return {n, redis.call('GETRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1)}
+`)
+
+// `mg` handler, the meta get command
+//
+//	mg <key> <flag>*\r\n
+//
+// Supports the flags v (return the value), s (return its size), f (return
+// its flags), q (answer nothing on a miss) and O<token>, which the parser
+// takes as McRequest.Opaque for the client to echo in any answer but an
+// error. A hit is answered `VA <size> <flags>` and the value with v,
+// `HD <flags>` without; a miss `EN`. Without v only the length of the value
+// and its header are read from Redis, so its size can be checked before
+// fetching a large value, unless Redis refuses scripts.
+//
+// The key is read as by a get, see readKeys: GET_LATENCY_FLOOR,
+// READ_FAIL_MODE, GET_FLUSHING and GET_WRONGTYPE apply to mg too.
+func MetaGetHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	var value, size, flags, quiet bool
+	for _, flag := range req.Args {
+		switch flag {
+		case "v":
+			value = true
+		case "s":
+			size = true
+		case "f":
+			flags = true
+		case "q":
+			quiet = true
+		default:
+			res.Response = "CLIENT_ERROR invalid flag"
+			return nil
+		}
+	}
+
+	// Without v a getFn of its own reads the size, answering the value
+	// without its data.
+	n, sized := 0, false
+	get := mget
+	if !value && scripting() {
+		get = func(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error {
+			key := req.Keys[0]
+			hotKeys.record(key)
+			result, err := metaSizeScript.Run([]string{key}, []string{strconv.Itoa(valueHeaderLen1)}).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if pair, _ := result.([]interface{}); len(pair) == 2 {
+				length, _ := pair[0].(int64)
+				prefix, _ := pair[1].(string)
+				if itemFlags, rest, ok := decodeValue(prefix); ok {
+					n, sized = int(length)-(len(prefix)-len(rest)), true
+					res.Values = []protocol.McValue{{Key: key, Flags: strconv.FormatUint(uint64(itemFlags), 10)}}
+				}
+			}
+			res.Response = "END"
+			return nil
+		}
+	}
+	getRes := &protocol.McResponse{}
+	if err := readKeys(config(), &protocol.McRequest{Command: req.Command, Keys: []string{req.Key}}, getRes, get); err != nil {
+		return err
+	}
+	if getRes.Response != "END" {
+		res.Response = getRes.Response // GET_WRONGTYPE=error
+		return nil
+	}
+	if len(getRes.Values) == 0 {
+		if quiet {
+			req.Noreply = true
+		}
+		res.Response = "EN"
+		return nil
+	}
+	item := getRes.Values[0]
+	if !sized {
+		n = len(item.Data)
+	}
+
+	var b strings.Builder
+	if value {
+		b.WriteString("VA ")
+		b.WriteString(strconv.Itoa(n))
+	} else {
+		b.WriteString("HD")
+	}
+	if size {
+		b.WriteString(" s")
+		b.WriteString(strconv.Itoa(n))
+	}
+	if flags {
+		b.WriteString(" f")
+		b.WriteString(item.Flags)
+	}
+	if value {
+		b.WriteString("\r\n")
+		b.Write(item.Data)
+	}
+	res.Response = b.String()
+	return nil
+}
@@ -0,0 +1,104 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetaGetSize(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["plain"] = "hello"
+	f.data["flagged"] = string(encodeValue(7, []byte("0123456789")))
+	c := dialTestServer(t, srv)
+
+	for cmd, want := range map[string]string{
+		"mg plain s":     "HD s5",
+		"mg flagged s f": "HD s10 f7",
+		"mg missing s":   "EN",
+		"mg plain":       "HD",
+	} {
+		c.send(t, cmd+"\r\n")
+		if line := c.readLine(t); line != want {
+			t.Errorf("%s answered %q, want %q", cmd, line, want)
+		}
+	}
+	if f.evals == 0 {
+		t.Errorf("size read without the script")
+	}
+
+	c.send(t, "mg flagged v s f\r\n")
+	lines := []string{c.readLine(t), c.readLine(t)}
+	if want := []string{"VA 10 s10 f7", "0123456789"}; strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("mg with v %q, want %q", lines, want)
+	}
+
+	c.send(t, "mg missing s q\r\nmg plain x\r\n")
+	if line := c.readLine(t); line != "CLIENT_ERROR invalid flag" {
+		t.Errorf("quiet miss then invalid flag %q", line)
+	}
+}
+
+func TestMetaGetOpaque(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["k"] = "hello"
+	c := dialTestServer(t, srv)
+
+	c.send(t, "mg missing s O1\r\nmg k s O2\r\nmg k v O3\r\nmg k x O4\r\n")
+	for _, want := range []string{"EN O1", "HD s5 O2", "VA 5 O3", "hello", "CLIENT_ERROR invalid flag"} {
+		if line := c.readLine(t); line != want {
+			t.Errorf("answered %q, want %q", line, want)
+		}
+	}
+}
+
+func TestMetaGetReadsLikeGet(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["hit"] = "hello"
+	mg := func(key string, flags ...string) (string, error) {
+		res := &protocol.McResponse{}
+		err := MetaGetHandler(&protocol.McRequest{Command: "mg", Key: key, Args: flags}, res)
+		return res.Response, err
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.GetLatencyFloor = 20 * time.Millisecond })
+	for _, key := range []string{"hit", "miss"} {
+		for _, flags := range [][]string{{"s"}, {"v"}} {
+			start := time.Now()
+			if _, err := mg(key, flags...); err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(start); d < 20*time.Millisecond {
+				t.Errorf("mg %s %v answered after %v", key, flags, d)
+			}
+		}
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.GetLatencyFloor, cfg.FlushPrefix = 0, "app:" })
+	f.data["app:old"] = "old"
+	stop := flushWindow()
+	for _, flags := range [][]string{{"s"}, {"v"}} {
+		if got, err := mg("app:old", flags...); err != nil || got != "EN" {
+			t.Errorf("mg app:old %v while flushing: %q, %v, want EN", flags, got, err)
+		}
+	}
+	stop()
+
+	f.fail["mget"] = io.ErrUnexpectedEOF
+	f.fail["eval"] = io.ErrUnexpectedEOF
+	for _, flags := range [][]string{{"s"}, {"v"}} {
+		if _, err := mg("hit", flags...); err != io.ErrUnexpectedEOF {
+			t.Errorf("closed mg %v error %v", flags, err)
+		}
+	}
+	for _, mode := range []string{ReadFailOpen, ReadFailPartial} {
+		withConfig(t, func(cfg *Config) { cfg.ReadFailMode = mode })
+		for _, flags := range [][]string{{"s"}, {"v"}} {
+			if got, err := mg("hit", flags...); err != nil || got != "EN" {
+				t.Errorf("READ_FAIL_MODE=%s: mg %v %q, %v, want EN", mode, flags, got, err)
+			}
+		}
+	}
+}
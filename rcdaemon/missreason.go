@@ -0,0 +1,152 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Miss reasons
+//
+// With MISS_REASONS set, every key a get misses is logged with why, as far
+// as it can be told, for chasing down unexpected misses. Redis forgets a
+// key entirely once it expires, so stores also write a tombstone, see
+// missTombstoneKey, recording when the item was stored and when it was to
+// expire, and deletes one recording the delete. A miss then costs a script
+// reading the type of each missed key and its tombstone.
+
+// missReasonWindow is how long a tombstone outlives its item.
+const missReasonWindow = time.Hour
+
+// lastFlush is when flush_all was last sent to this process, in Unix
+// milliseconds, 0 for never. Only accessed atomically.
+var lastFlush int64
+
+// missReasonScript returns, for each key in KEYS, its Redis type and its
+// tombstone, or nil. ARGV[1] is the RESERVED_PREFIX of the tombstones.
+var missReasonScript = newScript(`
+local out = {}
+for i, key in ipairs(KEYS) do
+  out[i] = {redis.call('TYPE', key).ok, redis.call('GET', ARGV[1] .. 'miss:' .. key)}
+end
+return out
+`)
+
+// missTombstoneKey names the key holding the tombstone of key.
+func missTombstoneKey(key string) string {
+	return config().ReservedPrefix + "miss:" + key
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// recordStore writes the tombstone of key after it has been stored with
+// exp: `set <stored> <expires>` in Unix milliseconds, 0 for never. It is a
+// no-op unless MISS_REASONS is set.
+func recordStore(key string, exp ttl) error {
+	cfg := config()
+	if !cfg.MissReasons || exp.past || !scripting() {
+		return nil
+	}
+	// how long the item stays in Redis, 0 for ever: its hardTTL, whose cap
+	// the write of the item counted already
+	life := maxTTL(graceTTL(exp))
+	now := time.Now()
+	var expires int64
+	var keep time.Duration
+	if life > 0 {
+		expires, keep = unixMillis(now.Add(life)), life+missReasonWindow
+	}
+	return backend.Set(missTombstoneKey(key), fmt.Sprintf("set %d %d", unixMillis(now), expires), keep).Err()
+}
+
+// recordDelete writes the tombstone of key after it has been deleted:
+// `delete <deleted>`. It is a no-op unless MISS_REASONS is set.
+func recordDelete(key string) error {
+	if !config().MissReasons || !scripting() {
+		return nil
+	}
+	return backend.Set(missTombstoneKey(key), fmt.Sprintf("delete %d", unixMillis(time.Now())), missReasonWindow).Err()
+}
+
+// recordFlush notes that flush_all was sent, for the misses it causes.
+func recordFlush() {
+	atomic.StoreInt64(&lastFlush, unixMillis(time.Now()))
+}
+
+// logMissReasons logs why each of keys missing from values was missed.
+func logMissReasons(keys []string, values []protocol.McValue) {
+	hit := make(map[string]bool, len(values))
+	for _, v := range values {
+		hit[v.Key] = true
+	}
+	var missed []string
+	for _, key := range keys {
+		if !hit[key] {
+			hit[key] = true // once per key
+			missed = append(missed, key)
+		}
+	}
+	if len(missed) == 0 {
+		return
+	}
+
+	result, err := missReasonScript.Run(missed, []string{config().ReservedPrefix}).Result()
+	if err != nil {
+		log.Printf("get miss of %v, reason unknown: %v", missed, err)
+		return
+	}
+	entries, _ := result.([]interface{})
+	now := unixMillis(time.Now())
+	for i, entry := range entries {
+		pair, _ := entry.([]interface{})
+		if i >= len(missed) || len(pair) != 2 {
+			continue
+		}
+		typ, _ := pair[0].(string)
+		tombstone, _ := pair[1].(string)
+		log.Printf("get miss of %s: %s", missed[i], missReason(typ, tombstone, now, atomic.LoadInt64(&lastFlush)))
+	}
+}
+
+// missReason explains the miss of a key of Redis type typ, with the
+// tombstone, given the time now and of the last flush_all.
+func missReason(typ, tombstone string, now, flushed int64) string {
+	switch typ {
+	case "none":
+	case "string":
+		return "present now, stored since or not readable by this version"
+	default:
+		return "holds a Redis " + typ
+	}
+
+	fields := strings.Fields(tombstone)
+	switch {
+	case len(fields) == 2 && fields[0] == "delete":
+		at, _ := strconv.ParseInt(fields[1], 10, 64)
+		return "deleted at " + fromMillis(at)
+	case len(fields) != 3 || fields[0] != "set":
+		if flushed > 0 {
+			return "never stored, or flushed at " + fromMillis(flushed)
+		}
+		return "never stored, or not since MISS_REASONS"
+	}
+	stored, _ := strconv.ParseInt(fields[1], 10, 64)
+	expires, _ := strconv.ParseInt(fields[2], 10, 64)
+	switch {
+	case stored < flushed:
+		return "flushed at " + fromMillis(flushed)
+	case expires > 0 && expires <= now:
+		return "expired at " + fromMillis(expires)
+	}
+	return "evicted by Redis, or deleted other than through redcached, before expiring"
+}
@@ -0,0 +1,113 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMissReason(t *testing.T) {
+	const now, flushed = 2000000, 1000000
+	tests := []struct {
+		typ, tombstone string
+		flushed        int64
+		want           string
+	}{
+		{"string", "", 0, "present now"},
+		{"hash", "", 0, "holds a Redis hash"},
+		{"none", "", 0, "never stored, or not since MISS_REASONS"},
+		{"none", "", flushed, "never stored, or flushed at "},
+		{"none", "delete 1500000", flushed, "deleted at "},
+		{"none", "set 500000 0", flushed, "flushed at "},
+		{"none", "set 1500000 1900000", flushed, "expired at "},
+		{"none", "set 1500000 0", flushed, "evicted"},
+		{"none", "set 1500000 2100000", 0, "evicted"},
+	}
+	for _, tc := range tests {
+		if got := missReason(tc.typ, tc.tombstone, now, tc.flushed); !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%s %q flushed at %d: %q, want %q...", tc.typ, tc.tombstone, tc.flushed, got, tc.want)
+		}
+	}
+}
+
+func TestMissReasonsLogged(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.MissReasons = true })
+	prevFlush := atomic.SwapInt64(&lastFlush, 0) // not flushed by earlier tests
+	defer atomic.StoreInt64(&lastFlush, prevFlush)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	SetHandler(&protocol.McRequest{Command: "set", Key: "deleted", Flags: "0", Value: []byte("v")}, &protocol.McResponse{})
+	DeleteHandler(&protocol.McRequest{Command: "delete", Key: "deleted"}, &protocol.McResponse{})
+	SetHandler(&protocol.McRequest{Command: "set", Key: "expired", Flags: "0", Exptime: 60, Value: []byte("v")}, &protocol.McResponse{})
+	SetHandler(&protocol.McRequest{Command: "set", Key: "evicted", Flags: "0", Value: []byte("v")}, &protocol.McResponse{})
+	SetHandler(&protocol.McRequest{Command: "set", Key: "hit", Flags: "0", Value: []byte("v")}, &protocol.McResponse{})
+	delete(f.data, "expired")
+	f.data[missTombstoneKey("expired")] = "set 1 2" // stored at the epoch, expired just after
+	delete(f.data, "evicted")
+	f.others["list"] = "list"
+
+	res := &protocol.McResponse{}
+	if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"hit", "deleted", "expired", "evicted", "list", "never", "never"}}, res); err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(os.Stderr)
+	out := logged.String()
+	for _, want := range []string{
+		"get miss of deleted: deleted at ",
+		"get miss of expired: expired at 1970-01-01T00:00:00.002Z",
+		"get miss of evicted: evicted",
+		"get miss of list: holds a Redis list",
+		"get miss of never: never stored",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log without %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "miss of hit") || strings.Count(out, "miss of never") != 1 {
+		t.Errorf("log of hits or repeated misses:\n%s", out)
+	}
+	if ttl := f.ttls[missTombstoneKey("hit")]; ttl != 0 {
+		t.Errorf("tombstone of an item without TTL expires in %v", ttl)
+	}
+	if ttl := f.ttls[missTombstoneKey("deleted")]; ttl != missReasonWindow {
+		t.Errorf("tombstone of a delete expires in %v, want %v", ttl, missReasonWindow)
+	}
+}
+
+func TestMissReasonsOff(t *testing.T) {
+	f := useFakeBackend(t)
+	SetHandler(&protocol.McRequest{Command: "set", Key: "k", Flags: "0", Exptime: 60, Value: []byte("v")}, &protocol.McResponse{})
+	if _, ok := f.data[missTombstoneKey("k")]; ok {
+		t.Errorf("tombstone written without MISS_REASONS")
+	}
+	if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"missing"}}, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if f.evals != 0 {
+		t.Errorf("%d scripts for a miss without MISS_REASONS", f.evals)
+	}
+}
+
+// Tombstones expire with the items, after STALE_GRACE and MAX_TTL.
+func TestMissReasonsTombstoneTTL(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.MissReasons = true
+		cfg.MaxTTL = time.Minute
+		cfg.StaleGrace = 30 * time.Second
+	})
+	for key, exptime := range map[string]int64{"short": 10, "graced": 45, "forever": 0} {
+		SetHandler(&protocol.McRequest{Command: "set", Key: key, Flags: "0", Exptime: exptime, Value: []byte("v")}, &protocol.McResponse{})
+		if got, want := f.ttls[missTombstoneKey(key)], f.ttls[key]+missReasonWindow; got != want {
+			t.Errorf("tombstone of %s kept %v, want %v", key, got, want)
+		}
+	}
+}
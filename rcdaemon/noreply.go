@@ -0,0 +1,38 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"log"
+	"strings"
+)
+
+// Noreply audit
+//
+// A request sent with noreply gets no response, so its client never learns
+// that it failed: a set Redis refused is silently lost. With NOREPLY_AUDIT
+// set, every noreply request that fails, with a Redis error or an error
+// response, is logged with its key, as an audit trail of lost writes. What
+// is sent to the client is unchanged.
+
+// auditNoreply is the Middleware logging the noreply requests that fail,
+// when NOREPLY_AUDIT is set. It is installed by NewServer outside the
+// others, so that requests they refuse are logged too.
+func auditNoreply(next HandlerFn) HandlerFn {
+	return func(req *protocol.McRequest, res *protocol.McResponse) error {
+		err := next(req, res)
+		if !req.Noreply || !config().NoreplyAudit {
+			return err
+		}
+		if err != nil {
+			logLostWrite(req.Command, req.Key, err.Error())
+		} else if strings.HasPrefix(res.Response, "SERVER_ERROR") || strings.HasPrefix(res.Response, "CLIENT_ERROR") {
+			logLostWrite(req.Command, req.Key, res.Response)
+		}
+		return err
+	}
+}
+
+// logLostWrite logs that the noreply cmd of key failed with reason.
+func logLostWrite(cmd, key, reason string) {
+	log.Printf("NOREPLY AUDIT: %s %s failed unanswered: %s", cmd, key, reason)
+}
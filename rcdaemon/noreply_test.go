@@ -0,0 +1,44 @@
+package rcdaemon
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNoreplyAudit(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.fail["set"] = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+	withConfig(t, func(cfg *Config) { cfg.RejectReservedKeys = true })
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	c := dialTestServer(t, srv)
+
+	send := func() {
+		c.send(t, "set lost 0 0 1 noreply\r\nv\r\nset __swr:k 0 0 1 noreply\r\nv\r\nversion\r\n")
+		if line := c.readLine(t); !strings.HasPrefix(line, "VERSION") {
+			t.Fatalf("noreply requests answered %q", line)
+		}
+	}
+	send()
+	if strings.Contains(logged.String(), "NOREPLY AUDIT") {
+		t.Errorf("audited without NOREPLY_AUDIT:\n%s", logged.String())
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.NoreplyAudit = true })
+	send()
+	log.SetOutput(os.Stderr)
+	out := logged.String()
+	for _, want := range []string{
+		"NOREPLY AUDIT: set lost failed unanswered: OOM command not allowed",
+		"NOREPLY AUDIT: set __swr:k failed unanswered: CLIENT_ERROR key __swr:k is reserved",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log without %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"log"
+	"sync"
+)
+
+// Partial gets
+//
+// A get is read from Redis in one MGET, or one script with STALE_GRACE,
+// which fails as a whole: with READ_FAIL_MODE=open every key of a large
+// multi-get misses when Redis fails to answer it. READ_FAIL_MODE=partial
+// reads the keys of a get in batches of partialGetBatch instead, all at
+// once, and only the keys of the batches that fail miss, after the error is
+// logged; the values of the others are answered. When every batch fails
+// the get is a miss, as with open.
+
+// partialGetBatch is how many keys of a get are read at once with
+// READ_FAIL_MODE=partial.
+const partialGetBatch = 100
+
+// partial returns the getFn reading the keys of a get in batches with get,
+// concurrently, answering the keys of the batches that fail as misses. The
+// batches are merged in key order, as if read one after the other.
+func partial(get getFn) getFn {
+	return func(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error {
+		if len(req.Keys) <= partialGetBatch {
+			return get(cfg, req, res)
+		}
+		var batches []protocol.McRequest
+		for start := 0; start < len(req.Keys); start += partialGetBatch {
+			end := start + partialGetBatch
+			if end > len(req.Keys) {
+				end = len(req.Keys)
+			}
+			batch := *req
+			batch.Keys = req.Keys[start:end]
+			batches = append(batches, batch)
+		}
+		results := make([]protocol.McResponse, len(batches))
+		errs := make([]error, len(batches))
+		var wg sync.WaitGroup
+		for i := range batches {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = get(cfg, &batches[i], &results[i])
+			}(i)
+		}
+		wg.Wait()
+
+		var firstErr error
+		failed := 0
+		for i := range results {
+			if err := errs[i]; err != nil {
+				log.Printf("ERROR: %v, get answered as a miss, Keys: %v", err, batches[i].Keys)
+				if firstErr == nil {
+					firstErr = err
+				}
+				failed++
+				continue
+			}
+			if results[i].Response != "END" {
+				*res = results[i] // such as a CLIENT_ERROR for the whole get
+				return nil
+			}
+			res.Values = append(res.Values, results[i].Values...)
+		}
+		if failed == len(batches) {
+			return firstErr
+		}
+		res.Response = "END"
+		return nil
+	}
+}
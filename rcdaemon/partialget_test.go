@@ -0,0 +1,82 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadFailModePartial(t *testing.T) {
+	f := useFakeBackend(t)
+	var keys []string
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		f.data[key] = "v"
+		keys = append(keys, key)
+	}
+	f.failKeys["k150"] = io.ErrUnexpectedEOF
+	withConfig(t, func(cfg *Config) { cfg.ReadFailMode = ReadFailPartial })
+
+	for _, grace := range []time.Duration{0, time.Minute} {
+		withConfig(t, func(cfg *Config) { cfg.StaleGrace = grace })
+		res := &protocol.McResponse{}
+		if err := GetHandler(&protocol.McRequest{Command: "get", Keys: keys}, res); err != nil || res.Response != "END" {
+			t.Fatalf("STALE_GRACE=%v: %v, %v", grace, res.Response, err)
+		}
+		// the keys of the batch of k150, k100 to k199, miss
+		if len(res.Values) != 150 || res.Values[99].Key != "k099" || res.Values[100].Key != "k200" {
+			t.Errorf("STALE_GRACE=%v: %d values, want those of the 2 batches read", grace, len(res.Values))
+		}
+
+		f.fail["mget"], f.fail["eval"] = io.ErrUnexpectedEOF, io.ErrUnexpectedEOF
+		res = &protocol.McResponse{}
+		if err := GetHandler(&protocol.McRequest{Command: "get", Keys: keys}, res); err != nil || res.Response != "END" || len(res.Values) != 0 {
+			t.Errorf("STALE_GRACE=%v: every batch failing: %+v, %v, want a miss", grace, res, err)
+		}
+		delete(f.fail, "mget")
+		delete(f.fail, "eval")
+	}
+}
+
+// The batches are read at once, and merged in key order.
+func TestPartialBatchesConcurrent(t *testing.T) {
+	var keys []string
+	for i := 0; i < 250; i++ {
+		keys = append(keys, fmt.Sprintf("k%03d", i))
+	}
+	var started sync.WaitGroup
+	started.Add(3)
+	all := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(all)
+	}()
+	get := partial(func(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error {
+		started.Done()
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("batch of %s read alone", req.Keys[0])
+		}
+		for _, key := range req.Keys {
+			res.Values = append(res.Values, protocol.McValue{Key: key})
+		}
+		res.Response = "END"
+		return nil
+	})
+	res := &protocol.McResponse{}
+	if err := get(config(), &protocol.McRequest{Command: "get", Keys: keys}, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Values) != len(keys) {
+		t.Fatalf("%d values, want %d", len(res.Values), len(keys))
+	}
+	for i, v := range res.Values {
+		if v.Key != keys[i] {
+			t.Fatalf("value %d is %s, want %s", i, v.Key, keys[i])
+		}
+	}
+}
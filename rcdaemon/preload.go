@@ -0,0 +1,46 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Preload replays the `set` commands in the file at path through
+// SetHandler, so a freshly started instance does not serve a cold cache.
+// The file uses the memcached text protocol, one entry per command:
+//
+//	set <key> <flags> <exptime> <bytes>\r\n
+//	<data block>\r\n
+//
+// It returns the number of entries stored.
+func Preload(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	n := 0
+	for {
+		req, err := protocol.ReadRequest(br)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("%s: entry %d: %v", path, n+1, err)
+		}
+		if req.Command != "set" {
+			return n, fmt.Errorf("%s: entry %d: only set is supported, got %q", path, n+1, req.Command)
+		}
+
+		res := &protocol.McResponse{}
+		foldKeys(req)
+		if err := SetHandler(req, res); err != nil {
+			return n, fmt.Errorf("%s: entry %d: %v", path, n+1, err)
+		}
+		n++
+	}
+}
@@ -0,0 +1,55 @@
+package rcdaemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePreloadFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "preload.txt")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPreload(t *testing.T) {
+	f := useFakeBackend(t)
+	path := writePreloadFile(t, "set a 0 0 3\r\nfoo\r\nset b 0 60 5\r\nhello\r\n")
+
+	n, err := Preload(path)
+	if err != nil {
+		t.Fatalf("Preload: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Preload stored %d entries, want 2", n)
+	}
+	if f.data["a"] != "foo" || f.data["b"] != "hello" {
+		t.Errorf("data %v", f.data)
+	}
+	if f.ttls["b"] != time.Minute {
+		t.Errorf("ttl of b %v, want 1m", f.ttls["b"])
+	}
+}
+
+func TestPreloadRejectsOtherCommands(t *testing.T) {
+	useFakeBackend(t)
+	path := writePreloadFile(t, "set a 0 0 3\r\nfoo\r\ndelete a\r\n")
+
+	n, err := Preload(path)
+	if err == nil {
+		t.Fatalf("Preload accepted a delete")
+	}
+	if n != 1 {
+		t.Errorf("Preload stored %d entries before failing, want 1", n)
+	}
+}
+
+func TestPreloadMissingFile(t *testing.T) {
+	if _, err := Preload(filepath.Join(os.TempDir(), "does-not-exist")); err == nil {
+		t.Fatalf("Preload of a missing file succeeded")
+	}
+}
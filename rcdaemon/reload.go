@@ -0,0 +1,139 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Settings changed with `reconfigure`, applied on top of the environment.
+var overrides = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// Reload rebuilds the configuration from the environment and the
+// `reconfigure` overrides and applies it to new and existing connections.
+// Settings only read at startup keep their value; the names of those that
+// changed are returned, as they need a restart to take effect.
+func Reload() ([]string, error) {
+	overrides.Lock()
+	defer overrides.Unlock()
+	cfg, _, err := loadWithOverrides(overrides.m)
+	if err != nil {
+		return nil, err
+	}
+	return apply(cfg), nil
+}
+
+// apply swaps in cfg, keeping the settings only read at startup, checks
+// for Lua scripting again, and returns the names of the settings that
+// differ.
+func apply(cfg *Config) []string {
+	old := config()
+	var restart []string
+	keep := func(name string, changed bool) {
+		if changed {
+			restart = append(restart, name)
+		}
+	}
+	keep("REDIS_ADDR", cfg.RedisAddr != old.RedisAddr)
+	keep("REDIS_POOL_SIZE", cfg.RedisPoolSize != old.RedisPoolSize)
+	keep("REDIS_IDLE_TIMEOUT", cfg.RedisIdleTimeout != old.RedisIdleTimeout)
+	keep("REDIS_MAX_RETRIES", cfg.RedisMaxRetries != old.RedisMaxRetries)
+	keep("REDIS_WARMUP", cfg.RedisWarmup != old.RedisWarmup)
+	keep("LISTEN", strings.Join(cfg.Listen, ",") != strings.Join(old.Listen, ","))
+	keep("TLS_CERT_FILE", cfg.TLSCertFile != old.TLSCertFile)
+	keep("TLS_KEY_FILE", cfg.TLSKeyFile != old.TLSKeyFile)
+	keep("REUSEPORT", cfg.ReusePort != old.ReusePort)
+	keep("ACCEPT_LOOPS", cfg.AcceptLoops != old.AcceptLoops)
+	keep("PRELOAD_FILE", cfg.PreloadFile != old.PreloadFile)
+	keep("MAX_LINE_LENGTH", cfg.MaxLineLength != old.MaxLineLength)
+	keep("ADMIN_COMMANDS", cfg.AdminCommands != old.AdminCommands)
+	keep("ADMIN_SOCKET", cfg.AdminSocket != old.AdminSocket)
+	keep("DEBUG_ADDR", cfg.DebugAddr != old.DebugAddr)
+	keep("LOG_FILE", cfg.LogFile != old.LogFile)
+	keep("RESERVED_PREFIX", cfg.ReservedPrefix != old.ReservedPrefix)
+	keep("SHUTDOWN_GRACE", cfg.ShutdownGrace != old.ShutdownGrace)
+	keep("CHAOS_MODE", cfg.ChaosMode != old.ChaosMode)
+	cfg.RedisAddr = old.RedisAddr
+	cfg.RedisPoolSize = old.RedisPoolSize
+	cfg.RedisIdleTimeout = old.RedisIdleTimeout
+	cfg.RedisMaxRetries = old.RedisMaxRetries
+	cfg.RedisWarmup = old.RedisWarmup
+	cfg.Listen = old.Listen
+	cfg.TLSCertFile = old.TLSCertFile
+	cfg.TLSKeyFile = old.TLSKeyFile
+	cfg.ReusePort = old.ReusePort
+	cfg.AcceptLoops = old.AcceptLoops
+	cfg.PreloadFile = old.PreloadFile
+	cfg.MaxLineLength = old.MaxLineLength
+	cfg.AdminCommands = old.AdminCommands
+	cfg.AdminSocket = old.AdminSocket
+	cfg.DebugAddr = old.DebugAddr
+	cfg.LogFile = old.LogFile
+	cfg.ReservedPrefix = old.ReservedPrefix
+	cfg.ShutdownGrace = old.ShutdownGrace
+	cfg.ChaosMode = old.ChaosMode
+
+	current.Store(cfg)
+
+	// a probe at startup may have failed, or Redis changed since
+	if _, err := CheckScripting(); err != nil {
+		log.Printf("Checking Lua scripting failed, keeping what was found: %v", err)
+	}
+	return restart
+}
+
+// `reconfigure` handler
+//
+//	reconfigure <NAME>=<value>...
+//
+// Overrides settings, named like their environment variables, and reloads
+// the configuration. An empty value drops the override. Settings that can
+// only change with a restart are listed in the response.
+func ReconfigureHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	overrides.Lock()
+	defer overrides.Unlock()
+
+	m := make(map[string]string, len(overrides.m))
+	for name, s := range overrides.m {
+		m[name] = s
+	}
+	for _, arg := range req.Args {
+		i := strings.IndexByte(arg, '=')
+		if i <= 0 {
+			res.Response = "CLIENT_ERROR bad command line format.  Usage: reconfigure <NAME>=<value>..."
+			return nil
+		}
+		if name, s := arg[:i], arg[i+1:]; s == "" {
+			delete(m, name)
+		} else {
+			m[name] = s
+		}
+	}
+
+	cfg, known, err := loadWithOverrides(m)
+	if err != nil {
+		res.Response = "CLIENT_ERROR " + err.Error()
+		return nil
+	}
+	for name := range m {
+		if !known[name] {
+			res.Response = "CLIENT_ERROR unknown setting " + name
+			return nil
+		}
+	}
+
+	overrides.m = m
+	restart := apply(cfg)
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		res.Response = "OK restart required for " + strings.Join(restart, ",")
+		return nil
+	}
+	res.Response = "OK"
+	return nil
+}
@@ -0,0 +1,92 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useEnvConfig loads the configuration from a minimal environment and
+// clears the reconfigure overrides for the duration of the test. Reloads
+// check for Lua scripting on a fake backend.
+func useEnvConfig(t *testing.T) {
+	useFakeBackend(t)
+	t.Setenv("REDIS_ADDR", "redis:6379")
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := config()
+	current.Store(cfg)
+	overrides.m = make(map[string]string)
+	t.Cleanup(func() {
+		current.Store(prev)
+		overrides.m = make(map[string]string)
+	})
+}
+
+func reconfigure(t *testing.T, args ...string) string {
+	res := &protocol.McResponse{}
+	if err := ReconfigureHandler(&protocol.McRequest{Command: "reconfigure", Args: args}, res); err != nil {
+		t.Fatalf("ReconfigureHandler: %v", err)
+	}
+	return res.Response
+}
+
+func TestReconfigureLiveSettings(t *testing.T) {
+	useEnvConfig(t)
+
+	if res := reconfigure(t, "PIPELINE_LIMIT=8", "TTL_MAX=1h"); res != "OK" {
+		t.Fatalf("reconfigure: %q", res)
+	}
+	if cfg := config(); cfg.PipelineLimit != 8 || cfg.TTLMax != time.Hour {
+		t.Errorf("config after reconfigure %+v", cfg)
+	}
+
+	// overrides survive a reload
+	if _, err := Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if cfg := config(); cfg.PipelineLimit != 8 {
+		t.Errorf("PipelineLimit after reload %d, want 8", cfg.PipelineLimit)
+	}
+
+	// an empty value falls back to the environment
+	if res := reconfigure(t, "PIPELINE_LIMIT="); res != "OK" {
+		t.Fatalf("reconfigure: %q", res)
+	}
+	if cfg := config(); cfg.PipelineLimit != 0 || cfg.TTLMax != time.Hour {
+		t.Errorf("config after dropping override %+v", cfg)
+	}
+}
+
+func TestReconfigureRestartSettings(t *testing.T) {
+	useEnvConfig(t)
+
+	res := reconfigure(t, "REUSEPORT=true", "REDIS_ADDR=other:6379", "TTL_MIN=1s")
+	if res != "OK restart required for REDIS_ADDR,REUSEPORT" {
+		t.Errorf("reconfigure: %q", res)
+	}
+	cfg := config()
+	if cfg.ReusePort || cfg.RedisAddr != "redis:6379" {
+		t.Errorf("startup settings changed live: %+v", cfg)
+	}
+	if cfg.TTLMin != time.Second {
+		t.Errorf("TTLMin %v, want 1s", cfg.TTLMin)
+	}
+}
+
+func TestReconfigureRejectsBadInput(t *testing.T) {
+	useEnvConfig(t)
+	before := config()
+
+	for _, args := range [][]string{{"TTL_MAX=soon"}, {"NO_SUCH_SETTING=1"}, {"=1"}, {"PIPELINE_LIMIT"}, {"TTL_MIN=2h", "TTL_MAX=1h"}} {
+		if res := reconfigure(t, args...); !strings.HasPrefix(res, "CLIENT_ERROR ") {
+			t.Errorf("reconfigure %q: %q", args, res)
+		}
+	}
+	if config() != before || len(overrides.m) != 0 {
+		t.Errorf("rejected reconfigure changed the configuration")
+	}
+}
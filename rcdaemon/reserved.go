@@ -0,0 +1,44 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strings"
+)
+
+// Reserved keys
+//
+// redcached keeps keys of its own next to the items, such as the soft
+// deadlines of stale-while-revalidate and the sets of tags, all named
+// with RESERVED_PREFIX. A client storing a key that happens to be named
+// like one of them would corrupt it. With REJECT_RESERVED_KEYS client keys
+// with the prefix are refused, so nothing but redcached itself writes in
+// that namespace.
+
+// rejectReservedKeys is the Middleware answering CLIENT_ERROR for requests
+// on a key with RESERVED_PREFIX, when REJECT_RESERVED_KEYS is set. It is
+// installed by NewServer, outside the request counters, so rejected
+// requests are not counted.
+func rejectReservedKeys(next HandlerFn) HandlerFn {
+	return func(req *protocol.McRequest, res *protocol.McResponse) error {
+		if cfg := config(); cfg.RejectReservedKeys {
+			if key, ok := reservedKey(req, cfg.ReservedPrefix); ok {
+				res.Response = "CLIENT_ERROR key " + key + " is reserved"
+				return nil
+			}
+		}
+		return next(req, res)
+	}
+}
+
+// reservedKey returns the first key of req starting with prefix.
+func reservedKey(req *protocol.McRequest, prefix string) (string, bool) {
+	if strings.HasPrefix(req.Key, prefix) {
+		return req.Key, true
+	}
+	for _, key := range req.Keys {
+		if strings.HasPrefix(key, prefix) {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,62 @@
+package rcdaemon
+
+import (
+	"testing"
+)
+
+func TestReservedKeysRejected(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.RejectReservedKeys = true })
+	srv, f := startTestServer(t)
+	f.data["ok"] = "v"
+	c := dialTestServer(t, srv)
+
+	meta, tag := staleMetaKey("k"), tagSetKey("user")
+	for _, tc := range []struct{ cmd, key string }{
+		{"set " + meta + " 0 0 1\r\nx\r\n", meta},
+		{"add " + tag + " 0 0 1\r\nx\r\n", tag},
+		{"add_get __x 0 0 1\r\nx\r\n", "__x"},
+		{"delete " + meta + "\r\n", meta},
+		{"incr " + meta + " 1\r\n", meta},
+		{"get ok " + meta + "\r\n", meta},
+		{"mg " + meta + " v\r\n", meta},
+	} {
+		c.send(t, tc.cmd)
+		if line, want := c.readLine(t), "CLIENT_ERROR key "+tc.key+" is reserved"; line != want {
+			t.Errorf("%q answered %q, want %q", tc.cmd, line, want)
+		}
+	}
+	c.send(t, "set "+meta+" 0 0 1 noreply\r\nx\r\nget ok\r\n")
+	if lines := c.readUntil(t, "END"); len(lines) != 3 {
+		t.Errorf("get after a rejected noreply set %q", lines)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key := range f.data {
+		if key != "ok" {
+			t.Errorf("client wrote %q", key)
+		}
+	}
+	if len(f.sets) != 0 {
+		t.Errorf("client wrote sets %v", f.sets)
+	}
+}
+
+func TestReservedPrefix(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.ReservedPrefix = "rc:"
+		cfg.RejectReservedKeys = true
+	})
+	if staleMetaKey("k") != "rc:swr:k" || tagSetKey("t") != "rc:tag:t" {
+		t.Errorf("internal keys %q, %q", staleMetaKey("k"), tagSetKey("t"))
+	}
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+	c.send(t, "set __k 0 0 1\r\nx\r\nset rc:k 0 0 1\r\nx\r\n")
+	if line := c.readLine(t); line != "STORED" {
+		t.Errorf("key with the default prefix %q", line)
+	}
+	if line := c.readLine(t); line != "CLIENT_ERROR key rc:k is reserved" {
+		t.Errorf("key with the configured prefix %q", line)
+	}
+}
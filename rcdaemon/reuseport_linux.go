@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package rcdaemon
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// reusePortControl sets SO_REUSEPORT on the listening socket so several
+// listeners (in this or other processes) can bind the same address and
+// let the kernel balance incoming connections between them.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package rcdaemon
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is only supported on linux")
+}
@@ -0,0 +1,100 @@
+package rcdaemon
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"gopkg.in/redis.v3"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// script is a Lua script shared by the handlers. It is sent by hash with
+// EVALSHA; only when Redis doesn't know the hash yet (or has flushed its
+// script cache) is the body sent with EVAL, which caches it again.
+type script struct {
+	src  string
+	hash string
+}
+
+func newScript(src string) *script {
+	h := sha1.Sum([]byte(src))
+	return &script{src: src, hash: hex.EncodeToString(h[:])}
+}
+
+// Run evaluates the script on the backend.
+func (s *script) Run(keys []string, args []string) *redis.Cmd {
+	return s.RunOn(backend, keys, args)
+}
+
+// RunOn evaluates the script on b.
+func (s *script) RunOn(b Backend, keys []string, args []string) *redis.Cmd {
+	cmd := b.EvalSha(s.hash, keys, args)
+	if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return b.Eval(s.src, keys, args)
+	}
+	return cmd
+}
+
+// scriptingOff is set once CheckScripting found that the backend refuses
+// scripts. Only accessed atomically.
+var scriptingOff int32
+
+// scripting reports whether the backend runs Lua scripts, as far as
+// CheckScripting found.
+func scripting() bool {
+	return atomic.LoadInt32(&scriptingOff) == 0
+}
+
+// probeScript is the trivial script run by CheckScripting.
+var probeScript = newScript("return 1")
+
+// CheckScripting runs a trivial script on the backend, to find out whether
+// it refuses EVAL, as some managed Redis offerings do. If it does, what
+// needs scripts degrades rather than failing every request, as logged:
+// incr/decr, append/prepend and add_get run as WATCH transactions whatever
+// COMPOUND_OPS says, mg without v reads the whole value, ttl and
+// invalidate_tag answer ERROR, and stale-while-revalidate, write-behind and
+// MISS_REASONS are off.
+// Only a refusal, see refusesScripts, turns scripts off. Any other error,
+// such as LOADING, BUSY or a network error, tells nothing: it is returned,
+// and what was found before is kept, scripts assumed to work at startup.
+// It runs at startup and again on reload, logging what changed.
+func CheckScripting() (bool, error) {
+	err := probeScript.Run(nil, nil).Err()
+	if err != nil && !refusesScripts(err) {
+		return scripting(), err
+	}
+	if err == nil {
+		if atomic.SwapInt32(&scriptingOff, 0) == 1 {
+			log.Printf("Redis runs Lua scripts again")
+		}
+		return true, nil
+	}
+	if atomic.SwapInt32(&scriptingOff, 1) == 1 {
+		return false, nil // logged already
+	}
+
+	cfg := config()
+	degraded := []string{"incr, decr, append, prepend and add_get run as WATCH transactions", "mg without v reads whole values", "ttl and invalidate_tag answer ERROR"}
+	if cfg.StaleGrace > 0 {
+		degraded = append(degraded, "STALE_GRACE serves stale items unflagged")
+	}
+	if cfg.WriteBehindInterval > 0 {
+		degraded = append(degraded, "WRITE_BEHIND_INTERVAL is ignored")
+	}
+	if cfg.MissReasons {
+		degraded = append(degraded, "MISS_REASONS is ignored")
+	}
+	log.Printf("Redis refuses Lua scripts (%v): %s", err, strings.Join(degraded, ", "))
+	return false, nil
+}
+
+// refusesScripts reports whether err, answered to a script, is Redis
+// refusing scripts for good rather than failing for the while: EVAL
+// unknown or renamed away, denied by an ACL, or disabled.
+func refusesScripts(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "unknown command") || strings.HasPrefix(msg, "NOPERM") ||
+		strings.HasPrefix(msg, "ERR") && strings.Contains(msg, "disabled")
+}
@@ -0,0 +1,144 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScriptFallsBackToEval(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["k"] = "v"
+	run := func() {
+		res, err := staleGetScript.Run([]string{"k"}, []string{"0"}).Result()
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		if entries, _ := res.([]interface{}); len(entries) != 1 {
+			t.Fatalf("Run result %v", res)
+		}
+	}
+
+	run()
+	if f.evals != 1 {
+		t.Fatalf("first run sent the body %d times, want 1", f.evals)
+	}
+	run()
+	if f.evals != 1 {
+		t.Errorf("cached script sent again, evals %d", f.evals)
+	}
+
+	f.flushScripts()
+	run()
+	if f.evals != 2 {
+		t.Errorf("after SCRIPT FLUSH evals %d, want 2", f.evals)
+	}
+	run()
+	if f.evals != 2 {
+		t.Errorf("reloaded script sent again, evals %d", f.evals)
+	}
+}
+
+// useScriptsRefused makes the fake refuse scripts, as found by CheckScripting.
+func useScriptsRefused(t *testing.T, f *fakeBackend) {
+	f.fail["eval"] = errors.New("ERR unknown command 'EVALSHA'")
+	t.Cleanup(func() { atomic.StoreInt32(&scriptingOff, 0) })
+	if ok, err := CheckScripting(); ok || err != nil {
+		t.Fatalf("CheckScripting with EVAL refused: %v, %v", ok, err)
+	}
+}
+
+func TestCheckScripting(t *testing.T) {
+	f := useFakeBackend(t)
+	if ok, err := CheckScripting(); !ok || err != nil || !scripting() {
+		t.Fatalf("CheckScripting: %v, %v", ok, err)
+	}
+
+	f.fail["eval"] = io.ErrUnexpectedEOF
+	if ok, err := CheckScripting(); !ok || err == nil || !scripting() {
+		t.Errorf("CheckScripting on a network error: %v, %v, want scripts assumed to work", ok, err)
+	}
+
+	for _, msg := range []string{
+		"LOADING Redis is loading the dataset in memory",
+		"BUSY Redis is busy running a script",
+		"NOAUTH Authentication required.",
+		"READONLY You can't write against a read only replica.",
+		"MASTERDOWN Link with MASTER is down",
+	} {
+		f.fail["eval"] = errors.New(msg)
+		if ok, err := CheckScripting(); !ok || err == nil || !scripting() {
+			t.Errorf("CheckScripting on %q: %v, %v, want scripts assumed to work", msg, ok, err)
+		}
+	}
+
+	useScriptsRefused(t, f)
+	if scripting() {
+		t.Errorf("scripts assumed to work after EVAL was refused")
+	}
+	f.fail["eval"] = errors.New("LOADING Redis is loading the dataset in memory")
+	if ok, err := CheckScripting(); ok || err == nil || scripting() {
+		t.Errorf("CheckScripting on LOADING after a refusal: %v, %v, want scripts still off", ok, err)
+	}
+	for _, msg := range []string{"NOPERM this user has no permissions to run the 'evalsha' command", "ERR scripting is disabled"} {
+		atomic.StoreInt32(&scriptingOff, 0)
+		f.fail["eval"] = errors.New(msg)
+		if ok, err := CheckScripting(); ok || err != nil || scripting() {
+			t.Errorf("CheckScripting on %q: %v, %v, want scripts refused", msg, ok, err)
+		}
+	}
+}
+
+func TestScriptingCheckedOnReload(t *testing.T) {
+	useEnvConfig(t)
+	f := useFakeBackend(t)
+	useScriptsRefused(t, f)
+	delete(f.fail, "eval")
+	if _, err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !scripting() {
+		t.Error("scripts still off after reload, though Redis runs them now")
+	}
+}
+
+func TestScriptsRefusedDegrade(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.StaleGrace = time.Minute
+		cfg.WriteBehindInterval = time.Hour
+	})
+	useScriptsRefused(t, f)
+	f.data["n"] = "41"
+	f.data["big"] = "hello"
+
+	res := &protocol.McResponse{}
+	if err := IncrHandler(&protocol.McRequest{Command: "incr", Key: "n", Increment: 1}, res); err != nil || res.Response != "42" {
+		t.Errorf("incr: %q, %v", res.Response, err)
+	}
+	res = &protocol.McResponse{}
+	if err := MetaGetHandler(&protocol.McRequest{Command: "mg", Key: "big", Args: []string{"s"}}, res); err != nil || res.Response != "HD s5" {
+		t.Errorf("mg s: %q, %v", res.Response, err)
+	}
+	res = &protocol.McResponse{}
+	if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"big"}}, res); err != nil || len(res.Values) != 1 {
+		t.Errorf("get with STALE_GRACE: %+v, %v", res, err)
+	}
+	if err := SetHandler(bufferedSetReq("w", "0", 0, "v"), &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if f.data["w"] != "v" {
+		t.Errorf("noreply set buffered without scripts to write it")
+	}
+	res = &protocol.McResponse{}
+	if err := TTLHandler(&protocol.McRequest{Command: "ttl", Keys: []string{"n"}}, res); err != nil || res.Response != "ERROR" {
+		t.Errorf("ttl: %q, %v", res.Response, err)
+	}
+	res = &protocol.McResponse{}
+	if err := InvalidateTagHandler(&protocol.McRequest{Command: "invalidate_tag", Args: []string{"t"}}, res); err != nil || res.Response != "ERROR" {
+		t.Errorf("invalidate_tag: %q, %v", res.Response, err)
+	}
+}
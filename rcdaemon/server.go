@@ -1,9 +1,16 @@
 package rcdaemon
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,14 +20,39 @@ const (
 
 type Server struct {
 	Addr         string // TCP address to listen on, ":11212" if empty
+	ReusePort    bool   // set SO_REUSEPORT on the listener (linux only)
+	AcceptLoops  int    // goroutines accepting on each listener, 1 if 0
+	Admin        bool   // serves operators, as on ADMIN_SOCKET, untouched by chaos mode
 	methods      map[string]HandlerFn
+	middleware   []Middleware // wrapped around handlers as they are registered
 	MonitorChans []chan string
 
-	StartTime        time.Time
-	CurrConnections  int
-	TotalConnections int
+	StartTime           time.Time
+	CurrConnections     int // guarded by mu
+	TotalConnections    int // guarded by mu
+	RejectedConnections int // refused by ALLOW_CIDRS or DENY_CIDRS, guarded by mu
+
+	stats counters // requests served, see StatsHandler
+
+	mu        sync.Mutex
+	clients   map[*Client]struct{}      // connected clients, guarded by mu
+	lastID    uint64                    // last Client.ID handed out, guarded by mu
+	listeners map[net.Listener]struct{} // accepting, guarded by mu
+	closing   bool                      // Shutdown was called, guarded by mu
 }
 
+// ErrServerClosed is returned by Serve and the ListenAndServe methods
+// after Shutdown.
+var ErrServerClosed = errors.New("rcdaemon: Server closed")
+
+// ErrNoListener is returned by ServeAll and ListenAndServeAll when given
+// nothing to listen on.
+var ErrNoListener = errors.New("rcdaemon: no listener to serve")
+
+// shutdownPollInterval is how often Shutdown checks whether the clients
+// are all gone.
+const shutdownPollInterval = 10 * time.Millisecond
+
 func NewServer(addr string, methods map[string]HandlerFn) (*Server, error) {
 	if addr == "" {
 		addr = fmt.Sprintf("0.0.0.0:%d", DEFAULT_PORT)
@@ -37,30 +69,175 @@ func NewServer(addr string, methods map[string]HandlerFn) (*Server, error) {
 		StartTime:        time.Now(),
 		CurrConnections:  0,
 		TotalConnections: 0,
+
+		clients:   make(map[*Client]struct{}),
+		listeners: make(map[net.Listener]struct{}),
 	}
+	srv.middleware = []Middleware{auditNoreply, warnCompat, rejectReservedKeys, srv.countRequests, srv.injectChaos, guardMemory, limitItemSize, publishInvalidations}
 
 	return srv, nil
 }
 
 func (srv *Server) ListenAndServe() error {
-	l, err := net.Listen("tcp", srv.Addr)
+	return srv.ListenAndServeAll([]string{srv.Addr}, nil)
+}
+
+// ListenAndServeAll listens on each of addrs, host:port for plain TCP or
+// tls://host:port for TLS with tlsConfig, and serves them all with the
+// same handlers, see ServeAll. If one of them cannot be bound, none is
+// served.
+func (srv *Server) ListenAndServeAll(addrs []string, tlsConfig *tls.Config) error {
+	lc := net.ListenConfig{}
+	if srv.ReusePort {
+		lc.Control = reusePortControl
+	}
+	var ls []net.Listener
+	for _, spec := range addrs {
+		addr, useTLS := splitListenAddr(spec)
+		var l net.Listener
+		var err error
+		if useTLS && tlsConfig == nil {
+			err = fmt.Errorf("%s: no TLS certificate configured", spec)
+		} else {
+			l, err = lc.Listen(context.Background(), "tcp", addr)
+		}
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return err
+		}
+		if useTLS {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		log.Printf("Start and Listening at %s", spec)
+		ls = append(ls, l)
+	}
+	return srv.ServeAll(ls...)
+}
+
+// splitListenAddr returns the address of a listen spec and whether it is
+// to be served over TLS.
+func splitListenAddr(spec string) (addr string, useTLS bool) {
+	if strings.HasPrefix(spec, "tls://") {
+		return strings.TrimPrefix(spec, "tls://"), true
+	}
+	return spec, false
+}
+
+// ListenAndServeUnix serves on a Unix socket at srv.Addr, replacing one
+// left there by an earlier run. Only the owner and group of the process
+// may connect.
+func (srv *Server) ListenAndServeUnix() error {
+	if fi, err := os.Lstat(srv.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(srv.Addr)
+	}
+	l, err := net.Listen("unix", srv.Addr)
 	if err != nil {
 		return err
 	}
+	if err := os.Chmod(srv.Addr, 0660); err != nil {
+		l.Close()
+		return err
+	}
 	log.Printf("Start and Listening at %s", srv.Addr)
-	return srv.Serve(l)
+	return srv.serve(l)
 }
 
+// Serve accepts connections on l until it fails, then closes the backend.
+// After Shutdown it returns ErrServerClosed once the clients are gone and
+// the sets write-behind still buffers are written, so that the backend is
+// only closed when no request needs it any more.
 func (srv *Server) Serve(l net.Listener) error {
+	return srv.ServeAll(l)
+}
+
+// ServeAll is Serve for several listeners, each with its own accept loop.
+// When one of them fails the others are closed too, and its error is
+// returned once they all stopped. Shutdown drains them all. Without
+// listeners it returns ErrNoListener at once.
+func (srv *Server) ServeAll(ls ...net.Listener) error {
+	defer closeBackend(backend, unretried)
+	if len(ls) == 0 {
+		return ErrNoListener
+	}
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) { errs <- srv.serve(l) }(l)
+	}
+	err := <-errs
+	if err != ErrServerClosed {
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+	for range ls[1:] {
+		<-errs
+	}
+	if err == ErrServerClosed {
+		for srv.clientCount() > 0 {
+			time.Sleep(shutdownPollInterval)
+		}
+		stopWriteBehind() // no client is left to buffer more
+	}
+	return err
+}
+
+// serve accepts connections on l with AcceptLoops goroutines until one of
+// them fails or Shutdown closes it, and returns once they all stopped.
+func (srv *Server) serve(l net.Listener) error {
 	defer l.Close()
-	srv.MonitorChans = []chan string{}
-	defer backend.Close()
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+	}()
 
+	loops := srv.acceptLoops()
+	errs := make(chan error, loops)
+	for i := 0; i < loops; i++ {
+		go func() { errs <- srv.accept(l) }()
+	}
+	err := <-errs
+	l.Close() // stops the other loops
+	for i := 1; i < loops; i++ {
+		<-errs
+	}
+	return err
+}
+
+func (srv *Server) acceptLoops() int {
+	if srv.AcceptLoops < 1 {
+		return 1
+	}
+	return srv.AcceptLoops
+}
+
+// accept is an accept loop of serve.
+func (srv *Server) accept(l net.Listener) error {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
+		if reason := refused(config(), conn.RemoteAddr()); reason != "" {
+			log.Printf("Connection from %s refused, %s", conn.RemoteAddr(), reason)
+			conn.Close()
+			srv.mu.Lock()
+			srv.RejectedConnections++
+			srv.mu.Unlock()
+			continue
+		}
 		client, err := NewClient(conn, srv)
 		if err != nil {
 			log.Printf("New Client ERROR:: %v", err)
@@ -72,8 +249,111 @@ func (srv *Server) Serve(l net.Listener) error {
 	return nil
 }
 
+// Middleware wraps a handler with behaviour common to commands, such as
+// metrics, auth checks, tracing or rate limiting.
+type Middleware func(next HandlerFn) HandlerFn
+
+// Use adds middleware around the handlers registered from now on. The
+// first middleware added is the outermost; the noreply audit, the
+// compatibility warnings, the check for reserved keys, the request counters
+// of stats, chaos mode, the memory guard and the invalidation channel,
+// installed by NewServer, come first.
+func (srv *Server) Use(mw ...Middleware) {
+	srv.middleware = append(srv.middleware, mw...)
+}
+
+// RegisterFunc registers fn for the command name, wrapped in the
+// middleware added so far.
 func (srv *Server) RegisterFunc(name string, fn HandlerFn) error {
 	log.Printf("REGISTER func: %s", name)
+	for i := len(srv.middleware) - 1; i >= 0; i-- {
+		fn = srv.middleware[i](fn)
+	}
 	srv.methods[name] = fn
 	return nil
 }
+
+// Shutdown stops accepting connections and lets the clients finish: each
+// connection is closed once the request it is serving, and any already
+// pipelined behind it, are answered. A request still being received is
+// dropped. If ctx is done first, the remaining connections are closed and
+// its error returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for client := range srv.clients {
+		client.Conn.SetReadDeadline(time.Now()) // wakes it up if idle
+	}
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for srv.clientCount() > 0 {
+		select {
+		case <-ctx.Done():
+			for _, client := range srv.connectedClients() {
+				client.Conn.Close()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// shuttingDown reports whether Shutdown was called.
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+// clientCount returns the number of connected clients.
+func (srv *Server) clientCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.clients)
+}
+
+// addClient registers a connected client and assigns its ID.
+func (srv *Server) addClient(client *Client) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		// accepted as Shutdown began, it is not waited for any longer
+		client.Conn.SetReadDeadline(time.Now())
+	}
+	srv.lastID++
+	client.ID = srv.lastID
+	srv.clients[client] = struct{}{}
+	srv.CurrConnections++
+	srv.TotalConnections++
+	debugVars.Add("curr_connections", 1)
+	debugVars.Add("total_connections", 1)
+}
+
+// removeClient unregisters a client once its connection is done.
+func (srv *Server) removeClient(client *Client) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.clients[client]; ok {
+		delete(srv.clients, client)
+		srv.CurrConnections--
+		debugVars.Add("curr_connections", -1)
+	}
+}
+
+// connectedClients returns the connected clients ordered by ID.
+func (srv *Server) connectedClients() []*Client {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	clients := make([]*Client, 0, len(srv.clients))
+	for client := range srv.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
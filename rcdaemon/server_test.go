@@ -1,9 +1,1101 @@
 package rcdaemon
 
 import (
+	"../protocol"
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestServer(t *testing.T) {
 	t.Skip("Not implemented")
 }
+
+// startTestServer serves srv on a loopback listener for the duration of
+// the test, with handlers backed by a fakeBackend.
+func startTestServer(t testing.TB) (*Server, *fakeBackend) {
+	f := useFakeBackend(t)
+	return serveTestServer(t), f
+}
+
+// serveTestServer is startTestServer on the backend already in use.
+func serveTestServer(t testing.TB) *Server {
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.RegisterFunc("get", GetHandler)
+	srv.RegisterFunc("gets", GetHandler)
+	srv.RegisterFunc("set", SetHandler)
+	srv.RegisterFunc("add", AddHandler)
+	srv.RegisterFunc("add_get", AddGetHandler)
+	srv.RegisterFunc("append", AppendHandler)
+	srv.RegisterFunc("prepend", PrependHandler)
+	srv.RegisterFunc("mg", MetaGetHandler)
+	srv.RegisterFunc("delete", DeleteHandler)
+	srv.RegisterFunc("incr", IncrHandler)
+	srv.RegisterFunc("decr", DecrHandler)
+	srv.RegisterFunc("flush_all", FlushAllHandler)
+	srv.RegisterFunc("version", VersionHandler)
+	srv.RegisterFunc("noop", NoopHandler)
+	srv.RegisterFunc("ping", NoopHandler)
+	srv.RegisterFunc("stats", srv.StatsHandler)
+	srv.RegisterFunc("time", srv.TimeHandler)
+
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Addr = l.Addr().String()
+	go srv.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	// Serve reads the backend as it starts, before the test may swap it back
+	waitFor(t, "the server to listen", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.listeners) > 0
+	})
+	return srv
+}
+
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialTestServer(t testing.TB, srv *Server) *testConn {
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testConn{conn, bufio.NewReader(conn)}
+}
+
+func (c *testConn) send(t testing.TB, cmd string) {
+	if _, err := c.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLine reads one response line without its terminator.
+func (c *testConn) readLine(t testing.TB) string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading response: %v (got %q)", err, line)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// readUntil reads response lines up to and including last.
+func (c *testConn) readUntil(t testing.TB, last string) []string {
+	var lines []string
+	for {
+		line := c.readLine(t)
+		lines = append(lines, line)
+		if line == last {
+			return lines
+		}
+	}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func contains(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
+
+func statsConns(t *testing.T, c *testConn) []string {
+	c.send(t, "stats conns\r\n")
+	lines := c.readUntil(t, "END")
+	return lines[:len(lines)-1]
+}
+
+func TestStatsConns(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c1 := dialTestServer(t, srv)
+	c2 := dialTestServer(t, srv)
+	c2.send(t, "version\r\n")
+	c2.readLine(t)
+
+	lines := statsConns(t, c1)
+	var addrs []string
+	id2 := ""
+	for _, line := range lines {
+		if strings.Contains(line, ":addr tcp:127.0.0.1:") {
+			addrs = append(addrs, line)
+		}
+		// IDs follow the order the clients registered in, not dialed in
+		if strings.HasSuffix(line, ":addr tcp:"+c2.LocalAddr().String()) {
+			id2 = strings.TrimPrefix(strings.Split(line, ":")[0], "STAT ")
+		}
+	}
+	if len(addrs) != 2 || id2 == "" {
+		t.Fatalf("stats conns %q, want 2 connections", lines)
+	}
+	for _, want := range []string{id2 + ":last_cmd version", id2 + ":cmds 1", id2 + ":age 0", id2 + ":secs_since_last_cmd 0"} {
+		if !contains(lines, "STAT "+want) {
+			t.Errorf("stats conns %q, missing %q", lines, want)
+		}
+	}
+
+	c2.Close()
+	waitFor(t, "client to unregister", func() bool { return len(srv.connectedClients()) == 1 })
+	lines = statsConns(t, c1)
+	if strings.Count(strings.Join(lines, "\n"), ":addr ") != 1 {
+		t.Errorf("stats conns after disconnect %q, want 1 connection", lines)
+	}
+
+	c1.send(t, "stats\r\n")
+	general := strings.Join(c1.readUntil(t, "END"), "\n")
+	if !strings.Contains(general, "STAT curr_connections 1\n") || !strings.Contains(general, "STAT total_connections 2\n") {
+		t.Errorf("stats\n%s", general)
+	}
+	for _, want := range []string{"STAT pool_total_conns 1\n", "STAT pool_idle_conns 1\n", "STAT pool_timeouts 0\n"} {
+		if !strings.Contains(general, want) {
+			t.Errorf("stats missing %q\n%s", want, general)
+		}
+	}
+}
+
+func TestPipelinedNoreplySets(t *testing.T) {
+	srv, f := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	var b strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&b, "set k%d 0 0 1 noreply\r\n%d\r\n", i, i%10)
+	}
+	b.WriteString("get k9999\r\n")
+	c.send(t, b.String())
+
+	lines := c.readUntil(t, "END")
+	if len(lines) != 3 || lines[0] != "VALUE k9999 0 1" || lines[1] != "9" {
+		t.Errorf("get after pipelined sets %q", lines)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.data) != 10000 {
+		t.Errorf("stored %d keys, want 10000", len(f.data))
+	}
+}
+
+func TestPipelineLimit(t *testing.T) {
+	for _, limit := range []int{0, 1, 7, 1000} {
+		withConfig(t, func(cfg *Config) { cfg.PipelineLimit = limit })
+		srv, f := startTestServer(t)
+		f.data["k"] = "v"
+		c := dialTestServer(t, srv)
+
+		c.send(t, strings.Repeat("get k\r\n", 100))
+		for i := 0; i < 100; i++ {
+			if lines := c.readUntil(t, "END"); len(lines) != 3 {
+				t.Fatalf("limit %d: response %d %q", limit, i, lines)
+			}
+		}
+
+		// A lone request must not wait for more pipelined ones.
+		c.send(t, "get k\r\n")
+		if lines := c.readUntil(t, "END"); len(lines) != 3 {
+			t.Fatalf("limit %d: lone response %q", limit, lines)
+		}
+	}
+}
+
+// writeCounter counts the writes to a connection.
+type writeCounter struct {
+	net.Conn
+	writes int32
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestPipelinedResponsesBatched(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["k"] = "v"
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.RegisterFunc("get", GetHandler)
+	server, conn := net.Pipe()
+	counter := &writeCounter{Conn: server}
+	client, err := NewClient(counter, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testConn{conn, bufio.NewReader(conn)}
+
+	// 100 responses of 20 bytes fit in the write buffer
+	c.send(t, strings.Repeat("get k\r\n", 100))
+	for i := 0; i < 100; i++ {
+		if lines := c.readUntil(t, "END"); len(lines) != 3 {
+			t.Fatalf("response %d %q", i, lines)
+		}
+	}
+	if n := atomic.LoadInt32(&counter.writes); n != 1 {
+		t.Errorf("%d writes for 100 pipelined responses, want 1", n)
+	}
+}
+
+// A request whose data block is still on its way is not a reason to hold
+// back the responses before it: the client may wait for them.
+func TestPartialRequestFlushes(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["k"] = "v"
+	c := dialTestServer(t, srv)
+
+	c.send(t, "get k\r\nset k 0 0 5\r\nhel")
+	if lines := c.readUntil(t, "END"); len(lines) != 3 {
+		t.Fatalf("get before a partial set %q", lines)
+	}
+	c.send(t, "lo\r\n")
+	if line := c.readLine(t); line != "STORED" {
+		t.Errorf("set completed later %q", line)
+	}
+}
+
+func TestFlushAllNoreply(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["k"] = "v"
+	c := dialTestServer(t, srv)
+
+	c.send(t, "flush_all noreply\r\nversion\r\n")
+	if line := c.readLine(t); line != "VERSION "+Version {
+		t.Errorf("first response after flush_all noreply %q", line)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.data) != 0 {
+		t.Errorf("flush_all noreply left %v", f.data)
+	}
+}
+
+func TestVersionWithExtraTokens(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	c.send(t, "version foo\r\n")
+	if line := c.readLine(t); line != "VERSION "+Version {
+		t.Errorf("version foo: %q", line)
+	}
+}
+
+func TestWrongArgumentCount(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	for _, cmd := range []string{"incr k\r\n", "incr k 1 2 3\r\n", "decr\r\n"} {
+		c.send(t, cmd)
+		if line := c.readLine(t); line != "CLIENT_ERROR bad command line format" {
+			t.Errorf("%q: %q", cmd, line)
+		}
+	}
+	// the connection is still usable
+	c.send(t, "version\r\n")
+	if line := c.readLine(t); line != "VERSION "+Version {
+		t.Errorf("version: %q", line)
+	}
+}
+
+func TestProtocolErrorResponses(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	tests := []struct{ in, want string }{
+		{"\r\n", "ERROR"},
+		{"set k 0 0 2\r\nabc\r\n", "CLIENT_ERROR bad data chunk"},
+		{"incr k x\r\n", "CLIENT_ERROR invalid numeric delta argument"},
+	}
+	for _, tc := range tests {
+		c.send(t, tc.in+"version\r\n")
+		if line := c.readLine(t); line != tc.want {
+			t.Errorf("%q: %q, want %q", tc.in, line, tc.want)
+		}
+		// a bad data chunk may leave the rest of the block unread
+		for line := c.readLine(t); line != "VERSION "+Version; line = c.readLine(t) {
+		}
+	}
+}
+
+func TestNoreplyProtocolError(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	c.send(t, "set k 0 x 5 noreply\r\nhello\r\nversion\r\n")
+	if line := c.readLine(t); line != "VERSION "+Version {
+		t.Errorf("reply after bad noreply set: %q", line)
+	}
+}
+
+// BenchmarkServeGet measures a get round trip through Client.Serve,
+// including parsing and serializing.
+func BenchmarkServeGet(b *testing.B) {
+	srv, f := startTestServer(b)
+	f.data["key"] = strings.Repeat("x", 100)
+	c := dialTestServer(b, srv)
+	c.SetDeadline(time.Time{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.send(b, "get key\r\n")
+		c.readUntil(b, "END")
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+
+	// unknown to the parser, and parsed but not served
+	for _, cmd := range []string{"bogus\r\n", "cas k 0 0 1 1\r\nx\r\n"} {
+		c.send(t, cmd)
+		if line := c.readLine(t); line != "ERROR" {
+			t.Errorf("%q: %q", cmd, line)
+		}
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.VerboseErrors = true })
+	c.send(t, "bogus\r\n")
+	if line := c.readLine(t); line != `ERROR unknown command "bogus"` {
+		t.Errorf("verbose: %q", line)
+	}
+}
+
+// memcached answers get without keys with ERROR, and carries on.
+func TestGetWithoutKeysAnswered(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["k"] = "v"
+	c := dialTestServer(t, srv)
+
+	c.send(t, "get\r\ngets \r\nget k\r\n")
+	for _, want := range []string{"ERROR", "ERROR", "VALUE k 0 1", "v", "END"} {
+		if line := c.readLine(t); line != want {
+			t.Errorf("%q, want %q", line, want)
+		}
+	}
+}
+
+// An empty value is a hit with no data, unlike a missing key, which is left
+// out; both read back from Redis as nothing in naive code.
+func TestGetEmptyValue(t *testing.T) {
+	for _, mode := range []struct {
+		name string
+		use  func(t *testing.T)
+	}{
+		{"plain", func(t *testing.T) {}},
+		{"STALE_GRACE", func(t *testing.T) { withConfig(t, func(cfg *Config) { cfg.StaleGrace = 10 * time.Second }) }},
+		{"COALESCE_GETS", func(t *testing.T) { withConfig(t, func(cfg *Config) { cfg.CoalesceGets = true }) }},
+		{"WRITE_BEHIND_INTERVAL", func(t *testing.T) { useWriteBehind(t, time.Minute, DefaultWriteBehindMax) }},
+	} {
+		srv, _ := startTestServer(t)
+		mode.use(t)
+		c := dialTestServer(t, srv)
+
+		c.send(t, "set empty 0 0 0 noreply\r\n\r\nset flagged 7 0 0 noreply\r\n\r\n")
+		c.send(t, "get missing empty flagged missing\r\nmg empty v f\r\nmg empty s\r\nmg missing v\r\n")
+		for _, want := range []string{"VALUE empty 0 0", "", "VALUE flagged 7 0", "", "END", "VA 0 f0", "", "HD s0", "EN"} {
+			if line := c.readLine(t); line != want {
+				t.Errorf("%s: %q, want %q", mode.name, line, want)
+			}
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+	near := func(what, s string, want int64) {
+		if n, err := strconv.ParseInt(s, 10, 64); err != nil || n < want-2 || n > want+2 {
+			t.Errorf("%s %q, want about %d", what, s, want)
+		}
+	}
+
+	c.send(t, "time\r\n")
+	fields := strings.Fields(c.readLine(t))
+	if len(fields) != 3 || fields[0] != "TIME" {
+		t.Fatalf("time answered %q", fields)
+	}
+	near("time", fields[1], time.Now().Unix())
+	near("uptime", fields[2], 0)
+
+	c.send(t, "stats\r\n")
+	stats := make(map[string]string)
+	for _, line := range c.readUntil(t, "END") {
+		if f := strings.Fields(line); len(f) == 3 {
+			stats[f[1]] = f[2]
+		}
+	}
+	near("stats time", stats["time"], time.Now().Unix())
+	near("stats uptime", stats["uptime"], 0)
+}
+
+func TestNoop(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+	before := srv.stats.snapshot()
+
+	for _, cmd := range []string{"noop\r\n", "ping\r\n"} {
+		c.send(t, cmd)
+		if line := c.readLine(t); line != "OK" {
+			t.Errorf("%q: %q", cmd, line)
+		}
+	}
+	if srv.stats.snapshot() != before {
+		t.Errorf("noop changed the stats")
+	}
+}
+
+// BenchmarkServeIncrNoreply measures incr noreply through Client.Serve,
+// where nothing is written back.
+func BenchmarkServeIncrNoreply(b *testing.B) {
+	srv, f := startTestServer(b)
+	f.data["n"] = "0"
+	c := dialTestServer(b, srv)
+	c.SetDeadline(time.Time{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.send(b, "incr n 1 noreply\r\n")
+		if i%100 == 99 {
+			c.send(b, "version\r\n")
+			c.readLine(b)
+		}
+	}
+	c.send(b, "version\r\n")
+	c.readLine(b)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	useFakeBackend(t)
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.RegisterFunc("get", func(req *protocol.McRequest, res *protocol.McResponse) error {
+		res.Values = append(res.Values, protocol.McValue{Key: "partial"})
+		var m map[string]int
+		m[req.Keys[0]]++
+		return nil
+	})
+	srv.RegisterFunc("version", VersionHandler)
+
+	server, conn := net.Pipe()
+	client, _ := NewClient(server, srv)
+	go client.Serve()
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testConn{conn, bufio.NewReader(conn)}
+
+	c.send(t, "get k\r\n")
+	if line := c.readLine(t); line != "SERVER_ERROR internal error" {
+		t.Errorf("panicking get %q, want SERVER_ERROR internal error", line)
+	}
+	c.send(t, "version\r\n")
+	if line := c.readLine(t); !strings.HasPrefix(line, "VERSION ") {
+		t.Errorf("version after panic %q", line)
+	}
+}
+
+func TestReadOnlyBackend(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.fail["set"] = fmt.Errorf("READONLY You can't write against a read only replica.")
+	c := dialTestServer(t, srv)
+	c.send(t, "set k 0 0 1\r\nv\r\n")
+	if line := c.readLine(t); line != "SERVER_ERROR backend is read-only" {
+		t.Errorf("set on a replica %q", line)
+	}
+}
+
+// dialUnixSocket connects to a server starting on the Unix socket path.
+func dialUnixSocket(t *testing.T, path string) *testConn {
+	var conn net.Conn
+	var err error
+	for i := 0; ; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		} else if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testConn{conn, bufio.NewReader(conn)}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	srv, _ := startTestServer(t)
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	admin, err := NewServer(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.RegisterFunc("stats", srv.StatsHandler)
+	go admin.ListenAndServeUnix()
+
+	c := dialUnixSocket(t, path)
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("admin socket %v, %v, want mode 0660", fi, err)
+	}
+	c.send(t, "stats conns\r\n")
+	if lines := c.readUntil(t, "END"); len(lines) != 1 {
+		t.Errorf("stats conns over the admin socket %q, want the main server's none", lines)
+	}
+	c.send(t, "get k\r\n")
+	if line := c.readLine(t); line != "ERROR" {
+		t.Errorf("get over the admin socket %q, want ERROR", line)
+	}
+}
+
+func TestPipelineBeforeQuit(t *testing.T) {
+	for _, limit := range []int{0, 1, 100} {
+		withConfig(t, func(cfg *Config) { cfg.PipelineLimit = limit })
+		srv, _ := startTestServer(t)
+		c := dialTestServer(t, srv)
+
+		c.send(t, "set k 0 0 1\r\nv\r\nget k\r\nquit\r\n")
+		rest, err := io.ReadAll(c.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "STORED\r\nVALUE k 0 1\r\nv\r\nEND\r\n"; string(rest) != want {
+			t.Errorf("PIPELINE_LIMIT=%d: %q before close, want %q", limit, rest, want)
+		}
+	}
+}
+
+func TestWriteTimeoutClosesNonReadingClient(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.WriteTimeout = 50 * time.Millisecond })
+	srv, f := startTestServer(t)
+	f.data["big"] = strings.Repeat("x", 256<<10)
+	c := dialTestServer(t, srv)
+	c.send(t, "version\r\n")
+	c.readLine(t)
+
+	// far more than the socket buffers hold, and never read
+	c.send(t, strings.Repeat("get big\r\n", 200))
+	waitFor(t, "the client to be closed", func() bool { return len(srv.connectedClients()) == 0 })
+}
+
+func TestStatsMemory(t *testing.T) {
+	srv, f := startTestServer(t)
+	c := dialTestServer(t, srv)
+	stat := func() string {
+		memoryInfo.at = time.Time{}
+		c.send(t, "stats\r\n")
+		return strings.Join(c.readUntil(t, "END"), "\n")
+	}
+
+	f.info = "# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\ntotal_system_memory:8589934592\r\nmaxmemory:104857600\r\n"
+	if general := stat(); !strings.Contains(general, "STAT bytes 1048576\n") || !strings.Contains(general, "STAT limit_maxbytes 104857600\n") {
+		t.Errorf("stats with maxmemory\n%s", general)
+	}
+	f.info = "used_memory:1048576\r\ntotal_system_memory:8589934592\r\nmaxmemory:0\r\n"
+	if general := stat(); !strings.Contains(general, "STAT limit_maxbytes 8589934592\n") {
+		t.Errorf("stats without maxmemory\n%s", general)
+	}
+	f.fail["info"] = io.ErrUnexpectedEOF
+	if general := stat(); strings.Contains(general, "STAT bytes ") || !strings.Contains(general, "STAT get_hits ") {
+		t.Errorf("stats with INFO failing\n%s", general)
+	}
+	t.Cleanup(func() { memoryInfo.at = time.Time{} })
+}
+
+func TestStatsMemoryCached(t *testing.T) {
+	f := useFakeBackend(t)
+	memoryInfo.at = time.Time{}
+	t.Cleanup(func() { memoryInfo.at = time.Time{} })
+	f.info = "used_memory:1\r\n"
+	redisMemory()
+	f.info = "used_memory:2\r\n"
+	if bytes, _, _ := redisMemory(); bytes != 1 {
+		t.Errorf("bytes %d, want the cached 1", bytes)
+	}
+}
+
+func TestGetCountsHitsAndMissesPerKey(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["k2"] = "v2"
+	c := dialTestServer(t, srv)
+
+	c.send(t, "get k1 k2 k3\r\n")
+	if lines := c.readUntil(t, "END"); len(lines) != 3 || lines[0] != "VALUE k2 0 2" {
+		t.Fatalf("get %q", lines)
+	}
+	after := srv.stats.snapshot()
+	if after.GetHits != 1 {
+		t.Errorf("get_hits %d, want 1", after.GetHits)
+	}
+	if after.GetMisses != 2 {
+		t.Errorf("get_misses %d, want 2", after.GetMisses)
+	}
+	if after.CmdGet != 3 {
+		t.Errorf("cmd_get %d, want 3", after.CmdGet)
+	}
+}
+
+func TestStatsPerServer(t *testing.T) {
+	srv1, f := startTestServer(t)
+	srv2 := serveTestServer(t)
+	f.data["k"] = "v"
+	c1, c2 := dialTestServer(t, srv1), dialTestServer(t, srv2)
+
+	c1.send(t, "get k k\r\n")
+	c1.readUntil(t, "END")
+	c2.send(t, "get k\r\n")
+	c2.readUntil(t, "END")
+	if hits := srv1.stats.snapshot().GetHits; hits != 2 {
+		t.Errorf("first server get_hits %d, want 2", hits)
+	}
+	if hits := srv2.stats.snapshot().GetHits; hits != 1 {
+		t.Errorf("second server get_hits %d, want 1", hits)
+	}
+
+	c1.send(t, "stats reset\r\n")
+	if line := c1.readLine(t); line != "RESET" {
+		t.Errorf("stats reset %q", line)
+	}
+	if c := srv1.stats.snapshot(); c != (counters{}) {
+		t.Errorf("counters after stats reset %+v", c)
+	}
+	if hits := srv2.stats.snapshot().GetHits; hits != 1 {
+		t.Errorf("stats reset of the first server changed the second to %d hits", hits)
+	}
+}
+
+func TestStatsSettings(t *testing.T) {
+	srv, f := startTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.RedisAddr = "default:secret@redis.internal:6379"
+		cfg.RedisPoolSize = 7
+		cfg.TTLMax = 90 * time.Second
+		cfg.FlushPrefix = ""
+	})
+	f.fail["info"] = io.ErrUnexpectedEOF
+	memoryInfo.at = time.Time{}
+	t.Cleanup(func() { memoryInfo.at = time.Time{} })
+	c := dialTestServer(t, srv)
+
+	c.send(t, "stats settings\r\n")
+	lines := c.readUntil(t, "END")
+	if s := strings.Join(lines, "\n"); strings.Contains(s, "secret") {
+		t.Errorf("stats settings shows the password\n%s", s)
+	}
+	for _, want := range []string{
+		"STAT listen_addr " + srv.Addr,
+		"STAT redis_addr REDACTED@redis.internal:6379",
+		"STAT redis_pool_size 7",
+		"STAT ttl_max 90",
+		"STAT flush_prefix NULL",
+		"STAT case_insensitive_keys no",
+	} {
+		if !contains(lines, want) {
+			t.Errorf("stats settings %q, missing %q", lines, want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	useFakeBackend(t)
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	srv.RegisterFunc("version", VersionHandler)
+	srv.RegisterFunc("noop", func(req *protocol.McRequest, res *protocol.McResponse) error {
+		<-release
+		res.Response = "DONE"
+		return nil
+	})
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Addr = l.Addr().String()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	idle := dialTestServer(t, srv)
+	idle.send(t, "version\r\n")
+	idle.readLine(t)
+	busy := dialTestServer(t, srv)
+	busy.send(t, "noop\r\nversion\r\n")
+	waitFor(t, "slow request to start", func() bool {
+		for _, c := range srv.connectedClients() {
+			if _, cmd, _ := c.activity(); cmd == "noop" {
+				return true
+			}
+		}
+		return false
+	})
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	if _, err := idle.r.ReadString('\n'); err != io.EOF {
+		t.Errorf("idle connection read %v, want EOF", err)
+	}
+	if _, err := net.Dial("tcp", srv.Addr); err == nil {
+		t.Errorf("new connection accepted during shutdown")
+	}
+
+	close(release)
+	if line := busy.readLine(t); line != "DONE" {
+		t.Errorf("request in progress answered %q", line)
+	}
+	if line := busy.readLine(t); !strings.HasPrefix(line, "VERSION") {
+		t.Errorf("pipelined request answered %q", line)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServeAllWithoutListeners(t *testing.T) {
+	useFakeBackend(t)
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ServeAll(); err != ErrNoListener {
+		t.Errorf("ServeAll() returned %v, want ErrNoListener", err)
+	}
+	if err := srv.ListenAndServeAll(nil, nil); err != ErrNoListener {
+		t.Errorf("ListenAndServeAll(nil) returned %v, want ErrNoListener", err)
+	}
+}
+
+// testTLSConfig returns a server configuration with a self-signed
+// certificate for 127.0.0.1.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestServeAll(t *testing.T) {
+	useFakeBackend(t)
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.RegisterFunc("version", VersionHandler)
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeAll(plain, tls.NewListener(secure, testTLSConfig(t))) }()
+
+	srv.Addr = plain.Addr().String()
+	c := dialTestServer(t, srv)
+	tc, err := tls.Dial("tcp", secure.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+	tlsConn := &testConn{tc, bufio.NewReader(tc)}
+	for name, conn := range map[string]*testConn{"plain": c, "TLS": tlsConn} {
+		conn.send(t, "version\r\n")
+		if line := conn.readLine(t); !strings.HasPrefix(line, "VERSION") {
+			t.Errorf("%s listener answered %q", name, line)
+		}
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	for _, l := range []net.Listener{plain, secure} {
+		if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			t.Errorf("%s still accepting after Shutdown", l.Addr())
+		}
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("ServeAll returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestListenAndServeAllNeedsCertificate(t *testing.T) {
+	useFakeBackend(t)
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ListenAndServeAll([]string{"127.0.0.1:0", "tls://127.0.0.1:0"}, nil); err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Errorf("TLS address without a certificate: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	useFakeBackend(t)
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	srv.RegisterFunc("noop", func(req *protocol.McRequest, res *protocol.McResponse) error {
+		<-release
+		return nil
+	})
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Addr = l.Addr().String()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	c := dialTestServer(t, srv)
+	c.send(t, "noop\r\n")
+	waitFor(t, "slow request to start", func() bool {
+		clients := srv.connectedClients()
+		if len(clients) == 0 {
+			return false
+		}
+		_, cmd, _ := clients[0].activity()
+		return cmd == "noop"
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want DeadlineExceeded", err)
+	}
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Errorf("connection still open after Shutdown gave up")
+	}
+	close(release) // the handler still holds the client
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+// Several accept loops share a listener, and Shutdown stops them all.
+func TestAcceptLoops(t *testing.T) {
+	useFakeBackend(t)
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.AcceptLoops = 4
+	srv.RegisterFunc("version", VersionHandler)
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Addr = l.Addr().String()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	const conns = 64
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dialTestServer(t, srv)
+			c.send(t, "version\r\n")
+			c.readLine(t)
+		}()
+	}
+	wg.Wait()
+	ids := make(map[uint64]bool)
+	for _, c := range srv.connectedClients() {
+		ids[c.ID] = true
+	}
+	if len(ids) != conns {
+		t.Errorf("%d distinct client IDs, want %d", len(ids), conns)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestSetHugeExptime(t *testing.T) {
+	srv, f := startTestServer(t)
+	c := dialTestServer(t, srv)
+	c.send(t, "set k 0 9223372036854775807 1\r\nx\r\nversion\r\n")
+	if line := c.readLine(t); line != "CLIENT_ERROR bad command line format" {
+		t.Errorf("set with exptime MaxInt64 %q", line)
+	}
+	if line := c.readLine(t); !strings.HasPrefix(line, "VERSION") {
+		t.Errorf("next request answered %q", line)
+	}
+	if _, ok := f.data["k"]; ok {
+		t.Errorf("item stored")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	useFakeBackend(t)
+	srv, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	tag := func(name string) Middleware {
+		return func(next HandlerFn) HandlerFn {
+			return func(req *protocol.McRequest, res *protocol.McResponse) error {
+				calls = append(calls, name+">")
+				err := next(req, res)
+				calls = append(calls, "<"+name)
+				return err
+			}
+		}
+	}
+	srv.RegisterFunc("version", VersionHandler)
+	srv.Use(tag("outer"), tag("inner"))
+	srv.RegisterFunc("get", GetHandler)
+
+	res := &protocol.McResponse{}
+	if err := srv.methods["get"](&protocol.McRequest{Command: "get", Keys: []string{"a", "b"}}, res); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(calls, " "), "outer> inner> <inner <outer"; got != want {
+		t.Errorf("middleware ran %q, want %q", got, want)
+	}
+	if c := srv.stats.snapshot(); c.CmdGet != 2 || c.GetMisses != 2 {
+		t.Errorf("counters %+v, want the get counted by the built-in middleware", c)
+	}
+
+	calls = nil
+	srv.methods["version"](&protocol.McRequest{Command: "version"}, &protocol.McResponse{})
+	if len(calls) != 0 {
+		t.Errorf("middleware added later ran around version: %q", calls)
+	}
+}
+
+func TestRequestsOneByteAtATime(t *testing.T) {
+	srv, _ := startTestServer(t)
+	c := dialTestServer(t, srv)
+	for _, b := range []byte("set k 3 0 4\r\na\r\nb\r\nget k\r\n") {
+		if _, err := c.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want := []string{"STORED", "VALUE k 3 4", "a", "b", "END"}
+	if lines := c.readUntil(t, "END"); strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("answered %q, want %q", lines, want)
+	}
+}
+
+// binaryGet is a binary protocol get of key with opaque.
+func binaryGet(key string, opaque uint32) []byte {
+	b := make([]byte, protocol.BinaryHeaderLen, protocol.BinaryHeaderLen+len(key))
+	b[0] = protocol.BinaryRequestMagic
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(key)))
+	binary.BigEndian.PutUint32(b[8:12], uint32(len(key)))
+	binary.BigEndian.PutUint32(b[12:16], opaque)
+	return append(b, key...)
+}
+
+func TestBinaryConnection(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["k"] = "v"
+	c := dialTestServer(t, srv)
+
+	c.send(t, string(binaryGet("k", 7))+string(binaryGet("k", 8)))
+	for _, opaque := range []uint32{7, 8} {
+		hdr := make([]byte, protocol.BinaryHeaderLen)
+		if _, err := io.ReadFull(c.r, hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr[0] != protocol.BinaryResponseMagic || binary.BigEndian.Uint16(hdr[6:8]) != protocol.BinaryUnknownCommand ||
+			binary.BigEndian.Uint32(hdr[12:16]) != opaque {
+			t.Errorf("binary response header % x", hdr)
+		}
+		body := make([]byte, binary.BigEndian.Uint32(hdr[8:12]))
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// text is not taken up mid-connection
+	c.send(t, "get k\r\n"+strings.Repeat(" ", protocol.BinaryHeaderLen))
+	if rest, err := io.ReadAll(c.r); err != nil || len(rest) != 0 {
+		t.Errorf("text on a binary connection answered %q, %v", rest, err)
+	}
+}
+
+func TestTextConnectionStaysText(t *testing.T) {
+	srv, f := startTestServer(t)
+	f.data["k"] = "v"
+	c := dialTestServer(t, srv)
+
+	c.send(t, "version\r\n")
+	c.readLine(t)
+	c.send(t, string(binaryGet("k", 7))+"\r\nget k\r\n")
+	if line := c.readLine(t); line != "ERROR" {
+		t.Errorf("binary request on a text connection %q", line)
+	}
+	if lines := c.readUntil(t, "END"); len(lines) != 3 {
+		t.Errorf("get after it %q", lines)
+	}
+}
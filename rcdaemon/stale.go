@@ -0,0 +1,119 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strconv"
+	"time"
+)
+
+// Stale-while-revalidate
+//
+// With STALE_GRACE set, an item stored with a TTL stays in Redis for
+// TTL + STALE_GRACE (its hard TTL). The original TTL (its soft TTL) is
+// recorded as a deadline in a companion key, see staleMetaKey.
+//
+// A get between the soft and the hard deadline still returns the value.
+// The first such get is elected to refresh the item: its VALUE line has
+// the STALE_FLAG bit set in the flags. Other clients keep getting the
+// stale value, unflagged, until the item is set again or the hard TTL
+// expires. Items stored without a TTL are never stale.
+
+// staleGetScript returns, for each key in KEYS, the value (or nil),
+// whether this caller was elected to refresh it and whether the key holds
+// a non-string value. ARGV[1] is the current time in milliseconds, ARGV[2]
+// the RESERVED_PREFIX of the companion keys.
+var staleGetScript = newScript(`
+local out = {}
+for i, key in ipairs(KEYS) do
+  local v = redis.pcall('GET', key)
+  local elected = 0
+  local wrongtype = 0
+  if type(v) == 'table' and v.err then
+    v = false
+    wrongtype = 1
+  elseif v then
+    local meta = ARGV[2] .. 'swr:' .. key
+    local soft = tonumber(redis.call('GET', meta))
+    if soft and soft <= tonumber(ARGV[1]) then
+      local pttl = redis.call('PTTL', meta)
+      if pttl > 0 then
+        redis.call('PSETEX', meta, pttl, 'refreshing')
+      end
+      elected = 1
+    end
+  end
+  out[i] = {v, elected, wrongtype}
+end
+return out
+`)
+
+// staleMetaKey names the key holding the soft deadline of key.
+func staleMetaKey(key string) string {
+	return config().ReservedPrefix + "swr:" + key
+}
+
+// hardTTL is the Redis expiration for an item stored with exp, 0 for
+// none, capped by capRedisTTL.
+func hardTTL(exp ttl) time.Duration {
+	return capRedisTTL(graceTTL(exp))
+}
+
+// graceTTL is hardTTL before MAX_TTL caps it.
+func graceTTL(exp ttl) time.Duration {
+	if exp.unlimited {
+		return 0
+	}
+	if grace := config().StaleGrace; grace > 0 {
+		return exp.secs + grace
+	}
+	return exp.secs
+}
+
+// setStaleDeadline records the soft deadline of key after it has been
+// stored with exp. It is a no-op unless STALE_GRACE is set.
+func setStaleDeadline(key string, exp ttl) error {
+	if config().StaleGrace <= 0 {
+		return nil
+	}
+	if exp.unlimited {
+		return backend.Del(staleMetaKey(key)).Err()
+	}
+	deadline := time.Now().Add(exp.secs).UnixNano() / int64(time.Millisecond)
+	return backend.Set(staleMetaKey(key), strconv.FormatInt(deadline, 10), hardTTL(exp)).Err()
+}
+
+// getWithStale is the getFn of GetHandler when STALE_GRACE is set.
+func getWithStale(cfg *Config, req *protocol.McRequest, res *protocol.McResponse) error {
+	staleFlag := cfg.StaleFlag
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	result, err := staleGetScript.Run(req.Keys, []string{strconv.FormatInt(now, 10), cfg.ReservedPrefix}).Result()
+	if err != nil {
+		return err
+	}
+	entries, _ := result.([]interface{})
+	for i, entry := range entries {
+		hotKeys.record(req.Keys[i])
+		pair, _ := entry.([]interface{})
+		if len(pair) != 3 {
+			continue
+		}
+		s, ok := pair[0].(string)
+		if !ok {
+			if wrong, _ := pair[2].(int64); wrong == 1 && cfg.GetWrongType == WrongTypeError {
+				wrongType(req.Keys[i], res)
+				return nil
+			}
+			continue // key did not exist
+		}
+		flags, data, ok := decodeValue(s)
+		if !ok {
+			continue // stored by a later version
+		}
+		if elected, _ := pair[1].(int64); elected == 1 {
+			flags |= staleFlag
+		}
+		res.Values = append(res.Values, protocol.McValue{Key: req.Keys[i], Flags: strconv.FormatUint(uint64(flags), 10), Data: []byte(data)})
+	}
+	res.Response = "END"
+	return nil
+}
@@ -0,0 +1,79 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetWithStaleGrace(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.StaleGrace = 10 * time.Second })
+
+	req := &protocol.McRequest{Command: "set", Key: "k", Exptime: 60, Value: []byte("v")}
+	if err := SetHandler(req, &protocol.McResponse{}); err != nil {
+		t.Fatalf("SetHandler: %v", err)
+	}
+	if f.ttls["k"] != 70*time.Second {
+		t.Errorf("hard ttl %v, want 70s", f.ttls["k"])
+	}
+	if f.ttls[staleMetaKey("k")] != 70*time.Second {
+		t.Errorf("deadline ttl %v, want 70s", f.ttls[staleMetaKey("k")])
+	}
+	deadline, err := strconv.ParseInt(f.data[staleMetaKey("k")], 10, 64)
+	if err != nil {
+		t.Fatalf("deadline %q: %v", f.data[staleMetaKey("k")], err)
+	}
+	if soft := time.Until(time.Unix(0, deadline*int64(time.Millisecond))); soft < 59*time.Second || soft > 60*time.Second {
+		t.Errorf("soft ttl %v, want about 60s", soft)
+	}
+
+	// Storing without a TTL drops the deadline: the item never goes stale.
+	req.Exptime = 0
+	if err := SetHandler(req, &protocol.McResponse{}); err != nil {
+		t.Fatalf("SetHandler: %v", err)
+	}
+	if _, ok := f.data[staleMetaKey("k")]; ok {
+		t.Errorf("deadline kept for an item without TTL")
+	}
+}
+
+func TestGetStaleElectsOneRefresher(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.StaleGrace = 10 * time.Second
+		cfg.StaleFlag = DefaultStaleFlag
+	})
+	f.data["fresh"] = "a"
+	f.data[staleMetaKey("fresh")] = strconv.FormatInt(time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond), 10)
+	f.data["stale"] = "b"
+	f.data[staleMetaKey("stale")] = strconv.FormatInt(time.Now().Add(-time.Second).UnixNano()/int64(time.Millisecond), 10)
+	f.data["plain"] = "c"
+
+	get := func() []protocol.McValue {
+		res := &protocol.McResponse{}
+		req := &protocol.McRequest{Command: "get", Keys: []string{"fresh", "stale", "plain", "missing"}}
+		if err := GetHandler(req, res); err != nil {
+			t.Fatalf("GetHandler: %v", err)
+		}
+		if len(res.Values) != 3 {
+			t.Fatalf("Values %+v", res.Values)
+		}
+		return res.Values
+	}
+
+	staleFlags := strconv.FormatUint(DefaultStaleFlag, 10)
+	first := get()
+	if first[0].Flags != "0" || first[1].Flags != staleFlags || first[2].Flags != "0" {
+		t.Errorf("first get flags %q %q %q", first[0].Flags, first[1].Flags, first[2].Flags)
+	}
+	if string(first[1].Data) != "b" {
+		t.Errorf("stale value %q", first[1].Data)
+	}
+
+	second := get()
+	if second[1].Flags != "0" || string(second[1].Data) != "b" {
+		t.Errorf("second get of stale item %+v, want unflagged stale value", second[1])
+	}
+}
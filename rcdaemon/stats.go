@@ -0,0 +1,340 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters of the requests a Server served, kept per Server so that each
+// reports only its own. Fields are only accessed atomically.
+type counters struct {
+	CmdGet    uint64 // keys requested by get/gets
+	GetHits   uint64
+	GetMisses uint64
+
+	TotalItems uint64 // items stored by set, add, append and prepend
+}
+
+// storingCommands are the commands counted in total_items when STORED.
+var storingCommands = map[string]bool{"set": true, "add": true, "append": true, "prepend": true}
+
+// count records that req was answered with res.
+func (c *counters) count(cmd string, req *protocol.McRequest, res *protocol.McResponse) {
+	if cmd == "get" || cmd == "gets" {
+		atomic.AddUint64(&c.CmdGet, uint64(len(req.Keys)))
+		atomic.AddUint64(&c.GetHits, uint64(len(res.Values)))
+		atomic.AddUint64(&c.GetMisses, uint64(len(req.Keys)-len(res.Values)))
+	}
+	if storingCommands[cmd] && res.Response == "STORED" {
+		atomic.AddUint64(&c.TotalItems, 1)
+	}
+}
+
+// snapshot returns a copy of the counters that is safe to read.
+func (c *counters) snapshot() counters {
+	return counters{
+		CmdGet:    atomic.LoadUint64(&c.CmdGet),
+		GetHits:   atomic.LoadUint64(&c.GetHits),
+		GetMisses: atomic.LoadUint64(&c.GetMisses),
+
+		TotalItems: atomic.LoadUint64(&c.TotalItems),
+	}
+}
+
+// reset zeroes the counters, for stats reset.
+func (c *counters) reset() {
+	atomic.StoreUint64(&c.CmdGet, 0)
+	atomic.StoreUint64(&c.GetHits, 0)
+	atomic.StoreUint64(&c.GetMisses, 0)
+	atomic.StoreUint64(&c.TotalItems, 0)
+}
+
+// countRequests is the Middleware keeping the counters of srv.
+func (srv *Server) countRequests(next HandlerFn) HandlerFn {
+	return func(req *protocol.McRequest, res *protocol.McResponse) error {
+		err := next(req, res)
+		if err == nil {
+			srv.stats.count(req.Command, req, res)
+		}
+		countDebug(req, res, err)
+		return err
+	}
+}
+
+// flushedKeys counts the keys deleted by scoped flushes. Like the flushes
+// themselves it is shared by the servers of the process.
+var flushedKeys uint64
+
+// memoryInfoTTL is how long the memory figures from INFO are reused.
+const memoryInfoTTL = time.Second
+
+// memoryInfo caches the memory figures of Redis for stats.
+var memoryInfo struct {
+	sync.Mutex
+	at           time.Time
+	bytes, limit uint64
+	err          error
+}
+
+// redisMemory returns the memory Redis uses and its limit, maxmemory or
+// without one the memory of its host, from an INFO at most memoryInfoTTL
+// old.
+func redisMemory() (bytes, limit uint64, err error) {
+	memoryInfo.Lock()
+	defer memoryInfo.Unlock()
+	if time.Since(memoryInfo.at) < memoryInfoTTL {
+		return memoryInfo.bytes, memoryInfo.limit, memoryInfo.err
+	}
+
+	info, err := backend.Info().Result()
+	fields := make(map[string]uint64)
+	for _, line := range strings.Split(info, "\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			n, err := strconv.ParseUint(strings.TrimSpace(line[i+1:]), 10, 64)
+			if err == nil {
+				fields[line[:i]] = n
+			}
+		}
+	}
+	bytes, limit = fields["used_memory"], fields["maxmemory"]
+	if limit == 0 {
+		limit = fields["total_system_memory"]
+	}
+	memoryInfo.at = time.Now()
+	memoryInfo.bytes, memoryInfo.limit, memoryInfo.err = bytes, limit, err
+	return bytes, limit, err
+}
+
+// statsWriter renders the STAT lines of a stats response.
+type statsWriter struct {
+	b bytes.Buffer
+}
+
+func (w *statsWriter) stat(name string, value interface{}) {
+	fmt.Fprintf(&w.b, "STAT %s %v\r\n", name, value)
+}
+
+// end terminates the response and returns it for McResponse.Response.
+func (w *statsWriter) end() string {
+	w.b.WriteString("END")
+	return w.b.String()
+}
+
+// uptime returns how long srv has been running, in whole seconds.
+func (srv *Server) uptime() int64 {
+	return int64(time.Since(srv.StartTime) / time.Second)
+}
+
+// `time` handler, an extension answering `TIME <unix time> <uptime>` in
+// seconds, the clock against which absolute exptimes are taken, for
+// chasing down clock skew between clients and redcached.
+func (srv *Server) TimeHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	res.Response = fmt.Sprintf("TIME %d %d", time.Now().Unix(), srv.uptime())
+	return nil
+}
+
+// `stats` handler
+//
+// Supports the general statistics, `stats conns`, which lists the
+// connected clients, `stats settings`, which lists the configuration in
+// effect, `stats hotkeys`, see hotKeyTracker, and `stats reset`, which
+// zeroes the request counters of srv.
+func (srv *Server) StatsHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	group := ""
+	if len(req.Args) > 0 {
+		group = req.Args[0]
+	}
+
+	w := &statsWriter{}
+	switch group {
+	case "":
+		srv.mu.Lock()
+		curr, total, rejected := srv.CurrConnections, srv.TotalConnections, srv.RejectedConnections
+		srv.mu.Unlock()
+		c := srv.stats.snapshot()
+
+		w.stat("pid", os.Getpid())
+		w.stat("uptime", srv.uptime())
+		w.stat("time", time.Now().Unix())
+		w.stat("version", Version)
+		w.stat("curr_connections", curr)
+		w.stat("total_connections", total)
+		w.stat("rejected_connections", rejected)
+		w.stat("cmd_get", c.CmdGet)
+		w.stat("get_hits", c.GetHits)
+		w.stat("get_misses", c.GetMisses)
+		w.stat("flush_in_progress", boolStat(flushInProgress()))
+		w.stat("flushed_keys", atomic.LoadUint64(&flushedKeys))
+		w.stat("ttl_capped", atomic.LoadInt64(&cappedTTLs))
+		w.stat("watch_conflicts", atomic.LoadUint64(&watchConflicts))
+		w.stat("get_coalesced", atomic.LoadUint64(&coalescedGets))
+		w.stat("write_behind_pending", pendingWrites())
+		w.stat("write_behind_dropped", atomic.LoadUint64(&writes.dropped))
+		w.stat("invalidations_dropped", atomic.LoadUint64(&invalidations.dropped))
+		w.stat("memory_rejected_writes", atomic.LoadUint64(&memoryRejects))
+		w.stat("chaos_delays", atomic.LoadUint64(&chaosDelays))
+		w.stat("chaos_errors", atomic.LoadUint64(&chaosErrors))
+		w.stat("compat_warnings", atomic.LoadUint64(&compatWarnings))
+		w.stat("curr_items", currItems())
+		w.stat("total_items", c.TotalItems)
+		if bytes, limit, err := redisMemory(); err == nil {
+			w.stat("bytes", bytes)
+			w.stat("limit_maxbytes", limit)
+		}
+
+		// Connection pool to Redis, to tell when PoolSize is too small.
+		// redis.v3 does not track stale connections, so there is no
+		// pool_stale_conns.
+		pool := backend.PoolStats()
+		w.stat("pool_total_conns", pool.TotalConns)
+		w.stat("pool_idle_conns", pool.FreeConns)
+		w.stat("pool_requests", pool.Requests)
+		w.stat("pool_hits", pool.Hits)
+		w.stat("pool_waits", pool.Waits)
+		w.stat("pool_timeouts", pool.Timeouts)
+	case "conns":
+		now := time.Now()
+		for _, client := range srv.connectedClients() {
+			lastActivity, lastCommand, commands := client.activity()
+			w.stat(fmt.Sprintf("%d:addr", client.ID), "tcp:"+client.Addr)
+			w.stat(fmt.Sprintf("%d:age", client.ID), int64(now.Sub(client.StartTime).Seconds()))
+			w.stat(fmt.Sprintf("%d:secs_since_last_cmd", client.ID), int64(now.Sub(lastActivity).Seconds()))
+			if lastCommand != "" {
+				w.stat(fmt.Sprintf("%d:last_cmd", client.ID), lastCommand)
+			}
+			w.stat(fmt.Sprintf("%d:cmds", client.ID), commands)
+		}
+	case "settings":
+		srv.settingsStats(w, config())
+	case "reset":
+		srv.stats.reset()
+		res.Response = "RESET"
+		return nil
+	case "hotkeys":
+		for _, k := range hotKeys.hottest() {
+			w.stat(k.key, k.count)
+		}
+	default:
+		res.Response = "ERROR"
+		return nil
+	}
+	res.Response = w.end()
+	return nil
+}
+
+// settingsStats renders the settings of stats settings: where srv listens,
+// all of LISTEN if set, then cfg by the lowercased names of its environment
+// variables. Durations are in seconds, unset strings NULL and booleans yes
+// or no, as in memcached.
+func (srv *Server) settingsStats(w *statsWriter, cfg *Config) {
+	str := func(s string) string {
+		if s == "" {
+			return "NULL"
+		}
+		return s
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	secs := func(d time.Duration) float64 { return d.Seconds() }
+
+	listen := cfg.Listen
+	if len(listen) == 0 {
+		listen = []string{srv.Addr}
+	}
+	w.stat("listen_addr", strings.Join(listen, ","))
+	if addr, _ := splitListenAddr(listen[0]); addr != "" {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			w.stat("tcpport", port)
+		}
+	}
+	w.stat("tls_cert_file", str(cfg.TLSCertFile))
+	w.stat("allow_cidrs", str(formatCIDRs(cfg.AllowCIDRs)))
+	w.stat("deny_cidrs", str(formatCIDRs(cfg.DenyCIDRs)))
+	w.stat("reuseport", yesNo(srv.ReusePort))
+	w.stat("accept_loops", srv.acceptLoops())
+	w.stat("redis_addr", redactAddr(cfg.RedisAddr))
+	w.stat("redis_pool_size", cfg.RedisPoolSize)
+	w.stat("redis_idle_timeout", secs(cfg.RedisIdleTimeout))
+	w.stat("redis_max_retries", cfg.RedisMaxRetries)
+	w.stat("redis_warmup", cfg.RedisWarmup)
+	if _, limit, err := redisMemory(); err == nil {
+		w.stat("maxbytes", limit)
+	}
+	w.stat("max_line_length", protocol.MaxLineLength)
+	w.stat("item_size_max", cfg.ItemSizeMax)
+	w.stat("pipeline_limit", cfg.PipelineLimit)
+	w.stat("ttl_mode", cfg.TTLMode)
+	w.stat("ttl_min", secs(cfg.TTLMin))
+	w.stat("ttl_max", secs(cfg.TTLMax))
+	w.stat("max_ttl", secs(cfg.MaxTTL))
+	w.stat("default_flags", cfg.DefaultFlags)
+	w.stat("stale_grace", secs(cfg.StaleGrace))
+	w.stat("stale_flag", cfg.StaleFlag)
+	w.stat("flush_prefix", str(cfg.FlushPrefix))
+	w.stat("get_flushing", cfg.GetFlushing)
+	w.stat("delete_matching", yesNo(cfg.DeleteMatching))
+	w.stat("invalidation_channel", str(cfg.InvalidationChannel))
+	w.stat("tag_delimiter", str(cfg.TagDelimiter))
+	w.stat("reserved_prefix", cfg.ReservedPrefix)
+	w.stat("reject_reserved_keys", yesNo(cfg.RejectReservedKeys))
+	w.stat("case_insensitive_keys", yesNo(cfg.CaseInsensitiveKeys))
+	w.stat("get_wrongtype", cfg.GetWrongType)
+	w.stat("read_fail_mode", cfg.ReadFailMode)
+	w.stat("compound_ops", cfg.CompoundOps)
+	w.stat("lua_scripting", yesNo(scripting()))
+	w.stat("get_latency_floor", secs(cfg.GetLatencyFloor))
+	w.stat("miss_reasons", yesNo(cfg.MissReasons))
+	w.stat("coalesce_gets", yesNo(cfg.CoalesceGets))
+	w.stat("write_behind_interval", secs(cfg.WriteBehindInterval))
+	w.stat("write_behind_max", cfg.WriteBehindMax)
+	w.stat("cache_memlimit", str(cfg.CacheMemlimit))
+	w.stat("memory_high_water", cfg.MemoryHighWater)
+	w.stat("slab_commands", str(cfg.SlabCommands))
+	w.stat("shutdown_grace", secs(cfg.ShutdownGrace))
+	w.stat("write_timeout", secs(cfg.WriteTimeout))
+	w.stat("admin_commands", yesNo(cfg.AdminCommands))
+	w.stat("admin_socket", str(cfg.AdminSocket))
+	w.stat("debug_addr", str(cfg.DebugAddr))
+	w.stat("verbose_errors", yesNo(cfg.VerboseErrors))
+	w.stat("noreply_audit", yesNo(cfg.NoreplyAudit))
+	w.stat("log_level", cfg.LogLevel)
+	w.stat("strict_compat", yesNo(cfg.StrictCompat))
+	w.stat("preload_file", str(cfg.PreloadFile))
+	w.stat("log_file", str(cfg.LogFile))
+	w.stat("hotkeys_sample_rate", cfg.HotKeysSampleRate)
+	w.stat("hotkeys_top", cfg.HotKeysTop)
+	w.stat("hotkeys_window", secs(cfg.HotKeysWindow))
+	w.stat("chaos_mode", yesNo(cfg.ChaosMode))
+	w.stat("chaos_latency", secs(cfg.ChaosLatency))
+	w.stat("chaos_latency_rate", cfg.ChaosLatencyRate)
+	w.stat("chaos_error_rate", cfg.ChaosErrorRate)
+}
+
+// redactAddr hides the credentials of addr, if it has any as in
+// user:password@host:port.
+func redactAddr(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return "REDACTED" + addr[i:]
+	}
+	return addr
+}
+
+// boolStat renders b as memcached does, 0 or 1.
+func boolStat(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
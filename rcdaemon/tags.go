@@ -0,0 +1,121 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strconv"
+	"strings"
+)
+
+// Tags
+//
+// With TAG_DELIMITER set, the part of a key before the first delimiter is
+// its tag: with ":", "user42:profile" and "user42:cart" are both tagged
+// "user42". Storing a tagged key adds it to a Redis set per tag, see
+// tagSetKey, and `invalidate_tag <tag>` deletes every key in the set and
+// the set itself, without scanning the keyspace.
+//
+// The sets are an index that only grows: a key stays in its tag's set
+// after it expires or is deleted, until the tag is invalidated.
+
+// invalidateTagScript deletes the members of the set KEYS[1], with their
+// stale-while-revalidate companion keys under the RESERVED_PREFIX ARGV[1],
+// and the set. It returns the number of items deleted and, if ARGV[2] is
+// '1', the members, to be published. The item keys are not declared in
+// KEYS, so this does not work with Redis Cluster.
+var invalidateTagScript = newScript(`
+local keys = redis.call('SMEMBERS', KEYS[1])
+local n = 0
+for i = 1, #keys, 1000 do
+  local batch, meta = {}, {}
+  for j = i, math.min(i + 999, #keys) do
+    batch[#batch + 1] = keys[j]
+    meta[#meta + 1] = ARGV[1] .. 'swr:' .. keys[j]
+  end
+  n = n + redis.call('DEL', unpack(batch))
+  redis.call('DEL', unpack(meta))
+end
+redis.call('DEL', KEYS[1])
+if ARGV[2] == '1' then
+  return {n, keys}
+end
+return {n, {}}
+`)
+
+// tagSetKey names the set of the keys tagged tag.
+func tagSetKey(tag string) string {
+	return config().ReservedPrefix + "tag:" + tag
+}
+
+// itemTag returns the tag of key, or "" if it has none.
+func itemTag(key string) string {
+	delim := config().TagDelimiter
+	if delim == "" {
+		return ""
+	}
+	if i := strings.Index(key, delim); i > 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// tagItem records key in the set of its tag, if it has one, after it has
+// been stored. With MAX_TTL set the set expires after it too, as its keys
+// do by then.
+func tagItem(key string) error {
+	tag := itemTag(key)
+	if tag == "" {
+		return nil
+	}
+	if err := backend.SAdd(tagSetKey(tag), key).Err(); err != nil {
+		return err
+	}
+	if max := config().MaxTTL; max > 0 {
+		return backend.Expire(tagSetKey(tag), max).Err()
+	}
+	return nil
+}
+
+// `invalidate_tag` handler
+//
+// Answers DELETED with the number of items deleted, or NOT_FOUND if the
+// tag had none. Without TAG_DELIMITER there are no tags, and it answers
+// ERROR before touching Redis.
+func InvalidateTagHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	if config().TagDelimiter == "" {
+		res.Response = unknownCommand("invalidate_tag needs TAG_DELIMITER")
+		return nil
+	}
+	if !scripting() {
+		res.Response = unknownCommand("invalidate_tag needs Lua scripts, which Redis refuses")
+		return nil
+	}
+	writeBehindFlush() // so that buffered items are in the tag's set
+	defer detachGets()
+	publish := "0"
+	if config().InvalidationChannel != "" {
+		publish = "1"
+	}
+	result, err := invalidateTagScript.Run([]string{tagSetKey(req.Args[0])}, []string{config().ReservedPrefix, publish}).Result()
+	if err != nil {
+		return err
+	}
+	var n int64
+	if pair, _ := result.([]interface{}); len(pair) == 2 {
+		n, _ = pair[0].(int64)
+		// members deleted before, or expired, are published too, harmlessly
+		members, _ := pair[1].([]interface{})
+		keys := make([]string, 0, len(members))
+		for _, m := range members {
+			if key, ok := m.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		publishDeleted(keys)
+	}
+	if n > 0 {
+		res.Response = "DELETED " + strconv.FormatInt(n, 10)
+	} else {
+		res.Response = "NOT_FOUND"
+	}
+	return nil
+}
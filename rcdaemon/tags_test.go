@@ -0,0 +1,63 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"testing"
+)
+
+func TestInvalidateTag(t *testing.T) {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.TagDelimiter = ":" })
+
+	for _, key := range []string{"user42:profile", "user42:cart", "user7:profile", "untagged", ":x"} {
+		req := &protocol.McRequest{Command: "set", Key: key, Value: []byte("v")}
+		if err := SetHandler(req, &protocol.McResponse{}); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	if err := AddHandler(&protocol.McRequest{Command: "add", Key: "user42:new", Value: []byte("v")}, &protocol.McResponse{}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if len(f.sets) != 2 || len(f.sets[tagSetKey("user42")]) != 3 {
+		t.Fatalf("tag sets %v", f.sets)
+	}
+
+	invalidate := func(tag string) string {
+		res := &protocol.McResponse{}
+		if err := InvalidateTagHandler(&protocol.McRequest{Command: "invalidate_tag", Args: []string{tag}}, res); err != nil {
+			t.Fatalf("invalidate_tag %s: %v", tag, err)
+		}
+		return res.Response
+	}
+	if got := invalidate("user42"); got != "DELETED 3" {
+		t.Errorf("invalidate_tag user42: %q", got)
+	}
+	if got := invalidate("user42"); got != "NOT_FOUND" {
+		t.Errorf("invalidate_tag user42 again: %q", got)
+	}
+	for _, key := range []string{"user7:profile", "untagged", ":x"} {
+		if _, ok := f.data[key]; !ok {
+			t.Errorf("%s deleted", key)
+		}
+	}
+	if _, ok := f.sets[tagSetKey("user42")]; ok {
+		t.Errorf("tag set left behind")
+	}
+}
+
+func TestInvalidateTagWithoutDelimiter(t *testing.T) {
+	f := useFakeBackend(t)
+	f.sets = map[string]map[string]bool{tagSetKey("user42"): {"user42:profile": true}}
+	f.data["user42:profile"] = "v"
+
+	res := &protocol.McResponse{}
+	if err := InvalidateTagHandler(&protocol.McRequest{Command: "invalidate_tag", Args: []string{"user42"}}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "ERROR" {
+		t.Errorf("invalidate_tag without TAG_DELIMITER: %q", res.Response)
+	}
+	if _, ok := f.data["user42:profile"]; !ok {
+		t.Error("item deleted")
+	}
+}
@@ -0,0 +1,71 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ttlScript returns the PTTL of each key in KEYS, in one round trip: -2
+// for a key that does not exist, -1 for one without an expiration.
+var ttlScript = newScript(`
+local out = {}
+for i, key in ipairs(KEYS) do
+  out[i] = redis.call('PTTL', key)
+end
+return out
+`)
+
+// `ttl` handler, an extension for inspecting expirations
+//
+//	ttl <key>+\r\n
+//
+// Answers `TTL <key> <milliseconds>` for each key, -1 for a key without an
+// expiration and NOT_FOUND for a missing one, then END. The TTLs are those
+// of the keys in Redis, so they include STALE_GRACE; a set still buffered
+// by write-behind reports the TTL it will be written with.
+func TTLHandler(req *protocol.McRequest, res *protocol.McResponse) error {
+	if !scripting() {
+		res.Response = unknownCommand("ttl needs Lua scripts, which Redis refuses")
+		return nil
+	}
+	result, err := ttlScript.Run(req.Keys, nil).Result()
+	if err != nil {
+		return err
+	}
+	pttls, _ := result.([]interface{})
+	buffered := bufferedValues(req.Keys)
+	now := time.Now()
+
+	var b strings.Builder
+	for i, key := range req.Keys {
+		pttl := int64(-2)
+		if i < len(pttls) {
+			pttl, _ = pttls[i].(int64)
+		}
+		if buffered != nil && buffered[i] != nil {
+			switch set := buffered[i]; {
+			case set.expired(now):
+				pttl = -2
+			case set.expiresAt.IsZero():
+				pttl = -1
+			default:
+				pttl = int64(set.expiresAt.Sub(now) / time.Millisecond)
+			}
+		}
+
+		b.WriteString("TTL ")
+		b.WriteString(key)
+		b.WriteByte(' ')
+		if pttl == -2 {
+			b.WriteString("NOT_FOUND")
+		} else {
+			b.WriteString(strconv.FormatInt(pttl, 10))
+		}
+		b.WriteString("\r\n")
+	}
+	b.WriteString("END")
+	res.Response = b.String()
+	return nil
+}
@@ -0,0 +1,26 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTLHandler(t *testing.T) {
+	f := useFakeBackend(t)
+	f.set("expiring", "v", 90*time.Second)
+	f.set("forever", "v", 0)
+	useWriteBehind(t, time.Hour, 100)
+	SetHandler(bufferedSetReq("buffered", "0", 60, "v"), &protocol.McResponse{})
+
+	res := &protocol.McResponse{}
+	if err := TTLHandler(&protocol.McRequest{Command: "ttl", Keys: []string{"expiring", "forever", "missing", "buffered"}}, res); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(res.Response, "\r\n")
+	if len(lines) != 5 || lines[0] != "TTL expiring 90000" || lines[1] != "TTL forever -1" ||
+		lines[2] != "TTL missing NOT_FOUND" || !strings.HasPrefix(lines[3], "TTL buffered 59") || lines[4] != "END" {
+		t.Errorf("ttl answered %q", lines)
+	}
+}
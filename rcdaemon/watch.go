@@ -0,0 +1,193 @@
+package rcdaemon
+
+import (
+	"errors"
+	"gopkg.in/redis.v3"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Transactions
+//
+// With COMPOUND_OPS=watch, the compound operations that otherwise run a
+// Lua script, incr/decr, append/prepend and add_get, run as optimistic
+// transactions for Redis servers where EVAL is disabled: the key is read
+// after a WATCH and written in a MULTI/EXEC, which Redis aborts if the key
+// changed in between. The operation is then retried from the read, up to
+// maxWatchAttempts times.
+
+// txn is a WATCH transaction, as *redis.Multi: reads run at once, writes
+// inside Exec are queued for EXEC.
+type txn interface {
+	Get(key string) *redis.StringCmd
+	PTTL(key string) *redis.DurationCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Exec(f func() error) ([]redis.Cmder, error)
+	Close() error
+}
+
+// watcher is a Backend that starts transactions itself, as the fake of
+// the tests does.
+type watcher interface {
+	watch(keys ...string) (txn, error)
+}
+
+// maxWatchAttempts bounds how often a transaction is retried when the key
+// keeps changing under it.
+const maxWatchAttempts = 16
+
+// errWatchContention is returned when every attempt of a transaction was
+// aborted by concurrent writes.
+var errWatchContention = errors.New("too many concurrent writes to the key")
+
+// watchConflicts counts the transactions aborted by a concurrent write
+// and retried, for stats.
+var watchConflicts uint64
+
+// watch starts a transaction on b watching keys.
+func watch(b Backend, keys ...string) (txn, error) {
+	switch b := b.(type) {
+	case *redis.Client:
+		m, err := b.Watch(keys...)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case watcher:
+		return b.watch(keys...)
+	}
+	return nil, errors.New("backend does not support transactions")
+}
+
+// watchOps reports whether incr/decr, append/prepend and add_get run as WATCH
+// transactions: with COMPOUND_OPS=watch, or when Redis refuses scripts.
+func watchOps() bool {
+	return config().CompoundOps == CompoundOpsWatch || !scripting()
+}
+
+// withWatch runs fn in a transaction on b watching key, again as long as
+// EXEC is aborted because key changed.
+func withWatch(b Backend, key string, fn func(tx txn) error) error {
+	for i := 0; i < maxWatchAttempts; i++ {
+		tx, err := watch(b, key)
+		if err != nil {
+			return err
+		}
+		err = fn(tx)
+		tx.Close()
+		if err != redis.TxFailedErr {
+			return err
+		}
+		atomic.AddUint64(&watchConflicts, 1)
+	}
+	return errWatchContention
+}
+
+// incrWatch is incrScript as a transaction on b, with the same results:
+// the new value, redis.Nil if the key does not exist or a NONNUMERIC
+// error.
+func incrWatch(b Backend, key, op string, delta uint64) (string, error) {
+	var s string
+	err := withWatch(b, key, func(tx txn) error {
+		v, err := tx.Get(key).Result()
+		if err != nil {
+			return err
+		}
+		header := ""
+		if strings.HasPrefix(v, valueMagic+"\x01") && len(v) >= valueHeaderLen1 {
+			header, v = v[:valueHeaderLen1], v[valueHeaderLen1:]
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return errors.New("NONNUMERIC")
+		}
+		switch {
+		case op == "incr":
+			n += delta // wraps around at 2^64
+		case n < delta:
+			n = 0
+		default:
+			n -= delta
+		}
+		pttl, err := tx.PTTL(key).Result()
+		if err != nil {
+			return err
+		}
+		if pttl < 0 {
+			pttl = 0 // none
+		}
+		s = strconv.FormatUint(n, 10)
+		_, err = tx.Exec(func() error {
+			tx.Set(key, header+s, pttl)
+			return nil
+		})
+		return err
+	})
+	return s, err
+}
+
+// addGetWatch is addGetScript as a transaction, with the same results: 1
+// if it stored value, the current value otherwise.
+func addGetWatch(key string, value []byte, px int64) (interface{}, error) {
+	var result interface{}
+	err := withWatch(backend, key, func(tx txn) error {
+		v, err := tx.Get(key).Result()
+		if err == nil {
+			result = v
+			return nil
+		} else if err != redis.Nil {
+			return err
+		}
+		result = int64(1)
+		if px < 0 {
+			return nil // expired already, nothing to store
+		}
+		_, err = tx.Exec(func() error {
+			tx.SetNX(key, value, time.Duration(px)*time.Millisecond)
+			return nil
+		})
+		return err
+	})
+	return result, err
+}
+
+// concatWatch is concatScript as a transaction on b, with the same
+// results, data growing the item up to max bytes.
+func concatWatch(b Backend, key, op, data string, max int) (int64, error) {
+	var result int64
+	err := withWatch(b, key, func(tx txn) error {
+		v, err := tx.Get(key).Result()
+		if err == redis.Nil {
+			result = concatMissing
+			return nil
+		} else if err != nil {
+			return err
+		}
+		v, ok := concatValue(v, op, data)
+		if !ok {
+			result = concatMissing
+			return nil
+		}
+		if _, item, _ := decodeValue(v); len(item) > max {
+			result = concatTooLarge
+			return nil
+		}
+		result = concatStored
+		pttl, err := tx.PTTL(key).Result()
+		if err != nil {
+			return err
+		}
+		if pttl < 0 {
+			pttl = 0 // none
+		}
+		_, err = tx.Exec(func() error {
+			tx.Set(key, v, pttl)
+			return nil
+		})
+		return err
+	})
+	return result, err
+}
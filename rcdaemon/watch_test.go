@@ -0,0 +1,216 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"gopkg.in/redis.v3"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTx is a transaction on a fakeBackend. EXEC is aborted if a watched
+// key changed since WATCH; beforeExec can change one to make it so.
+type fakeTx struct {
+	f       *fakeBackend
+	watched map[string]string // values at WATCH, "\x00none" if missing
+	queued  []func()
+}
+
+func (f *fakeBackend) watch(keys ...string) (txn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tx := &fakeTx{f: f, watched: make(map[string]string)}
+	for _, key := range keys {
+		tx.watched[key] = f.watchedValue(key)
+	}
+	return tx, nil
+}
+
+func (f *fakeBackend) watchedValue(key string) string {
+	if v, ok := f.data[key]; ok {
+		return v
+	}
+	return "\x00none"
+}
+
+func (tx *fakeTx) Get(key string) *redis.StringCmd { return tx.f.Get(key) }
+
+func (tx *fakeTx) PTTL(key string) *redis.DurationCmd {
+	tx.f.mu.Lock()
+	defer tx.f.mu.Unlock()
+	switch _, ok := tx.f.data[key]; {
+	case !ok:
+		return redis.NewDurationResult(-2*time.Millisecond, nil)
+	case tx.f.ttls[key] == 0:
+		return redis.NewDurationResult(-time.Millisecond, nil)
+	}
+	return redis.NewDurationResult(tx.f.ttls[key], nil)
+}
+
+func (tx *fakeTx) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	tx.queued = append(tx.queued, func() { tx.f.set(key, value, expiration) })
+	return redis.NewStatusResult("QUEUED", nil)
+}
+
+func (tx *fakeTx) SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	tx.queued = append(tx.queued, func() {
+		if _, ok := tx.f.data[key]; !ok {
+			tx.f.set(key, value, expiration)
+		}
+	})
+	return redis.NewBoolResult(false, nil)
+}
+
+func (tx *fakeTx) Exec(fn func() error) ([]redis.Cmder, error) {
+	if err := fn(); err != nil {
+		return nil, err
+	}
+	tx.f.mu.Lock()
+	hook := tx.f.beforeExec
+	tx.f.execs++
+	tx.f.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+
+	tx.f.mu.Lock()
+	defer tx.f.mu.Unlock()
+	for key, v := range tx.watched {
+		if tx.f.watchedValue(key) != v {
+			return nil, redis.TxFailedErr
+		}
+	}
+	for _, q := range tx.queued {
+		q()
+	}
+	return nil, nil
+}
+
+func (tx *fakeTx) Close() error { return nil }
+
+func useWatch(t *testing.T) *fakeBackend {
+	f := useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.CompoundOps = CompoundOpsWatch })
+	return f
+}
+
+func TestIncrWatch(t *testing.T) {
+	f := useWatch(t)
+	f.set("n", string(encodeValue(3, []byte("18446744073709551615"))), time.Minute)
+	f.data["word"] = "abc"
+
+	for _, tc := range []struct {
+		handler HandlerFn
+		key     string
+		delta   uint64
+		want    string
+	}{
+		{IncrHandler, "n", 2, "1"}, // wraps around at 2^64
+		{DecrHandler, "n", 5, "0"}, // stops at 0
+		{IncrHandler, "missing", 1, "NOT_FOUND"},
+		{IncrHandler, "word", 1, "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+	} {
+		res := &protocol.McResponse{}
+		if err := tc.handler(&protocol.McRequest{Key: tc.key, Increment: tc.delta}, res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Response != tc.want {
+			t.Errorf("%s by %d: %q, want %q", tc.key, tc.delta, res.Response, tc.want)
+		}
+	}
+	if flags, data, _ := decodeValue(f.data["n"]); flags != 3 || data != "0" || f.ttls["n"] != time.Minute {
+		t.Errorf("n is %d %q with TTL %v", flags, data, f.ttls["n"])
+	}
+	if f.evals != 0 {
+		t.Errorf("%d scripts sent", f.evals)
+	}
+}
+
+// A write to the key between WATCH and EXEC aborts the transaction, which
+// is retried on the new value.
+func TestIncrWatchRetriesOnConflict(t *testing.T) {
+	f := useWatch(t)
+	f.data["n"] = "10"
+	conflicts := 2
+	f.beforeExec = func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if conflicts > 0 {
+			conflicts--
+			n, _ := strconv.Atoi(f.data["n"])
+			f.data["n"] = strconv.Itoa(n + 100)
+		}
+	}
+	before := atomic.LoadUint64(&watchConflicts)
+
+	res := &protocol.McResponse{}
+	if err := IncrHandler(&protocol.McRequest{Key: "n", Increment: 1}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "211" || f.data["n"] != "211" {
+		t.Errorf("incr answered %q, stored %q, want 211 after both concurrent writes", res.Response, f.data["n"])
+	}
+	if f.execs != 3 {
+		t.Errorf("%d EXECs, want 3", f.execs)
+	}
+	if n := atomic.LoadUint64(&watchConflicts) - before; n != 2 {
+		t.Errorf("%d conflicts counted, want 2", n)
+	}
+}
+
+func TestIncrWatchContention(t *testing.T) {
+	f := useWatch(t)
+	f.data["n"] = "1"
+	f.beforeExec = func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.data["n"] += "0"
+	}
+	if err := IncrHandler(&protocol.McRequest{Key: "n", Increment: 1}, &protocol.McResponse{}); err != errWatchContention {
+		t.Errorf("incr under constant writes: %v", err)
+	}
+	if f.execs != maxWatchAttempts {
+		t.Errorf("%d EXECs, want %d", f.execs, maxWatchAttempts)
+	}
+}
+
+func TestAddGetWatch(t *testing.T) {
+	f := useWatch(t)
+	f.data["taken"] = "old"
+	raced := false
+	f.beforeExec = func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !raced {
+			raced = true
+			f.data["new"] = "winner"
+		}
+	}
+
+	res := &protocol.McResponse{}
+	if err := AddGetHandler(&protocol.McRequest{Command: "add_get", Key: "taken", Flags: "0", Value: []byte("mine")}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "END" || len(res.Values) != 1 || string(res.Values[0].Data) != "old" {
+		t.Errorf("add_get of an existing key %+v", res)
+	}
+
+	// the key is stored by someone else during the transaction: the
+	// retry finds it and answers it
+	res = &protocol.McResponse{}
+	if err := AddGetHandler(&protocol.McRequest{Command: "add_get", Key: "new", Flags: "0", Value: []byte("mine")}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "END" || len(res.Values) != 1 || string(res.Values[0].Data) != "winner" {
+		t.Errorf("add_get losing a race %+v", res)
+	}
+
+	res = &protocol.McResponse{}
+	if err := AddGetHandler(&protocol.McRequest{Command: "add_get", Key: "free", Flags: "0", Value: []byte("mine")}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "STORED" || f.data["free"] != "mine" {
+		t.Errorf("add_get of a free key %q, stored %q", res.Response, f.data["free"])
+	}
+}
@@ -0,0 +1,364 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Write-behind
+//
+// With WRITE_BEHIND_INTERVAL set, `set ... noreply` does not wait for
+// Redis: the item is buffered and written with others every interval, or
+// as soon as WRITE_BEHIND_MAX keys are pending, in one script per batch.
+// A key set again before it is written is only written once, with its
+// last value.
+//
+// The other commands keep seeing buffered items: get answers them from
+// the buffer, set with a reply and delete drop them, and the commands that
+// read the item in Redis (add, add_get, incr, decr) write it first.
+// flush_all discards them and invalidate_tag writes them all first.
+//
+// Buffered items are lost if the process dies or Redis fails when they
+// are written, which is logged and counted in write_behind_dropped. A
+// server shutting down writes them before it closes the backend.
+
+// writeBehindScript sets each key in KEYS to one value and TTL in ARGV,
+// taken in pairs: a TTL of 0 milliseconds is none, a negative one deletes
+// the key as its item expired in the buffer.
+var writeBehindScript = newScript(`
+for i, key in ipairs(KEYS) do
+  local v, px = ARGV[2 * i - 1], tonumber(ARGV[2 * i])
+  if px > 0 then
+    redis.call('SET', key, v, 'PX', px)
+  elseif px == 0 then
+    redis.call('SET', key, v)
+  else
+    redis.call('DEL', key)
+  end
+end
+return #KEYS
+`)
+
+// writeBehindBatch bounds the keys written by one script.
+const writeBehindBatch = 1000
+
+// DefaultWriteBehindMax is the WRITE_BEHIND_MAX used when none is
+// configured.
+const DefaultWriteBehindMax = 1000
+
+// bufferedSet is a set not yet written to Redis.
+type bufferedSet struct {
+	value     []byte    // as stored, see encodeValue
+	exp       ttl       // as given, never past
+	expiresAt time.Time // zero if exp is unlimited
+}
+
+// expired reports whether the item has expired by now.
+func (b bufferedSet) expired(now time.Time) bool {
+	return !b.expiresAt.IsZero() && !now.Before(b.expiresAt)
+}
+
+var writes = struct {
+	mu      sync.Mutex
+	pending map[string]bufferedSet // guarded by mu
+	flight  map[string]bufferedSet // being written, guarded by mu
+
+	flushMu sync.Mutex    // held while a batch is written
+	loopMu  sync.Mutex    // guards stop and stopped
+	stop    chan struct{} // closed to stop writeBehindLoop, nil if it is not running
+	stopped chan struct{} // closed by writeBehindLoop as it returns
+	kick    chan struct{} // wakes writeBehindLoop early
+	dropped uint64        // keys lost to failed writes, accessed atomically
+}{
+	pending: make(map[string]bufferedSet),
+	kick:    make(chan struct{}, 1),
+}
+
+// bufferSet buffers req, whose item expires after exp.
+func bufferSet(req *protocol.McRequest, exp ttl) {
+	b := bufferedSet{value: storedValue(req), exp: exp}
+	if !exp.unlimited {
+		b.expiresAt = time.Now().Add(exp.secs)
+	}
+	startWriteBehind()
+
+	max := config().WriteBehindMax
+	if max <= 0 {
+		max = DefaultWriteBehindMax
+	}
+	writes.mu.Lock()
+	writes.pending[req.Key] = b
+	full := len(writes.pending) >= max
+	writes.mu.Unlock()
+	if full {
+		select {
+		case writes.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startWriteBehind starts writeBehindLoop, unless it is running.
+func startWriteBehind() {
+	writes.loopMu.Lock()
+	defer writes.loopMu.Unlock()
+	if writes.stop == nil {
+		writes.stop, writes.stopped = make(chan struct{}), make(chan struct{})
+		go writeBehindLoop(writes.stop, writes.stopped)
+	}
+}
+
+// stopWriteBehind stops writeBehindLoop, waiting for a batch it is
+// writing, then writes the sets still buffered. A set buffered afterwards
+// starts the loop again. It is called as the server shuts down, once its
+// clients are gone, so that an orderly exit loses no item.
+func stopWriteBehind() {
+	writes.loopMu.Lock()
+	if writes.stop != nil {
+		close(writes.stop)
+		<-writes.stopped
+		writes.stop, writes.stopped = nil, nil
+	}
+	writes.loopMu.Unlock()
+	writeBehindFlush()
+}
+
+// writeBehindLoop writes the buffered sets every WRITE_BEHIND_INTERVAL, or
+// when bufferSet kicks it, until stop is closed. It closes stopped as it
+// returns.
+func writeBehindLoop(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	for {
+		interval := config().WriteBehindInterval
+		if interval <= 0 {
+			interval = time.Second // turned off by a reload, write what is left
+		}
+		select {
+		case <-time.After(interval):
+		case <-writes.kick:
+		case <-stop:
+			return
+		}
+		writeBehindFlush()
+	}
+}
+
+// writeBehindFlush writes all the buffered sets.
+func writeBehindFlush() {
+	writes.flushMu.Lock()
+	defer writes.flushMu.Unlock()
+	writes.mu.Lock()
+	batch := writes.pending
+	writes.pending = make(map[string]bufferedSet)
+	writes.flight = batch
+	writes.mu.Unlock()
+	writeBuffered(batch)
+}
+
+// writeBuffered writes batch, keeping it visible to get meanwhile. The
+// caller holds flushMu, and made batch the flight in the same critical
+// section of mu as it took it out of pending: in between, get would miss
+// the items and delete would not wait for them to be written, leaving them
+// to land after it.
+func writeBuffered(batch map[string]bufferedSet) {
+	defer func() {
+		writes.mu.Lock()
+		writes.flight = nil
+		writes.mu.Unlock()
+	}()
+
+	now := time.Now()
+	keys := make([]string, 0, writeBehindBatch)
+	args := make([]string, 0, 2*writeBehindBatch)
+	write := func() {
+		if _, err := writeBehindScript.Run(keys, args).Result(); err != nil {
+			log.Printf("ERROR: write-behind of %d keys failed: %v", len(keys), err)
+			atomic.AddUint64(&writes.dropped, uint64(len(keys)))
+			if config().NoreplyAudit {
+				for _, key := range keys {
+					logLostWrite("set", key, err.Error())
+				}
+			}
+		} else if config().InvalidationChannel != "" {
+			// only now that the values are in Redis, see publishInvalidations
+			for _, key := range keys {
+				publishInvalidation("invalidate " + key)
+			}
+		}
+		keys, args = keys[:0], args[:0]
+	}
+	for key, b := range batch {
+		exp := b.exp
+		if !exp.unlimited {
+			exp.secs = b.expiresAt.Sub(now)
+		}
+		px := int64(-1)
+		if !b.expired(now) {
+			px = int64(hardTTL(exp) / time.Millisecond)
+			if !exp.unlimited && px <= 0 {
+				px = -1
+			}
+		}
+		keys = append(keys, key)
+		args = append(args, string(b.value), strconv.FormatInt(px, 10))
+		if len(keys) == writeBehindBatch {
+			write()
+		}
+	}
+	if len(keys) > 0 {
+		write()
+	}
+
+	// these cost a command per key, only with STALE_GRACE, TAG_DELIMITER or
+	// MISS_REASONS
+	now = time.Now()
+	for key, b := range batch {
+		if b.expired(now) {
+			continue
+		}
+		exp := b.exp
+		if !exp.unlimited {
+			exp.secs = b.expiresAt.Sub(now)
+		}
+		if err := setStaleDeadline(key, exp); err != nil {
+			log.Printf("ERROR: write-behind of %s: %v", key, err)
+		}
+		if err := tagItem(key); err != nil {
+			log.Printf("ERROR: write-behind of %s: %v", key, err)
+		}
+		if err := recordStore(key, exp); err != nil {
+			log.Printf("ERROR: write-behind of %s: %v", key, err)
+		}
+	}
+}
+
+// settleWrite writes the buffered set of key, if any, so that a command
+// reading the item in Redis finds it.
+func settleWrite(key string) {
+	writes.mu.Lock()
+	_, pending := writes.pending[key]
+	_, inFlight := writes.flight[key]
+	writes.mu.Unlock()
+	if !pending && !inFlight {
+		return
+	}
+
+	writes.flushMu.Lock()
+	defer writes.flushMu.Unlock()
+	writes.mu.Lock()
+	b, ok := writes.pending[key]
+	delete(writes.pending, key)
+	batch := map[string]bufferedSet{key: b}
+	if ok {
+		writes.flight = batch
+	}
+	writes.mu.Unlock()
+	if ok {
+		writeBuffered(batch)
+	}
+}
+
+// forgetWrite drops the buffered set of key before it is replaced or
+// deleted, waiting for it if it is being written. It reports whether key
+// held an unexpired buffered item.
+func forgetWrite(key string) bool {
+	writes.mu.Lock()
+	b, pending := writes.pending[key]
+	delete(writes.pending, key)
+	f, inFlight := writes.flight[key]
+	writes.mu.Unlock()
+	if inFlight {
+		writes.flushMu.Lock()
+		writes.flushMu.Unlock()
+	}
+	now := time.Now()
+	return (pending && !b.expired(now)) || (inFlight && !f.expired(now))
+}
+
+// discardWrites drops the buffered sets of the keys starting with prefix,
+// for flush_all, after any batch being written has landed.
+func discardWrites(prefix string) {
+	writes.flushMu.Lock()
+	defer writes.flushMu.Unlock()
+	writes.mu.Lock()
+	defer writes.mu.Unlock()
+	for key := range writes.pending {
+		if strings.HasPrefix(key, prefix) {
+			delete(writes.pending, key)
+		}
+	}
+}
+
+// bufferedValues looks up keys in the buffer. It returns nil if none is
+// buffered, otherwise the buffered set of each key, nil if it has none.
+func bufferedValues(keys []string) []*bufferedSet {
+	writes.mu.Lock()
+	defer writes.mu.Unlock()
+	if len(writes.pending) == 0 && len(writes.flight) == 0 {
+		return nil
+	}
+	var found []*bufferedSet
+	for i, key := range keys {
+		b, ok := writes.pending[key]
+		if !ok {
+			b, ok = writes.flight[key]
+		}
+		if !ok {
+			continue
+		}
+		if found == nil {
+			found = make([]*bufferedSet, len(keys))
+		}
+		found[i] = &b
+	}
+	return found
+}
+
+// pendingWrites returns the number of buffered sets, for stats.
+func pendingWrites() int {
+	writes.mu.Lock()
+	defer writes.mu.Unlock()
+	return len(writes.pending) + len(writes.flight)
+}
+
+// getBuffered is GetHandler when some of the keys have buffered sets: the
+// others are looked up with get, and the values merged in request order.
+func getBuffered(cfg *Config, req *protocol.McRequest, res *protocol.McResponse, buffered []*bufferedSet, get getFn) error {
+	backendReq := &protocol.McRequest{Command: req.Command}
+	for i, key := range req.Keys {
+		if buffered[i] == nil {
+			backendReq.Keys = append(backendReq.Keys, key)
+		}
+	}
+	backendRes := &protocol.McResponse{}
+	if len(backendReq.Keys) > 0 {
+		if err := get(cfg, backendReq, backendRes); err != nil {
+			return err
+		}
+		if backendRes.Response != "END" {
+			*res = *backendRes // GET_WRONGTYPE=error
+			return nil
+		}
+	}
+
+	now := time.Now()
+	j := 0
+	for i, key := range req.Keys {
+		if b := buffered[i]; b != nil {
+			hotKeys.record(key)
+			if flags, data, ok := decodeValue(string(b.value)); ok && !b.expired(now) {
+				res.Values = append(res.Values, protocol.McValue{Key: key, Flags: strconv.FormatUint(uint64(flags), 10), Data: []byte(data)})
+			}
+		} else if j < len(backendRes.Values) && backendRes.Values[j].Key == key {
+			res.Values = append(res.Values, backendRes.Values[j])
+			j++
+		}
+	}
+	res.Response = "END"
+	return nil
+}
@@ -0,0 +1,356 @@
+package rcdaemon
+
+import (
+	"../protocol"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useWriteBehind turns write-behind on for the test and drops whatever it
+// leaves buffered. The loop is restarted, so that the first flush comes
+// after interval, not that of an earlier test.
+func useWriteBehind(t *testing.T, interval time.Duration, max int) {
+	withConfig(t, func(cfg *Config) {
+		cfg.WriteBehindInterval = interval
+		cfg.WriteBehindMax = max
+	})
+	stopWriteBehind()
+	t.Cleanup(func() {
+		writes.flushMu.Lock()
+		defer writes.flushMu.Unlock()
+		writes.mu.Lock()
+		defer writes.mu.Unlock()
+		writes.pending = make(map[string]bufferedSet)
+	})
+}
+
+func bufferedSetReq(key, flags string, exptime int64, value string) *protocol.McRequest {
+	return &protocol.McRequest{Command: "set", Key: key, Flags: flags, Exptime: exptime, Value: []byte(value), Noreply: true}
+}
+
+func TestWriteBehindCoalesces(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 100)
+
+	for _, v := range []string{"1", "2", "3"} {
+		if err := SetHandler(bufferedSetReq("k", "0", 60, v), &protocol.McResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetHandler(bufferedSetReq("other", "0", 0, "x"), &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.data["k"]; ok {
+		t.Fatalf("noreply set written before the flush")
+	}
+	if n := pendingWrites(); n != 2 {
+		t.Errorf("%d pending writes, want 2", n)
+	}
+
+	writeBehindFlush()
+	if f.evals != 1 {
+		t.Errorf("%d scripts for one flush, want 1", f.evals)
+	}
+	if f.data["k"] != "3" || f.data["other"] != "x" {
+		t.Errorf("flushed %q", f.data)
+	}
+	if ttl := f.ttls["k"]; ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("TTL %v, want about 1m", ttl)
+	}
+	if f.ttls["other"] != 0 {
+		t.Errorf("TTL %v for an item without one", f.ttls["other"])
+	}
+	if n := pendingWrites(); n != 0 {
+		t.Errorf("%d pending writes after the flush", n)
+	}
+}
+
+func TestWriteBehindReadYourWrites(t *testing.T) {
+	f := useFakeBackend(t)
+	f.data["a"] = "old"
+	f.data["b"] = "2"
+	useWriteBehind(t, time.Hour, 100)
+
+	SetHandler(bufferedSetReq("a", "5", 0, "new"), &protocol.McResponse{})
+	SetHandler(bufferedSetReq("c", "0", 0, "3"), &protocol.McResponse{})
+
+	res := &protocol.McResponse{}
+	if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"a", "missing", "b", "c", "a"}}, res); err != nil {
+		t.Fatal(err)
+	}
+	want := []protocol.McValue{
+		{Key: "a", Flags: "5", Data: []byte("new")},
+		{Key: "b", Flags: "0", Data: []byte("2")},
+		{Key: "c", Flags: "0", Data: []byte("3")},
+		{Key: "a", Flags: "5", Data: []byte("new")},
+	}
+	if len(res.Values) != len(want) {
+		t.Fatalf("got %d values, want %d: %+v", len(res.Values), len(want), res.Values)
+	}
+	for i, v := range res.Values {
+		if v.Key != want[i].Key || v.Flags != want[i].Flags || string(v.Data) != string(want[i].Data) {
+			t.Errorf("value %d is %s %s %q, want %s %s %q", i, v.Key, v.Flags, v.Data, want[i].Key, want[i].Flags, want[i].Data)
+		}
+	}
+	if res.Response != "END" {
+		t.Errorf("response %q", res.Response)
+	}
+}
+
+func TestWriteBehindDeleteAndReplyingSet(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 100)
+
+	SetHandler(bufferedSetReq("d", "0", 0, "buffered"), &protocol.McResponse{})
+	res := &protocol.McResponse{}
+	if err := DeleteHandler(&protocol.McRequest{Command: "delete", Key: "d"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "DELETED" {
+		t.Errorf("delete of a buffered item %q", res.Response)
+	}
+
+	SetHandler(bufferedSetReq("s", "0", 0, "buffered"), &protocol.McResponse{})
+	if err := SetHandler(&protocol.McRequest{Command: "set", Key: "s", Flags: "0", Value: []byte("direct")}, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	writeBehindFlush()
+	if _, ok := f.data["d"]; ok {
+		t.Errorf("deleted item written by the flush")
+	}
+	if f.data["s"] != "direct" {
+		t.Errorf("set overwritten by the flush: %q", f.data["s"])
+	}
+}
+
+func TestWriteBehindSettlesBeforeIncrAndAdd(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 100)
+
+	SetHandler(bufferedSetReq("n", "0", 0, "41"), &protocol.McResponse{})
+	res := &protocol.McResponse{}
+	if err := IncrHandler(&protocol.McRequest{Command: "incr", Key: "n", Increment: 1}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "42" {
+		t.Errorf("incr of a buffered item %q", res.Response)
+	}
+
+	SetHandler(bufferedSetReq("a", "0", 0, "first"), &protocol.McResponse{})
+	res = &protocol.McResponse{}
+	if err := AddHandler(&protocol.McRequest{Command: "add", Key: "a", Flags: "0", Value: []byte("second")}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response != "NOT_STORED" {
+		t.Errorf("add over a buffered item %q", res.Response)
+	}
+	if f.data["a"] != "first" {
+		t.Errorf("stored %q", f.data["a"])
+	}
+}
+
+func TestWriteBehindFlushAllDiscards(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 100)
+
+	SetHandler(bufferedSetReq("k", "0", 0, "v"), &protocol.McResponse{})
+	if err := FlushAllHandler(&protocol.McRequest{Command: "flush_all"}, &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	writeBehindFlush()
+	if _, ok := f.data["k"]; ok {
+		t.Errorf("buffered item written after flush_all")
+	}
+}
+
+// waitWritten waits for the write-behind loop to store key.
+func waitWritten(t *testing.T, f *fakeBackend, key string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		f.mu.Lock()
+		_, ok := f.data[key]
+		f.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%s not written", key)
+}
+
+func TestWriteBehindFlushesWhenFull(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 2)
+
+	SetHandler(bufferedSetReq("a", "0", 0, "1"), &protocol.McResponse{})
+	SetHandler(bufferedSetReq("b", "0", 0, "2"), &protocol.McResponse{})
+	waitWritten(t, f, "b")
+}
+
+func TestWriteBehindFlushesOnTimer(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, 10*time.Millisecond, 100)
+
+	SetHandler(bufferedSetReq("t", "0", 0, "1"), &protocol.McResponse{})
+	// the loop may be waiting out the interval of an earlier test
+	select {
+	case writes.kick <- struct{}{}:
+	default:
+	}
+	waitWritten(t, f, "t")
+}
+
+// flushing calls writeBehindFlush over and over until the test ends, to
+// interleave batches with the requests of the test.
+func flushing(t *testing.T) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				writeBehindFlush()
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+}
+
+func TestWriteBehindConcurrentSetGet(t *testing.T) {
+	useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 100)
+	flushing(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		key := fmt.Sprintf("k%d", w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				v := strconv.Itoa(i)
+				SetHandler(bufferedSetReq(key, "0", 0, v), &protocol.McResponse{})
+				res := &protocol.McResponse{}
+				if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{key}}, res); err != nil {
+					t.Error(err)
+					return
+				}
+				if len(res.Values) != 1 || string(res.Values[0].Data) != v {
+					t.Errorf("get %s after setting it to %s: %+v", key, v, res.Values)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWriteBehindConcurrentSetDelete(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 100)
+	flushing(t)
+
+	for i := 0; i < 500; i++ {
+		SetHandler(bufferedSetReq("k", "0", 0, strconv.Itoa(i)), &protocol.McResponse{})
+		if err := DeleteHandler(&protocol.McRequest{Command: "delete", Key: "k"}, &protocol.McResponse{}); err != nil {
+			t.Fatal(err)
+		}
+		writes.flushMu.Lock() // no batch is being written
+		f.mu.Lock()
+		v, ok := f.data["k"]
+		f.mu.Unlock()
+		writes.flushMu.Unlock()
+		if ok {
+			t.Fatalf("set %d written after its delete: %q", i, v)
+		}
+	}
+}
+
+func TestWriteBehindWrittenOnShutdown(t *testing.T) {
+	srv, f := startTestServer(t)
+	useWriteBehind(t, time.Hour, 100)
+	c := dialTestServer(t, srv)
+	c.send(t, "set k 0 0 1 noreply\r\nv\r\nversion\r\n")
+	c.readLine(t)
+	f.mu.Lock()
+	_, written := f.data["k"]
+	f.mu.Unlock()
+	if written {
+		t.Fatal("noreply set written before the flush")
+	}
+
+	c.Close()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the buffered set to be written", func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.data["k"] == "v"
+	})
+}
+
+func TestWriteBehindExpiredNotCapped(t *testing.T) {
+	f := useFakeBackend(t)
+	useWriteBehind(t, time.Hour, 100)
+	withConfig(t, func(cfg *Config) {
+		cfg.MaxTTL = time.Minute
+		cfg.TTLMode = TTLModeMilliseconds
+	})
+	before := atomic.LoadInt64(&cappedTTLs)
+
+	if err := SetHandler(bufferedSetReq("k", "0", 10, "v"), &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	writeBehindFlush()
+	if _, ok := f.data["k"]; ok {
+		t.Error("expired item written")
+	}
+	if n := atomic.LoadInt64(&cappedTTLs) - before; n != 0 {
+		t.Errorf("%d writes capped, want 0", n)
+	}
+}
+
+// An item buffered by write-behind with a 500ms TTL expires in under a
+// second, though it is not written yet.
+func TestWriteBehindMillisecondTTL(t *testing.T) {
+	useFakeBackend(t)
+	withConfig(t, func(cfg *Config) { cfg.TTLMode = TTLModeMilliseconds })
+	useWriteBehind(t, time.Hour, 100) // w stays buffered, the fake does not expire what is written
+	start := time.Now()
+	if err := SetHandler(bufferedSetReq("w", "0", 500, "v"), &protocol.McResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	get := func() int {
+		res := &protocol.McResponse{}
+		if err := GetHandler(&protocol.McRequest{Command: "get", Keys: []string{"w"}}, res); err != nil {
+			t.Fatal(err)
+		}
+		return len(res.Values)
+	}
+	if get() != 1 {
+		t.Fatal("w missed at once")
+	}
+	for get() == 1 {
+		if time.Since(start) > time.Second {
+			t.Fatal("w still hit after a second")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("w expired after %v, before its TTL", elapsed)
+	}
+}